@@ -1,21 +1,35 @@
 package main
 
 import (
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alexedwards/scs/postgresstore"
 	"github.com/alexedwards/scs/v2"
+	"github.com/cepa995/go-web-template/internal/accountpurge"
 	"github.com/cepa995/go-web-template/internal/config"
 	"github.com/cepa995/go-web-template/internal/driver"
+	"github.com/cepa995/go-web-template/internal/encryption"
+	"github.com/cepa995/go-web-template/internal/forms"
 	"github.com/cepa995/go-web-template/internal/handlers"
 	"github.com/cepa995/go-web-template/internal/helpers"
-	"github.com/cepa995/go-web-template/internal/models"
-	render "github.com/cepa995/go-web-template/internal/renderer"
+	"github.com/cepa995/go-web-template/internal/logging"
+	"github.com/cepa995/go-web-template/internal/mailer"
+	"github.com/cepa995/go-web-template/internal/mailqueue"
+	"github.com/cepa995/go-web-template/internal/oidc"
+	"github.com/cepa995/go-web-template/internal/passwords"
+	"github.com/cepa995/go-web-template/internal/ratelimit"
+	render "github.com/cepa995/go-web-template/internal/render"
+	"github.com/cepa995/go-web-template/internal/urlsigner"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var app config.AppConfig        // Application Configuration
@@ -26,54 +40,68 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.SQL.Close()
 
-	defer close(app.MailChan)
-	listenForMail()
+	mailQueue := mailqueue.New(handlers.Repo.DB, app.Mailer.Send, app.MailWorkers, app.MailMaxAttempts, app.Logger)
+	mailQueue.Start()
 
-	app.InfoLog.Printf("Starting application on port %s", portNumber)
+	accountPurger := accountpurge.New(handlers.Repo.DB, app.DeletionGracePeriod, app.Logger)
+	accountPurger.Start()
+
+	app.Logger.Info("starting application", "port", portNumber)
 	srv := &http.Server{
-		Addr:    portNumber,
-		Handler: routes(&app),
+		Addr:     portNumber,
+		Handler:  routes(&app),
+		ErrorLog: app.Logger.StdLogger(logging.LevelError),
 	}
 
-	err = srv.ListenAndServe()
-	if err != nil {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	// Wait for SIGINT/SIGTERM (e.g. during rolling deploys) or for the server to fail
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	failed := false
+	select {
+	case err = <-serverErr:
+		app.Logger.Error("server stopped", "err", err)
+		failed = true
+	case sig := <-quit:
+		app.Logger.Info("shutting down", "signal", sig)
+	}
+
+	if err = shutdown(srv, db, mailQueue, accountPurger); err != nil {
 		log.Fatal(err)
 	}
+	if failed {
+		os.Exit(1)
+	}
+	app.Logger.Info("application stopped")
 }
 
 func run() (*driver.DB, string, error) {
-	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime)
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
-
-	// Read Flags
-	inProduction := flag.Bool("production", true, "Application is in production")
-	useCache := flag.Bool("cache", false, "Use template cache")
-	portNumber := flag.String("portNumber", ":8080", "")
-	dbHost := flag.String("dbhost", "localhost", "Database host")
-	dbName := flag.String("dbname", "", "Database name")
-	dbUser := flag.String("dbuser", "", "Database user")
-	dbPassword := flag.String("dbpassword", "", "Database password")
-	dbPort := flag.String("dbport", "5432", "Database port")
-	dbSSL := flag.String("dbssl", "disable", "Database ssl settings (disable, prefer, require)")
-
-	flag.StringVar(&app.SecretKey, "secret", "", "secret key for hashing email data")
-	flag.StringVar(&app.FrontEnd, "frontend", "", "URL to front end")
-	flag.StringVar(&app.SMTP.Host, "smtphost", "", "smtp host")
-	flag.StringVar(&app.SMTP.Username, "smtpuser", "", "smtp user")
-	flag.StringVar(&app.SMTP.Password, "smtppass", "", "smtp password")
-	flag.IntVar(&app.SMTP.Port, "smtpport", 587, "smtp port")
-	flag.Parse()
-
-	if *dbName == "" || *dbPassword == "" || *dbUser == "" {
-		app.ErrorLog.Println("Missing required flags")
-		os.Exit(1)
+	// Read configuration from database.yml, APP_* environment variables and flags
+	args, err := app.Load(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Create logger selected with -logformat and -loglevel
+	level, err := logging.ParseLevel(app.LogLevel)
+	if err != nil {
+		return nil, "", err
+	}
+	app.Logger, err = logging.New(os.Stdout, app.LogFormat, level)
+	if err != nil {
+		return nil, "", err
 	}
 
-	app.InProduction = *inProduction
+	if app.DB.Database == "" || app.DB.Password == "" || app.DB.User == "" {
+		app.Logger.Error("missing required database settings (dbname, dbuser, dbpassword)")
+		os.Exit(1)
+	}
 
 	// Step 1. Create User Session
 	session = scs.New()
@@ -83,31 +111,185 @@ func run() (*driver.DB, string, error) {
 	session.Cookie.Secure = app.InProduction
 
 	// Step 2. Connect to the database
-	app.InfoLog.Println("Trying to Connect to PostgreSQL Database ")
-	connectionString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", *dbHost, *dbPort, *dbName, *dbUser, *dbPassword, *dbSSL)
-	db, err := driver.ConnectSQL(connectionString)
+	app.Logger.Info("connecting to PostgreSQL database", "host", app.DB.Host, "dbname", app.DB.Database)
+	db, err := driver.ConnectSQL(app.DB.DSN())
 	if err != nil {
-		app.ErrorLog.Fatal("Cannot connect to PostgreSQL database")
+		app.Logger.Error("cannot connect to PostgreSQL database", "err", err)
+		os.Exit(1)
+	}
+	if app.DB.Pool > 0 {
+		db.SQL.SetMaxOpenConns(app.DB.Pool)
+	}
+	app.Logger.Info("connected to PostgreSQL database")
+
+	// Step 2.1. Run "migrate" subcommand instead of starting the web server
+	if len(args) > 0 && args[0] == "migrate" {
+		err = migrateCommand(db, args[1:])
+		db.SQL.Close()
+		if err != nil {
+			app.Logger.Error("migration failed", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
-	app.InfoLog.Println("Successfully Connected to PostgreSQL Database")
 
 	// 3. Save a session to the database
 	session.Store = postgresstore.NewWithCleanupInterval(db.SQL, 30*time.Minute)
 	app.Session = session
 
-	// Step 3. Create Template Cache
+	// 3.1. Create store which rate limits of auth endpoints are counted in
+	app.RateLimiter, err = newRateLimiter(db)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Step 3. Create mail backend used by the mail queue workers
+	app.Mailer, err = newMailer()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Step 3.1. Create key ring for data encrypted at rest (e.g. TOTP secrets)
+	app.Encryption, err = newKeyRing()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Step 3.2. Create signer of links sent via email, so expired and modified links can be told apart
+	app.URLSigner, err = newURLSigner()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Step 3.3. Create clients of OpenID Connect providers users can sign in with
+	for _, cfg := range app.OIDCConfigs {
+		app.OIDC = append(app.OIDC, oidc.NewProvider(cfg, nil))
+	}
+
+	// Step 3.3. Create policy passwords chosen by users have to satisfy
+	app.PasswordPolicy, err = newPasswordPolicy()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Step 3.4. Create hasher of new passwords; hashes created with other settings are upgraded on sign-in
+	app.PasswordHasher, err = newPasswordHasher()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Step 4. Create Template Cache
 	tc, err := render.CreateTemplateCache()
 	if err != nil {
-		app.ErrorLog.Fatal(fmt.Sprintf("Cannot create Template Cache due to - %v", err))
+		app.Logger.Error("cannot create template cache", "err", err)
+		os.Exit(1)
 	}
 	app.TemplateCache = tc
-	app.UseCache = *useCache
 
 	repo := handlers.NewRepo(&app, db)
 	handlers.NewHandlers(repo)
 	render.NewRenderer(&app)
 	helpers.NewHelpers(&app)
 
-	return db, *portNumber, nil
+	return db, app.Port, nil
 
 }
+
+// newMailer creates mail backend selected with -mailbackend
+func newMailer() (mailer.Mailer, error) {
+	switch app.MailBackend {
+	case "smtp":
+		return mailer.NewSMTP(app.SMTP.Host, app.SMTP.Port, app.SMTP.Username, app.SMTP.Password, app.SMTP.Encryption)
+	case "file":
+		return mailer.NewFile(app.MailDir)
+	case "memory":
+		return mailer.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unsupported mail backend %s", app.MailBackend)
+	}
+}
+
+// newRateLimiter creates rate limit store selected with -ratelimitstore
+func newRateLimiter(db *driver.DB) (ratelimit.Store, error) {
+	switch app.RateLimitStore {
+	case "memory":
+		return ratelimit.NewMemoryStore(time.Minute), nil
+	case "postgres":
+		return ratelimit.NewPostgresStore(db.SQL, time.Minute, app.Logger), nil
+	default:
+		return nil, fmt.Errorf("unsupported rate limit store %s", app.RateLimitStore)
+	}
+}
+
+// newKeyRing creates key ring from -encryptionkeys. Without them data is encrypted with a key derived from
+// -secret. The hash of -secret is also the key of values written in the old AES-CFB format.
+func newKeyRing() (*encryption.KeyRing, error) {
+	keys, err := encryption.ParseKeys(app.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		if app.SecretKey == "" && app.InProduction {
+			return nil, errors.New("-encryptionkeys or -secret is required in production")
+		}
+		derived := sha256.Sum256([]byte("encryption:" + app.SecretKey))
+		keys = []encryption.Key{{ID: "secret", Secret: derived[:]}}
+	}
+
+	legacy := sha256.Sum256([]byte(app.SecretKey))
+	return encryption.NewKeyRing(keys, legacy[:])
+}
+
+// minSecretKeyLength is the minimum length of -secret in production, where it keys signed links
+const minSecretKeyLength = 32
+
+// newURLSigner creates signer of links sent via email, keyed with -secret
+func newURLSigner() (*urlsigner.Signer, error) {
+	if len(app.SecretKey) < minSecretKeyLength && app.InProduction {
+		return nil, fmt.Errorf("-secret of at least %d characters is required in production", minSecretKeyLength)
+	}
+	return urlsigner.New([]byte(app.SecretKey)), nil
+}
+
+// newPasswordPolicy creates password policy from -passwordminlength, -passwordclasses and -breachedpasswords
+func newPasswordPolicy() (forms.PasswordPolicy, error) {
+	policy := forms.DefaultPasswordPolicy()
+	policy.MinLength = app.PasswordMinLength
+	policy.MinClasses = app.PasswordClasses
+
+	if app.BreachedPasswordsFile != "" {
+		f, err := os.Open(app.BreachedPasswordsFile)
+		if err != nil {
+			return policy, err
+		}
+		defer f.Close()
+
+		policy.Breached, err = policy.Breached.Extend(f)
+		if err != nil {
+			return policy, fmt.Errorf("%s: %w", app.BreachedPasswordsFile, err)
+		}
+	}
+	return policy, nil
+}
+
+// newPasswordHasher creates password hasher selected with -passwordhash
+func newPasswordHasher() (passwords.Hasher, error) {
+	switch app.PasswordHash {
+	case "argon2id":
+		if app.Argon2Memory < 8*1024 || app.Argon2Iterations < 1 {
+			return nil, fmt.Errorf("-argon2memory must be at least 8192 and -argon2iterations at least 1")
+		}
+		hasher := passwords.DefaultArgon2id()
+		hasher.Memory = uint32(app.Argon2Memory)
+		hasher.Iterations = uint32(app.Argon2Iterations)
+		return hasher, nil
+	case "bcrypt":
+		if app.BcryptCost < bcrypt.MinCost || app.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("-bcryptcost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return passwords.Bcrypt{Cost: app.BcryptCost}, nil
+	default:
+		return nil, fmt.Errorf("unsupported password hash %s", app.PasswordHash)
+	}
+}
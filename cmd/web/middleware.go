@@ -2,17 +2,26 @@ package main
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/logging"
+	"github.com/go-chi/chi/middleware"
 	"github.com/justinas/nosurf"
 )
 
+// requestIDHeader is the header request IDs are read from and written to
+const requestIDHeader = "X-Request-ID"
+
 // NoSurf ceate new CSRF handler by utilizing github.com/justinas/nosurf package
 // and set base cookie. This middleware allows us to ignore any POST request that
-// does not have proper CSRF token.
+// does not have proper CSRF token. The JSON API is exempt; it authenticates with bearer
+// tokens instead of cookies, so it cannot be abused by cross-site requests.
 func NoSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/api/")
+	})
 
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
@@ -42,14 +51,56 @@ func StopPageCache(next http.Handler) http.Handler {
 	})
 }
 
-// IsAdmin checks if logged in user has Administrative access level for accesing particular page.
-func IsAdmin(next http.Handler) http.Handler {
+// RequestID gives every request an ID, stored in its context so log entries, repository calls and
+// queued mail can be traced back to it. An ID sent by a proxy in X-Request-ID is kept if it looks
+// sane; the ID is always sent back in the same header.
+func RequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !helpers.CheckAuthorization(r, 3) {
-			session.Put(r.Context(), "error", "Requires authorized access!")
-			http.Redirect(w, r, "/unauthorized_access", http.StatusSeeOther)
-			return
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = logging.NewRequestID()
 		}
-		next.ServeHTTP(w, r)
+		w.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
 	})
 }
+
+// AccessLog writes an entry for every request with its status, size of the response and how long
+// it took
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		defer func() {
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			app.Logger.FromContext(r.Context()).Info("request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", status,
+				"bytes", ww.BytesWritten(),
+				"duration", time.Since(start),
+				"ip", r.RemoteAddr,
+			)
+		}()
+
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// validRequestID returns true if id is at most 64 letters, digits and dashes
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
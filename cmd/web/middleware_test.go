@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/cepa995/go-web-template/internal/logging"
 )
 
 func TestNoSurf(t *testing.T) {
@@ -47,3 +52,60 @@ func TestStopPageCache(t *testing.T) {
 		t.Error(fmt.Sprintf("type is not http.Handler, but is %t", v))
 	}
 }
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		kept     bool
+	}{
+		{"missing", "", false},
+		{"from-proxy", "3f2a-Proxy-1", true},
+		{"invalid", "bad id\n", false},
+		{"too-long", strings.Repeat("a", 65), false},
+	}
+
+	for _, e := range tests {
+		var fromContext string
+		h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fromContext = logging.RequestID(r.Context())
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", e.incoming)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		header := rr.Header().Get("X-Request-ID")
+		if header == "" || header != fromContext {
+			t.Errorf("%s: expected the same ID in header and context, got %q and %q", e.name, header, fromContext)
+		}
+		if (header == e.incoming) != e.kept {
+			t.Errorf("%s: expected incoming ID kept to be %t, got %q", e.name, e.kept, header)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := logging.New(&buf, logging.FormatLogfmt, logging.LevelInfo)
+	app.Logger = logger
+
+	h := RequestID(AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("short and stout"))
+	})))
+	req := httptest.NewRequest("POST", "/auth/signin?email=jon@example.com", nil)
+	req.Header.Set("X-Request-ID", "access-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	entry := buf.String()
+	for _, expected := range []string{"msg=request", "request_id=access-1", "method=POST", "path=/auth/signin ", "status=418", "bytes=15", "duration="} {
+		if !strings.Contains(entry, expected) {
+			t.Errorf("expected %q in access log entry %s", expected, entry)
+		}
+	}
+	if strings.Contains(entry, "jon@example.com") {
+		t.Errorf("expected query string not to be logged, got %s", entry)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/cepa995/go-web-template/internal/driver"
+	"github.com/cepa995/go-web-template/internal/migrate"
+)
+
+const migrateUsage = "usage: migrate up | down | status | goto N"
+
+// migrateCommand handles "migrate" subcommand, e.g. ./app -dbname=db -dbuser=postgres -dbpassword=password migrate up
+func migrateCommand(db *driver.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	m, err := migrate.New(db.SQL)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		err = m.Up()
+	case "down":
+		err = m.Down()
+	case "goto":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil || version < 0 {
+			return fmt.Errorf("invalid migration version %s", args[1])
+		}
+		err = m.Goto(version)
+	case "status":
+		return printMigrationStatus(m)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	if errors.Is(err, migrate.ErrNoChange) {
+		app.Logger.Info("database schema is already up to date")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	app.Logger.Info("database schema migrated", "version", version)
+	return nil
+}
+
+// printMigrationStatus writes a table of all known migrations and whether they have been applied.
+func printMigrationStatus(m *migrate.Migrator) error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	return w.Flush()
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/cepa995/go-web-template/internal/config"
 	"github.com/cepa995/go-web-template/internal/handlers"
+	"github.com/cepa995/go-web-template/internal/models"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
@@ -15,9 +16,13 @@ import (
 func routes(app *config.AppConfig) http.Handler {
 	mux := chi.NewRouter()
 
+	mux.Use(RequestID)
+	mux.Use(AccessLog)
 	mux.Use(middleware.Recoverer)
 	mux.Use(NoSurf)
 	mux.Use(SessionLoad)
+	mux.Use(handlers.Repo.LoadUserSession)
+	mux.Use(handlers.Repo.LoadPermissions)
 	//mux.Use(StopPageCache)
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
@@ -31,20 +36,90 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Handle("/assets/*", http.StripPrefix("/assets", assetsFileServer))
 
 	mux.Get("/", handlers.Repo.Home)
+	mux.Get("/unauthorized_access", handlers.Repo.Unauthorized)
+
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(handlers.Repo.RequirePermission(models.PermissionAdminAccess))
+		mux.Get("/", handlers.Repo.Admin)
+
+		mux.With(handlers.Repo.RequirePermission(models.PermissionUsersRead)).Get("/users", handlers.Repo.AdminUsers)
+		mux.With(handlers.Repo.RequirePermission(models.PermissionUsersRead)).Get("/users/{id}", handlers.Repo.AdminShowUser)
+		mux.With(handlers.Repo.RequirePermission(models.PermissionRolesWrite)).Post("/users/{id}/roles", handlers.Repo.AdminUpdateRoles)
+		mux.With(handlers.Repo.RequirePermission(models.PermissionAuditRead)).Get("/audit", handlers.Repo.AdminAudit)
+		mux.With(handlers.Repo.RequirePermission(models.PermissionAuditRead)).Get("/audit/export", handlers.Repo.AdminAuditExport)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(handlers.Repo.RequirePermission(models.PermissionUsersWrite))
+			mux.Post("/users/{id}", handlers.Repo.AdminUpdateUser)
+			mux.Post("/users/{id}/block", handlers.Repo.AdminBlockUser)
+			mux.Post("/users/{id}/unblock", handlers.Repo.AdminUnblockUser)
+			mux.Post("/users/{id}/reset-password", handlers.Repo.AdminResetPassword)
+			mux.Post("/users/{id}/reset-2fa", handlers.Repo.AdminResetTwoFactor)
+			mux.Post("/users/{id}/delete", handlers.Repo.AdminDeleteUser)
+		})
+	})
 	mux.Route("/auth", func(mux chi.Router) {
 		mux.Get("/", handlers.Repo.ShowAuth)
 
-		mux.Post("/signin", handlers.Repo.PostSignIn)
-		mux.Post("/signup", handlers.Repo.PostSignUp)
+		mux.With(handlers.Repo.RateLimit(handlers.SignInLimit)).Post("/signin", handlers.Repo.PostSignIn)
+		mux.With(handlers.Repo.RateLimit(handlers.SignUpLimit), handlers.Repo.RateLimit(handlers.SignUpEmailLimit)).Post("/signup", handlers.Repo.PostSignUp)
 		mux.Get("/signout", handlers.Repo.SignOut)
 
-		mux.Get("/activate-accoutn", handlers.Repo.ShowActivateUserAccount)
-		mux.Post("/activate-accoutn", handlers.Repo.ActivateUserAccount)
+		mux.Get("/two-factor", handlers.Repo.ShowTwoFactorChallenge)
+		mux.With(handlers.Repo.RateLimit(handlers.SignInLimit)).Post("/two-factor", handlers.Repo.PostTwoFactorChallenge)
+
+		mux.With(handlers.Repo.RateLimit(handlers.MagicLinkLimit), handlers.Repo.RateLimit(handlers.MagicLinkEmailLimit)).Post("/magic-link", handlers.Repo.SendMagicLink)
+		mux.Get("/magic-link", handlers.Repo.ShowMagicLink)
+		mux.With(handlers.Repo.RateLimit(handlers.SignInLimit)).Post("/magic-link/signin", handlers.Repo.MagicLinkSignIn)
+
+		mux.Get("/oidc/{provider}", handlers.Repo.OIDCSignIn)
+		mux.With(handlers.Repo.RateLimit(handlers.SignInLimit)).Get("/oidc/{provider}/callback", handlers.Repo.OIDCCallback)
+
+		mux.Get("/activate-account", handlers.Repo.ShowActivateUserAccount)
+		mux.Post("/activate-account", handlers.Repo.ActivateUserAccount)
 
 		mux.Get("/forgot-password", handlers.Repo.ForgotPassword)
+		mux.With(handlers.Repo.RateLimit(handlers.ForgotPasswordLimit), handlers.Repo.RateLimit(handlers.ForgotPasswordEmailLimit)).Post("/forgot-password", handlers.Repo.SendPasswordResetEmail)
 		mux.Get("/reset-password", handlers.Repo.ShowResetPassword)
 		mux.Post("/reset-password", handlers.Repo.ResetPassword)
 
+		mux.Get("/unlock-account", handlers.Repo.UnlockAccount)
+		mux.Get("/confirm-email", handlers.Repo.ConfirmEmailChange)
+		mux.Get("/delete-account", handlers.Repo.ShowDeleteAccount)
+		mux.Post("/delete-account", handlers.Repo.DeleteAccount)
+
+	})
+
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Use(handlers.Repo.RequireAuth)
+		mux.Get("/", handlers.Repo.ShowAccount)
+		mux.Post("/profile", handlers.Repo.UpdateProfile)
+		mux.With(handlers.Repo.RateLimit(handlers.ConfirmPasswordLimit)).Post("/password", handlers.Repo.ChangePassword)
+		mux.With(handlers.Repo.RateLimit(handlers.ConfirmPasswordLimit)).Post("/email", handlers.Repo.ChangeEmail)
+		mux.Get("/export", handlers.Repo.ExportAccountData)
+		mux.With(handlers.Repo.RateLimit(handlers.ConfirmPasswordLimit)).Post("/delete", handlers.Repo.RequestAccountDeletion)
+
+		mux.Get("/two-factor", handlers.Repo.ShowTwoFactor)
+		mux.Post("/two-factor/enable", handlers.Repo.EnableTwoFactor)
+		mux.With(handlers.Repo.RateLimit(handlers.ConfirmPasswordLimit)).Post("/two-factor/disable", handlers.Repo.DisableTwoFactor)
+		mux.With(handlers.Repo.RateLimit(handlers.ConfirmPasswordLimit)).Post("/two-factor/recovery-codes", handlers.Repo.RegenerateRecoveryCodes)
+
+		mux.Get("/sessions", handlers.Repo.ShowSessions)
+		mux.Post("/sessions/{id}/revoke", handlers.Repo.RevokeSession)
+		mux.Post("/sessions/revoke-all", handlers.Repo.RevokeAllSessions)
+	})
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.With(handlers.Repo.RateLimit(handlers.SignInLimit)).Post("/auth/signin", handlers.Repo.APISignIn)
+		mux.With(handlers.Repo.RateLimit(handlers.SignUpLimit), handlers.Repo.RateLimit(handlers.SignUpEmailLimit)).Post("/auth/signup", handlers.Repo.APISignUp)
+		mux.Post("/auth/activate-account", handlers.Repo.APIActivateAccount)
+		mux.With(handlers.Repo.RateLimit(handlers.ForgotPasswordLimit), handlers.Repo.RateLimit(handlers.ForgotPasswordEmailLimit)).Post("/auth/forgot-password", handlers.Repo.APIForgotPassword)
+		mux.Post("/auth/reset-password", handlers.Repo.APIResetPassword)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(handlers.Repo.APIAuthenticate)
+			mux.Post("/auth/signout", handlers.Repo.APISignOut)
+			mux.Get("/users/me", handlers.Repo.APICurrentUser)
+		})
 	})
 
 	return mux
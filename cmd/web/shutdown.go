@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/alexedwards/scs/postgresstore"
+	"github.com/cepa995/go-web-template/internal/accountpurge"
+	"github.com/cepa995/go-web-template/internal/driver"
+	"github.com/cepa995/go-web-template/internal/mailqueue"
+)
+
+// shutdown gracefully stops the application: it stops accepting new connections and waits for in-flight
+// requests, waits for mail workers to finish messages they already claimed, stops the session and rate limit
+// cleanup goroutines and the account purger and closes the database pool. All of it has to finish within app.ShutdownTimeout.
+func shutdown(srv *http.Server, db *driver.DB, mailQueue *mailqueue.Queue, accountPurger *accountpurge.Purger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), app.ShutdownTimeout)
+	defer cancel()
+
+	// Step 1. Stop accepting new connections and drain the ones in progress
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		app.Logger.Error("could not drain all connections", "err", err)
+		_ = srv.Close()
+	}
+
+	// Step 2. Stop claiming queued mail and wait for messages which are being sent right now. Anything
+	// still waiting stays in the mail_queue table and is picked up by the next instance.
+	if mailErr := mailQueue.Stop(ctx); mailErr != nil {
+		app.Logger.Error("timed out while waiting for mail workers", "err", mailErr)
+	} else {
+		app.Logger.Info("mail workers stopped")
+	}
+	if mailErr := app.Mailer.Close(); mailErr != nil {
+		app.Logger.Error("could not close mailer", "err", mailErr)
+	}
+
+	// Step 3. Stop removing expired sessions, rate limit buckets and deleted accounts in the background
+	if store, ok := session.Store.(*postgresstore.PostgresStore); ok {
+		store.StopCleanup()
+	}
+	if limiter, ok := app.RateLimiter.(interface{ StopCleanup() }); ok {
+		limiter.StopCleanup()
+	}
+	if purgeErr := accountPurger.Stop(ctx); purgeErr != nil {
+		app.Logger.Error("timed out while waiting for account purger", "err", purgeErr)
+	}
+
+	// Step 4. Close database connections
+	if dbErr := db.SQL.Close(); dbErr != nil && err == nil {
+		err = dbErr
+	}
+
+	return err
+}
@@ -0,0 +1,97 @@
+package accountpurge
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/logging"
+)
+
+// Store is the part of repository.DatabaseRepo which the purger needs for removing deleted accounts.
+type Store interface {
+	PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int64, error)
+}
+
+// Purger removes accounts which were deleted by their owners once GracePeriod is over. Until then the
+// accounts are kept anonymized. Several instances may run at the same time; removing a row twice is harmless.
+type Purger struct {
+	Store       Store
+	GracePeriod time.Duration
+	Interval    time.Duration
+	Logger      *logging.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a Purger which checks for accounts to remove every hour.
+func New(store Store, gracePeriod time.Duration, logger *logging.Logger) *Purger {
+	return &Purger{
+		Store:       store,
+		GracePeriod: gracePeriod,
+		Interval:    time.Hour,
+		Logger:      logger,
+	}
+}
+
+// Start removes accounts whose grace period is over right away, and then every Interval in background.
+func (p *Purger) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.run(ctx)
+	}()
+}
+
+// Stop stops the purger and waits until a purge which is running right now is finished, or until ctx is
+// done.
+func (p *Purger) Stop(ctx context.Context) error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run purges accounts every Interval until ctx is cancelled
+func (p *Purger) run(ctx context.Context) {
+	for {
+		if _, err := p.PurgeOnce(ctx); err != nil {
+			p.Logger.Error("account purge failed", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.Interval):
+		}
+	}
+}
+
+// PurgeOnce removes accounts which were deleted more than GracePeriod ago and returns how many were removed.
+// A purge cancelled with ctx removes nothing and is simply repeated next time.
+func (p *Purger) PurgeOnce(ctx context.Context) (int64, error) {
+	purged, err := p.Store.PurgeDeletedUsers(ctx, time.Now().Add(-p.GracePeriod))
+	if err != nil {
+		return 0, err
+	}
+	if purged > 0 {
+		p.Logger.Info("removed deleted accounts", "count", purged)
+	}
+	return purged, nil
+}
@@ -0,0 +1,98 @@
+package accountpurge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/logging"
+)
+
+// memoryStore is an in-memory Store which keeps deletion times of accounts in a map
+type memoryStore struct {
+	mu        sync.Mutex
+	deletedAt map[int64]time.Time
+	calls     int
+	err       error
+}
+
+func (s *memoryStore) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.err != nil {
+		return 0, s.err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	for id, deletedAt := range s.deletedAt {
+		if deletedAt.Before(deletedBefore) {
+			delete(s.deletedAt, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func newTestPurger(store *memoryStore) *Purger {
+	return New(store, 24*time.Hour, logging.Discard())
+}
+
+func TestPurger_PurgeOnce(t *testing.T) {
+	store := &memoryStore{deletedAt: map[int64]time.Time{
+		1: time.Now().Add(-25 * time.Hour),
+		2: time.Now().Add(-23 * time.Hour),
+		3: time.Now().Add(-30 * 24 * time.Hour),
+	}}
+	p := newTestPurger(store)
+
+	purged, err := p.PurgeOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("expected 2 accounts to be removed, but got %d", purged)
+	}
+	if _, ok := store.deletedAt[2]; !ok || len(store.deletedAt) != 1 {
+		t.Errorf("expected only the account within the grace period to be kept, got %v", store.deletedAt)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store.deletedAt[4] = time.Now().Add(-48 * time.Hour)
+	if _, err = p.PurgeOnce(ctx); !errors.Is(err, context.Canceled) || len(store.deletedAt) != 2 {
+		t.Errorf("expected cancelled purge to remove nothing, got %v", err)
+	}
+
+	store.err = errors.New("connection refused")
+	if _, err = p.PurgeOnce(context.Background()); err == nil {
+		t.Error("expected error of the store to be returned")
+	}
+}
+
+func TestPurger_StartStop(t *testing.T) {
+	store := &memoryStore{deletedAt: map[int64]time.Time{1: time.Now().Add(-48 * time.Hour)}}
+	p := newTestPurger(store)
+	p.Interval = 10 * time.Millisecond
+
+	p.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.deletedAt) != 0 || store.calls < 2 {
+		t.Errorf("expected the purger to run right away and then periodically, got %d calls", store.calls)
+	}
+}
@@ -1,31 +1,101 @@
 package config
 
 import (
+	"fmt"
 	"html/template"
-	"log"
+	"strings"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
-	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/encryption"
+	"github.com/cepa995/go-web-template/internal/forms"
+	"github.com/cepa995/go-web-template/internal/logging"
+	"github.com/cepa995/go-web-template/internal/mailer"
+	"github.com/cepa995/go-web-template/internal/oidc"
+	"github.com/cepa995/go-web-template/internal/passwords"
+	"github.com/cepa995/go-web-template/internal/ratelimit"
+	"github.com/cepa995/go-web-template/internal/urlsigner"
 )
 
 // SMTP holds SMTP server configuration
 type SMTP struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string
+}
+
+// Database holds database connection settings for a single database.yml environment
+type Database struct {
+	Dialect  string `yaml:"dialect"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Database string `yaml:"database"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	SSLMode  string `yaml:"sslmode"`
+	Pool     int    `yaml:"pool"`
+	URL      string `yaml:"url"`
+}
+
+// DSN returns connection string for the PostgreSQL driver
+func (d Database) DSN() string {
+	return fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s",
+		quoteDSN(d.Host), quoteDSN(d.Port), quoteDSN(d.Database), quoteDSN(d.User), quoteDSN(d.Password), quoteDSN(d.SSLMode))
+}
+
+// quoteDSN quotes a single key=value connection string value so it may contain spaces and quotes
+func quoteDSN(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
 }
 
 // AppConfig holds the application configuration
 type AppConfig struct {
-	UseCache      bool
-	TemplateCache map[string]*template.Template
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
-	InProduction  bool
-	Session       *scs.SessionManager
-	MailChan      chan models.MailData
-	SMTP          SMTP
-	SecretKey     string
-	FrontEnd      string
+	Env                   string
+	Port                  string
+	DB                    Database
+	UseCache              bool
+	TemplateCache         map[string]*template.Template
+	Logger                *logging.Logger
+	LogFormat             string
+	LogLevel              string
+	InProduction          bool
+	Session               *scs.SessionManager
+	SMTP                  SMTP
+	SecretKey             string
+	URLSigner             *urlsigner.Signer
+	FrontEnd              string
+	ShutdownTimeout       time.Duration
+	MailWorkers           int
+	MailMaxAttempts       int
+	MailBackend           string
+	MailFrom              string
+	MailDir               string
+	Mailer                mailer.Mailer
+	LockoutAttempts       int
+	LockoutDuration       time.Duration
+	RateLimitStore        string
+	RateLimiter           ratelimit.Store
+	EncryptionKeys        string
+	Encryption            *encryption.KeyRing
+	OIDCProviders         string
+	OIDCConfigs           []oidc.Config
+	OIDC                  []*oidc.Provider
+	PasswordMinLength     int
+	PasswordClasses       int
+	BreachedPasswordsFile string
+	PasswordPolicy        forms.PasswordPolicy
+	PasswordHash          string
+	BcryptCost            int
+	Argon2Memory          int
+	Argon2Iterations      int
+	PasswordHasher        passwords.Hasher
+	RememberMeDuration    time.Duration
+	DeletionGracePeriod   time.Duration
 }
@@ -5,57 +5,170 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"regexp"
+	"strings"
 )
 
-// Encryption type stores secret key based on which data is being encrypted
-type Encryption struct {
-	Key []byte // Secret Key
+// version prefixes every value encrypted by KeyRing, so the format can change later without
+// breaking values which are already stored
+const version = "v1"
+
+// Errors returned by KeyRing.Decrypt
+var (
+	ErrMalformed  = errors.New("encryption: malformed cipher text")
+	ErrUnknownKey = errors.New("encryption: value was encrypted with unknown key")
+	ErrDecrypt    = errors.New("encryption: could not decrypt value, it was tampered with or the key is wrong")
+)
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Key is a 256-bit AES key. Its ID is stored in every value encrypted with it, so the key can be found
+// again after it has been retired.
+type Key struct {
+	ID     string
+	Secret []byte
 }
 
-// Encrypt encrypts text based on a secret key.
-func (e *Encryption) Encrypt(text string) (string, error) {
-	plainText := []byte(text)
+// KeyRing encrypts values with AES-256-GCM using its current key and decrypts values encrypted with any
+// of its keys. Encrypted values look like v1:<key ID>:<base64 of nonce and cipher text>.
+type KeyRing struct {
+	current Key
+	keys    map[string]cipher.AEAD
+	legacy  []byte
+}
 
-	block, err := aes.NewCipher(e.Key)
-	if err != nil {
-		return "", err
+// NewKeyRing creates a KeyRing which encrypts with the first key and decrypts with all of them. Values
+// produced by the old AES-CFB Encryption can be decrypted when legacyKey is not nil; see Decrypt.
+func NewKeyRing(keys []Key, legacyKey []byte) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("encryption: at least one key is required")
 	}
 
-	cipherText := make([]byte, aes.BlockSize+len(plainText))
-	iv := cipherText[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", err
+	k := &KeyRing{
+		current: keys[0],
+		keys:    map[string]cipher.AEAD{},
+		legacy:  legacyKey,
 	}
+	for _, key := range keys {
+		if !keyIDPattern.MatchString(key.ID) {
+			return nil, fmt.Errorf("encryption: invalid key ID %q", key.ID)
+		}
+		if len(key.Secret) != 32 {
+			return nil, fmt.Errorf("encryption: key %s must be 32 bytes long, it has %d", key.ID, len(key.Secret))
+		}
+		if _, ok := k.keys[key.ID]; ok {
+			return nil, fmt.Errorf("encryption: duplicate key ID %s", key.ID)
+		}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], plainText)
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[key.ID] = aead
+	}
+	return k, nil
+}
+
+// ParseKeys parses keys written as comma separated <ID>:<base64 encoded key> pairs, e.g. the value of
+// -encryptionkeys. The first key is the current one.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
 
-	// Encode cipherText (i.e. slice of bytes) to text, so it is safe to use on web pages
-	return base64.URLEncoding.EncodeToString(cipherText), nil
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("encryption: key %q is not in <ID>:<base64 key> format", pair)
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %s is not valid base64: %w", parts[0], err)
+		}
+		keys = append(keys, Key{ID: parts[0], Secret: secret})
+	}
+	return keys, nil
 }
 
-// Decrypt decrypts previously encrypted text based on a specific secret key.
-func (e *Encryption) Decrypt(cryptoText string) (string, error) {
-	cipherText, err := base64.URLEncoding.DecodeString(cryptoText)
-	if err != nil {
-		return "", nil
+// Encrypt encrypts text with the current key. The key ID and format version are authenticated as well,
+// so they can not be swapped.
+func (k *KeyRing) Encrypt(text string) (string, error) {
+	aead := k.keys[k.current.ID]
+	header := version + ":" + k.current.ID
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(text)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(text), []byte(header))
+
+	return header + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value encrypted with any key of the ring. Values without a version prefix are
+// treated as the old AES-CFB format and decrypted with the legacy key. That format is not
+// authenticated, so a wrong legacy key produces garbage instead of an error.
+func (k *KeyRing) Decrypt(cryptoText string) (string, error) {
+	if !strings.HasPrefix(cryptoText, version+":") {
+		return k.decryptLegacy(cryptoText)
 	}
 
-	block, err := aes.NewCipher(e.Key)
+	parts := strings.SplitN(cryptoText, ":", 3)
+	if len(parts) != 3 {
+		return "", ErrMalformed
+	}
+	aead, ok := k.keys[parts[1]]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return "", ErrMalformed
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plainText, err := aead.Open(nil, nonce, sealed, []byte(parts[0]+":"+parts[1]))
 	if err != nil {
-		return "", nil
+		return "", ErrDecrypt
 	}
+	return string(plainText), nil
+}
 
-	if len(cipherText) < aes.BlockSize {
-		return "", err
+// NeedsReencryption returns true if the value was not encrypted with the current key in the current
+// format. Callers should decrypt such values and store them encrypted again, so retired keys can
+// eventually be removed.
+func (k *KeyRing) NeedsReencryption(cryptoText string) bool {
+	return !strings.HasPrefix(cryptoText, version+":"+k.current.ID+":")
+}
+
+// decryptLegacy decrypts values produced by the AES-CFB Encryption this package used to provide.
+func (k *KeyRing) decryptLegacy(cryptoText string) (string, error) {
+	if k.legacy == nil {
+		return "", ErrUnknownKey
 	}
 
-	iv := cipherText[:aes.BlockSize]
-	cipherText = cipherText[aes.BlockSize:]
+	cipherText, err := base64.URLEncoding.DecodeString(cryptoText)
+	if err != nil || len(cipherText) < aes.BlockSize {
+		return "", ErrMalformed
+	}
 
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(cipherText, cipherText)
+	block, err := aes.NewCipher(k.legacy)
+	if err != nil {
+		return "", err
+	}
 
-	return string(cipherText), nil
+	iv, cipherText := cipherText[:aes.BlockSize], cipherText[aes.BlockSize:]
+	plainText := make([]byte, len(cipherText))
+	cipher.NewCFBDecrypter(block, iv).XORKeyStream(plainText, cipherText)
+	return string(plainText), nil
 }
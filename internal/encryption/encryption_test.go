@@ -0,0 +1,177 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	oldKey = Key{ID: "2023", Secret: bytes.Repeat([]byte{1}, 32)}
+	newKey = Key{ID: "2024", Secret: bytes.Repeat([]byte{2}, 32)}
+)
+
+// encryptLegacy encrypts text the way the old AES-CFB Encryption did
+func encryptLegacy(t *testing.T, key []byte, text string) string {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText := make([]byte, aes.BlockSize+len(text))
+	iv := cipherText[:aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(cipherText[aes.BlockSize:], []byte(text))
+	return base64.URLEncoding.EncodeToString(cipherText)
+}
+
+func TestKeyRing_EncryptDecrypt(t *testing.T) {
+	ring, err := NewKeyRing([]Key{newKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := ring.Encrypt("secret text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, "v1:2024:") || strings.Contains(encrypted, "secret text") {
+		t.Errorf("unexpected cipher text %s", encrypted)
+	}
+
+	again, _ := ring.Encrypt("secret text")
+	if again == encrypted {
+		t.Error("expected every encryption to use a new nonce")
+	}
+
+	decrypted, err := ring.Decrypt(encrypted)
+	if err != nil || decrypted != "secret text" {
+		t.Errorf("expected %q, got %q (%v)", "secret text", decrypted, err)
+	}
+	if ring.NeedsReencryption(encrypted) {
+		t.Error("expected value encrypted with the current key not to need re-encryption")
+	}
+}
+
+func TestKeyRing_Rotation(t *testing.T) {
+	oldRing, _ := NewKeyRing([]Key{oldKey}, nil)
+	encrypted, _ := oldRing.Encrypt("secret text")
+
+	ring, err := NewKeyRing([]Key{newKey, oldKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := ring.Decrypt(encrypted)
+	if err != nil || decrypted != "secret text" {
+		t.Errorf("expected retired key to decrypt, got %q (%v)", decrypted, err)
+	}
+	if !ring.NeedsReencryption(encrypted) {
+		t.Error("expected value encrypted with a retired key to need re-encryption")
+	}
+
+	reencrypted, _ := ring.Encrypt(decrypted)
+	if !strings.HasPrefix(reencrypted, "v1:2024:") {
+		t.Errorf("expected new values to use the current key, got %s", reencrypted)
+	}
+}
+
+func TestKeyRing_Legacy(t *testing.T) {
+	legacyKey := bytes.Repeat([]byte{3}, 32)
+	encrypted := encryptLegacy(t, legacyKey, "old secret")
+
+	ring, _ := NewKeyRing([]Key{newKey}, legacyKey)
+	decrypted, err := ring.Decrypt(encrypted)
+	if err != nil || decrypted != "old secret" {
+		t.Errorf("expected legacy value to decrypt, got %q (%v)", decrypted, err)
+	}
+	if !ring.NeedsReencryption(encrypted) {
+		t.Error("expected legacy value to need re-encryption")
+	}
+
+	withoutLegacy, _ := NewKeyRing([]Key{newKey}, nil)
+	if _, err := withoutLegacy.Decrypt(encrypted); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey without legacy key, got %v", err)
+	}
+}
+
+func TestKeyRing_DecryptErrors(t *testing.T) {
+	ring, _ := NewKeyRing([]Key{newKey}, bytes.Repeat([]byte{3}, 32))
+	encrypted, _ := ring.Encrypt("secret text")
+
+	// Change a character in the middle of the cipher text
+	i := len("v1:2024:") + 10
+	flipped := byte('A')
+	if encrypted[i] == 'A' {
+		flipped = 'B'
+	}
+	tampered := encrypted[:i] + string(flipped) + encrypted[i+1:]
+
+	tests := []struct {
+		name     string
+		value    string
+		expected error
+	}{
+		{"tampered", tampered, ErrDecrypt},
+		{"swapped key ID", strings.Replace(encrypted, "v1:2024:", "v1:2023:", 1), ErrUnknownKey},
+		{"bad base64", "v1:2024:%%%", ErrMalformed},
+		{"too short", "v1:2024:AAAA", ErrMalformed},
+		{"missing parts", "v1:2024", ErrMalformed},
+		{"legacy bad base64", "%%%", ErrMalformed},
+		{"legacy too short", "AAAA", ErrMalformed},
+	}
+
+	for _, e := range tests {
+		decrypted, err := ring.Decrypt(e.value)
+		if !errors.Is(err, e.expected) || decrypted != "" {
+			t.Errorf("for %s expected %v, got %q (%v)", e.name, e.expected, decrypted, err)
+		}
+	}
+
+	otherRing, _ := NewKeyRing([]Key{{ID: "2024", Secret: bytes.Repeat([]byte{9}, 32)}}, nil)
+	if _, err := otherRing.Decrypt(encrypted); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt with a wrong key, got %v", err)
+	}
+}
+
+func TestNewKeyRing_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []Key
+	}{
+		{"no keys", nil},
+		{"short key", []Key{{ID: "a", Secret: []byte("short")}}},
+		{"invalid ID", []Key{{ID: "a:b", Secret: newKey.Secret}}},
+		{"duplicate ID", []Key{newKey, newKey}},
+	}
+
+	for _, e := range tests {
+		if _, err := NewKeyRing(e.keys, nil); err == nil {
+			t.Errorf("for %s expected an error", e.name)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(newKey.Secret)
+
+	keys, err := ParseKeys("2024:" + secret + ", 2023:" + secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != "2024" || keys[1].ID != "2023" || !bytes.Equal(keys[0].Secret, newKey.Secret) {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+
+	for _, invalid := range []string{"2024", "2024:not base64!"} {
+		if _, err := ParseKeys(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
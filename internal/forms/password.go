@@ -0,0 +1,190 @@
+package forms
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bcryptMaxLength is the number of bytes of a password bcrypt looks at; the rest is silently ignored
+const bcryptMaxLength = 72
+
+//go:embed breached-passwords.txt
+var bundledBreachedPasswords string
+
+var (
+	bundledOnce     sync.Once
+	bundledBreached *BreachedPasswords
+)
+
+// PasswordPolicy describes passwords users are allowed to choose
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+	// MaxLength is the maximum number of bytes, 0 means no limit
+	MaxLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits and symbols are required
+	MinClasses int
+	// Breached passwords are refused; nil disables the check
+	Breached *BreachedPasswords
+}
+
+// DefaultPasswordPolicy returns policy which prefers length over composition, as NIST SP 800-63B
+// recommends, and refuses passwords from the bundled list of common and breached passwords.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength: 8,
+		MaxLength: bcryptMaxLength,
+		Breached:  BundledBreachedPasswords(),
+	}
+}
+
+// Check returns reasons why password does not satisfy the policy. personal holds values the password
+// must not contain, like email and name of the user.
+func (p PasswordPolicy) Check(password string, personal ...string) []string {
+	var problems []string
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("Password must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		problems = append(problems, fmt.Sprintf("Password must be at most %d bytes long", p.MaxLength))
+	}
+	if p.MinClasses > 0 && characterClasses(password) < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("Password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", p.MinClasses))
+	}
+	if containsPersonal(password, personal) {
+		problems = append(problems, "Password must not contain your name or email")
+	}
+	if p.Breached != nil && p.Breached.Contains(password) {
+		problems = append(problems, "This password is too common or has appeared in a data breach, choose another one")
+	}
+	return problems
+}
+
+// Password checks a specific field against policy. personal holds values the password must not contain.
+func (f *Form) Password(field string, policy PasswordPolicy, personal ...string) bool {
+	problems := policy.Check(f.Get(field), personal...)
+	for _, problem := range problems {
+		f.Errors.Add(field, problem)
+	}
+	return len(problems) == 0
+}
+
+// characterClasses returns how many of lowercase letters, uppercase letters, digits and symbols s contains
+func characterClasses(s string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// containsPersonal returns true if password contains one of the personal values, or the local part of an
+// email among them. Values shorter than 3 characters are ignored.
+func containsPersonal(password string, personal []string) bool {
+	password = strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if i := strings.Index(value, "@"); i >= 0 {
+			value = value[:i]
+		}
+		if utf8.RuneCountInString(value) >= 3 && strings.Contains(password, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// BreachedPasswords is a set of SHA-1 hashes of passwords which must not be used. Hashes are grouped by
+// their first 5 hex characters, like ranges of the Pwned Passwords k-anonymity API.
+type BreachedPasswords struct {
+	ranges map[string][]string
+}
+
+// ParseBreachedPasswords reads upper or lower case SHA-1 hex hashes, one per line. Anything after a colon
+// (e.g. the count in Pwned Passwords downloads) is ignored, as are empty lines and lines starting with #.
+func ParseBreachedPasswords(r io.Reader) (*BreachedPasswords, error) {
+	return (&BreachedPasswords{}).Extend(r)
+}
+
+// Extend returns a new set holding hashes of b and hashes read from r, in the format ParseBreachedPasswords
+// reads. b is left unchanged.
+func (b *BreachedPasswords) Extend(r io.Reader) (*BreachedPasswords, error) {
+	extended := &BreachedPasswords{ranges: make(map[string][]string, len(b.ranges))}
+	for prefix, suffixes := range b.ranges {
+		extended.ranges[prefix] = append([]string(nil), suffixes...)
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if i := strings.Index(text, ":"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.ToUpper(text)
+		if _, err := hex.DecodeString(text); err != nil || len(text) != 2*sha1.Size {
+			return nil, fmt.Errorf("line %d is not a SHA-1 hash", line)
+		}
+		extended.ranges[text[:5]] = append(extended.ranges[text[:5]], text[5:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, suffixes := range extended.ranges {
+		sort.Strings(suffixes)
+	}
+	return extended, nil
+}
+
+// BundledBreachedPasswords returns the list of common and breached passwords bundled with the application
+func BundledBreachedPasswords() *BreachedPasswords {
+	bundledOnce.Do(func() {
+		var err error
+		bundledBreached, err = ParseBreachedPasswords(strings.NewReader(bundledBreachedPasswords))
+		if err != nil {
+			panic(err)
+		}
+	})
+	return bundledBreached
+}
+
+// Contains returns true if password is in the set
+func (b *BreachedPasswords) Contains(password string) bool {
+	hash := sha1.Sum([]byte(password))
+	hexHash := strings.ToUpper(hex.EncodeToString(hash[:]))
+
+	suffixes := b.ranges[hexHash[:5]]
+	i := sort.SearchStrings(suffixes, hexHash[5:])
+	return i < len(suffixes) && suffixes[i] == hexHash[5:]
+}
+
+// Len returns number of hashes in the set
+func (b *BreachedPasswords) Len() int {
+	n := 0
+	for _, suffixes := range b.ranges {
+		n += len(suffixes)
+	}
+	return n
+}
@@ -0,0 +1,82 @@
+package forms
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var passwordPolicyTests = []struct {
+	name     string
+	policy   PasswordPolicy
+	password string
+	personal []string
+	problems int
+}{
+	{"long-enough", PasswordPolicy{MinLength: 8}, "abcdefgh", nil, 0},
+	{"too-short", PasswordPolicy{MinLength: 8}, "abcdefg", nil, 1},
+	{"counts-characters", PasswordPolicy{MinLength: 8}, "ššššššššš", nil, 0},
+	{"too-long-for-bcrypt", PasswordPolicy{MaxLength: bcryptMaxLength}, strings.Repeat("š", 37), nil, 1},
+	{"no-max-length", PasswordPolicy{}, strings.Repeat("a", 100), nil, 0},
+	{"enough-classes", PasswordPolicy{MinClasses: 3}, "abcDEF12", nil, 0},
+	{"too-few-classes", PasswordPolicy{MinClasses: 3}, "abcdef12", nil, 1},
+	{"symbols", PasswordPolicy{MinClasses: 2}, "abc def!", nil, 0},
+	{"contains-name", PasswordPolicy{}, "xJaneDoe99", []string{"Jane", "Doe"}, 1},
+	{"contains-email", PasswordPolicy{}, "jane.doe-rocks", []string{"jane.doe@example.com"}, 1},
+	{"short-names-ignored", PasswordPolicy{}, "joe-li-forever", []string{"Li", "Jo"}, 0},
+	{"breached", PasswordPolicy{Breached: BundledBreachedPasswords()}, "password1", nil, 1},
+	{"not-breached", PasswordPolicy{Breached: BundledBreachedPasswords()}, "correct horse battery", nil, 0},
+	{"several-problems", DefaultPasswordPolicy(), "123456", nil, 2},
+}
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	for _, e := range passwordPolicyTests {
+		problems := e.policy.Check(e.password, e.personal...)
+		if len(problems) != e.problems {
+			t.Errorf("for %s expected %d problems, but got %d: %v", e.name, e.problems, len(problems), problems)
+		}
+	}
+}
+
+func TestForm_Password(t *testing.T) {
+	form := New(url.Values{"password": {"letmein"}})
+	if form.Password("password", DefaultPasswordPolicy()) {
+		t.Error("form shows that weak password is valid when it isn't")
+	}
+	if len(form.Errors["password"]) != 2 || form.Valid() {
+		t.Errorf("expected two errors for the password, but got %v", form.Errors["password"])
+	}
+
+	form = New(url.Values{"password": {"correct horse battery"}})
+	if !form.Password("password", DefaultPasswordPolicy(), "test@gmail.com") || !form.Valid() {
+		t.Errorf("form shows that strong password is invalid when it isn't: %v", form.Errors)
+	}
+}
+
+func TestParseBreachedPasswords(t *testing.T) {
+	// SHA-1 of "hunter2", lower case and with a Pwned Passwords count
+	list := "# comment\n\nf3bbbd66a63d4bf1747940578ec3d0103530e21d:1234\n"
+	b, err := ParseBreachedPasswords(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Contains("hunter2") || b.Contains("hunter3") || b.Len() != 1 {
+		t.Error("unexpected content of parsed list")
+	}
+
+	extended, err := b.Extend(strings.NewReader("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !extended.Contains("password") || !extended.Contains("hunter2") || b.Contains("password") {
+		t.Error("expected extended list to hold both lists and the original list to stay unchanged")
+	}
+
+	if _, err = ParseBreachedPasswords(strings.NewReader("not a hash\n")); err == nil {
+		t.Error("expected an error for a line which is not a hash")
+	}
+
+	if BundledBreachedPasswords().Len() == 0 {
+		t.Error("expected bundled list not to be empty")
+	}
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cepa995/go-web-template/internal/forms"
+	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/render"
+)
+
+/*******************************************************************
+                   ACCOUNT HANDLERS
+********************************************************************/
+
+// ShowAccount handler - shows profile of the signed in user with forms for changing name, password and
+// email address
+func (m *Repository) ShowAccount(w http.ResponseWriter, r *http.Request) {
+	m.renderAccount(w, r, forms.New(nil))
+}
+
+// UpdateProfile handler - changes first and last name of the signed in user
+func (m *Repository) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("firstName", "lastName")
+	form.MinLength("firstName", 3)
+	form.MinLength("lastName", 3)
+	if !form.Valid() {
+		m.renderAccount(w, r, form)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	user.FirstName = form.Get("firstName")
+	user.LastName = form.Get("lastName")
+	err = m.DB.UpdateUser(r.Context(), user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Profile updated")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// ChangePassword handler - changes password of the signed in user once the current password is confirmed,
+// or sets the first one of users without a password. Other sessions and API tokens of the user are revoked;
+// this browser stays signed in.
+func (m *Repository) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	// Step 1. Make sure the user knows the current password
+	form := forms.New(r.PostForm)
+	form.Required("new-password", "verify-password")
+	err = m.checkPassword(r, form, "current-password", user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if !form.Valid() {
+		m.renderAccount(w, r, form)
+		return
+	}
+
+	// Step 2. Make sure user has re-entered the new password correctly and it satisfies the policy
+	newPassword := form.Get("new-password")
+	if newPassword != form.Get("verify-password") {
+		form.Errors.Add("verify-password", "Passwords do not match")
+	}
+	form.Password("new-password", m.App.PasswordPolicy, user.Email, user.FirstName, user.LastName)
+	if !form.Valid() {
+		m.renderAccount(w, r, form)
+		return
+	}
+
+	// Step 3. Store the new password and revoke everything that was authorized by the old one
+	newHash, err := m.App.PasswordHasher.Hash(newPassword)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.DB.UpdatePasswordForUser(r.Context(), user, newHash)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.revokeOtherSessions(r, user.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.DB.RevokeTokensForUser(r.Context(), user.ID, models.ScopeAuthentication)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{Type: models.AuditPasswordChanged, TargetUserID: user.ID})
+
+	m.App.Session.Put(r.Context(), "flash", "Password changed")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// ChangeEmail handler - emails a link for confirming the new email address of the signed in user. The
+// address is changed only once the link is followed.
+func (m *Repository) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		m.renderAccount(w, r, form)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	email := form.Get("email")
+	if strings.EqualFold(email, user.Email) {
+		form.Errors.Add("email", "This is already your email address")
+	} else if _, err := m.DB.GetUserByEmail(r.Context(), email); err == nil {
+		form.Errors.Add("email", "Email address already exists!")
+	}
+	err = m.checkPassword(r, form, "email-password", user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if !form.Valid() {
+		m.renderAccount(w, r, form)
+		return
+	}
+
+	err = m.sendEmailChangeLink(r.Context(), user, email)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("We sent a link to %s, follow it to confirm the change", email))
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// ConfirmEmailChange handler - handles the link emailed to the new address and changes email address of
+// the user it was issued for. Links sent to the old address stop working.
+func (m *Repository) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	next := "/auth"
+	if m.App.Session.Exists(r.Context(), "user_id") {
+		next = "/account"
+	}
+
+	// Step 1. Consume the token; it is no longer valid if the address has been changed in the meantime
+	token, err := m.DB.ConsumeToken(r.Context(), r.URL.Query().Get("token"), models.ScopeEmailChange)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	user, err := m.DB.GetUserByID(r.Context(), token.UserID)
+	if err != nil || user.Email != token.Email {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	// Step 2. Make sure nobody has taken the address since the link was sent
+	email := token.Data["newEmail"]
+	if _, err := m.DB.GetUserByEmail(r.Context(), email); err == nil {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Email address %s already exists", email))
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	// Step 3. Change the address and revoke tokens issued for the old one
+	user.Email = email
+	err = m.DB.UpdateUser(r.Context(), user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.revokeEmailTokens(r.Context(), token.Email)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{
+		Type:         models.AuditEmailChanged,
+		TargetUserID: user.ID,
+		Metadata:     map[string]string{"from": token.Email, "to": email},
+	})
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Your email address has been changed to %s", email))
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+/*******************************************************************
+                   ACCOUNT PAGE HELPERS
+********************************************************************/
+
+// renderAccount renders account page of the signed in user with form
+func (m *Repository) renderAccount(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	user, err := m.DB.GetUserByID(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	render.Template(w, r, "account.page.gohtml", &models.TemplateData{
+		Form: form,
+		Data: map[string]interface{}{"user": user, "hasPassword": user.Password != ""},
+	})
+}
+
+// revokeEmailTokens revokes tokens issued for email which must not outlive a change of the user's address:
+// API tokens and reset, sign-in, unlock, email change and account deletion links.
+func (m *Repository) revokeEmailTokens(ctx context.Context, email string) error {
+	scopes := []string{
+		models.ScopeAuthentication, models.ScopePasswordReset, models.ScopeMagicLink, models.ScopeUnlock,
+		models.ScopeEmailChange, models.ScopeAccountDeletion,
+	}
+	for _, scope := range scopes {
+		if err := m.DB.RevokeTokens(ctx, email, scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendEmailChangeLink issues an email change token and queues email with the link to it to the new address.
+// The token is issued for the current address, so only the newest link is valid.
+func (m *Repository) sendEmailChangeLink(ctx context.Context, user models.User, newEmail string) error {
+	err := m.DB.RevokeTokens(ctx, user.Email, models.ScopeEmailChange)
+	if err != nil {
+		return err
+	}
+
+	token, err := models.GenerateToken(user.ID, user.Email, tokenTTL, models.ScopeEmailChange)
+	if err != nil {
+		return err
+	}
+	token.Data["newEmail"] = newEmail
+
+	err = m.DB.InsertToken(ctx, *token)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		Link string
+	}
+	data.Link = fmt.Sprintf("%s/auth/confirm-email?token=%s", m.App.FrontEnd, token.PlainText)
+	msg := models.MailData{
+		To:           newEmail,
+		From:         m.App.MailFrom,
+		Subject:      "Confirm your new email address",
+		TemplateName: "email-change",
+		Data:         data,
+	}
+
+	_, err = m.DB.EnqueueMail(ctx, msg)
+	return err
+}
+
+// revokeOtherSessions signs out every session of the user except the current one
+func (m *Repository) revokeOtherSessions(r *http.Request, userID int64) error {
+	sessions, err := m.DB.GetUserSessionsForUser(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	current := m.App.Session.GetInt64(r.Context(), "user_session_id")
+	for _, s := range sessions {
+		if s.ID == current {
+			continue
+		}
+		err = m.DB.DeleteUserSession(r.Context(), s.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
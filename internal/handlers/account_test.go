@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/models"
+)
+
+// accountRequest posts form to handler within session ctx of a signed in user
+func accountRequest(ctx context.Context, handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", target, nil)
+	req = req.WithContext(ctx)
+	req.PostForm = form
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestShowAccount(t *testing.T) {
+	rr := userRequest(Repo.ShowAccount, "GET", "/account", nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "test@gmail.com") {
+		t.Errorf("expected account page of the signed in user, got %d", rr.Code)
+	}
+}
+
+var updateProfileTests = []struct {
+	name             string
+	form             url.Values
+	expectedCode     int
+	expectedLastName string
+}{
+	{"valid", url.Values{"firstName": {"Janet"}, "lastName": {"Doherty"}}, http.StatusSeeOther, "Doherty"},
+	{"missing-last-name", url.Values{"firstName": {"Janet"}}, http.StatusOK, "User"},
+	{"too-short", url.Values{"firstName": {"Jo"}, "lastName": {"Li"}}, http.StatusOK, "User"},
+}
+
+func TestUpdateProfile(t *testing.T) {
+	for _, e := range updateProfileTests {
+		user := insertUser(t, e.name+"@example.com")
+		ctx, _ := signInWith(t, user.Email, "", false)
+
+		rr := accountRequest(ctx, Repo.UpdateProfile, "/account/profile", e.form)
+		if rr.Code != e.expectedCode {
+			t.Errorf("for %s expected %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+		if updated, _ := Repo.DB.GetUserByID(context.Background(), user.ID); updated.LastName != e.expectedLastName || updated.Email != user.Email {
+			t.Errorf("for %s expected last name %s, but got %s", e.name, e.expectedLastName, updated.LastName)
+		}
+	}
+}
+
+var changePasswordTests = []struct {
+	name          string
+	form          url.Values
+	expectedCode  int
+	expectedError string
+}{
+	{"wrong-current-password", url.Values{"current-password": {"wrong"}, "new-password": {"correct horse battery"}, "verify-password": {"correct horse battery"}}, http.StatusOK, "Incorrect password"},
+	{"not-repeated", url.Values{"current-password": {"password"}, "new-password": {"correct horse battery"}, "verify-password": {"correct horse"}}, http.StatusOK, "Passwords do not match"},
+	{"weak", url.Values{"current-password": {"password"}, "new-password": {"12345678"}, "verify-password": {"12345678"}}, http.StatusOK, "text-danger"},
+	{"contains-name", url.Values{"current-password": {"password"}, "new-password": {"test-drive-forever"}, "verify-password": {"test-drive-forever"}}, http.StatusOK, "text-danger"},
+	{"valid", url.Values{"current-password": {"password"}, "new-password": {"correct horse battery"}, "verify-password": {"correct horse battery"}}, http.StatusSeeOther, ""},
+}
+
+func TestChangePassword(t *testing.T) {
+	for _, e := range changePasswordTests {
+		user := insertUser(t, "changer-"+e.name+"@example.com")
+		ctx, _ := signInWith(t, user.Email, "", false)
+		other, _ := signInWith(t, user.Email, "", false)
+
+		apiToken, _ := models.GenerateToken(user.ID, user.Email, time.Hour, models.ScopeAuthentication)
+		Repo.DB.InsertToken(context.Background(), *apiToken)
+
+		rr := accountRequest(ctx, Repo.ChangePassword, "/account/password", e.form)
+		if rr.Code != e.expectedCode || !strings.Contains(rr.Body.String(), e.expectedError) {
+			t.Errorf("for %s expected %d with %q, but got %d %s", e.name, e.expectedCode, e.expectedError, rr.Code, rr.Body.String())
+		}
+
+		// A changed password signs out other sessions and revokes API tokens, but not this browser
+		changed := e.expectedCode == http.StatusSeeOther
+		loadUserSession(other)
+		if signedIn := session.GetInt64(other, "user_id") != 0; signedIn == changed {
+			t.Errorf("for %s expected other session to be signed in: %v", e.name, !changed)
+		}
+		if _, err := Repo.DB.GetToken(context.Background(), apiToken.PlainText, models.ScopeAuthentication); (err == nil) == changed {
+			t.Errorf("for %s expected API token to be valid: %v", e.name, !changed)
+		}
+		loadUserSession(ctx)
+		if session.GetInt64(ctx, "user_id") != user.ID {
+			t.Errorf("for %s expected this browser to stay signed in", e.name)
+		}
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	user := insertUser(t, "before@example.com")
+	ctx, _ := signInWith(t, user.Email, "", false)
+	apiToken, _ := models.GenerateToken(user.ID, user.Email, time.Hour, models.ScopeAuthentication)
+	Repo.DB.InsertToken(context.Background(), *apiToken)
+
+	// Step 1. Invalid requests are refused
+	invalid := []struct {
+		name string
+		form url.Values
+	}{
+		{"not-an-email", url.Values{"email": {"after"}, "email-password": {"password"}}},
+		{"same-email", url.Values{"email": {"Before@example.com"}, "email-password": {"password"}}},
+		{"taken", url.Values{"email": {"test@gmail.com"}, "email-password": {"password"}}},
+		{"wrong-password", url.Values{"email": {"after@example.com"}, "email-password": {"wrong"}}},
+	}
+	testMailer.Reset()
+	for _, e := range invalid {
+		rr := accountRequest(ctx, Repo.ChangeEmail, "/account/email", e.form)
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "text-danger") {
+			t.Errorf("for %s expected 200 with an error, but got %d", e.name, rr.Code)
+		}
+	}
+	if len(testMailer.Messages()) != 0 {
+		t.Fatal("expected no email for invalid requests")
+	}
+
+	// Step 2. The link is sent to the new address and the email is not changed yet
+	rr := accountRequest(ctx, Repo.ChangeEmail, "/account/email", url.Values{"email": {"after@example.com"}, "email-password": {"password"}})
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, but got %d", rr.Code)
+	}
+	messages := testMailer.Messages()
+	if len(messages) != 1 || messages[0].To != "after@example.com" {
+		t.Fatalf("expected one email to the new address, got %+v", messages)
+	}
+	link := tokenFromLink(t)
+	if unchanged, _ := Repo.DB.GetUserByID(context.Background(), user.ID); unchanged.Email != "before@example.com" {
+		t.Fatalf("expected email not to change before confirmation, got %s", unchanged.Email)
+	}
+
+	// Step 3. Following the link changes the email once and revokes tokens issued for the old one
+	confirm := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/auth/confirm-email?token="+token, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.ConfirmEmailChange).ServeHTTP(rr, req.WithContext(ctx))
+		return rr
+	}
+	rr = confirm(link)
+	if rr.Header().Get("Location") != "/account" {
+		t.Errorf("expected redirect to /account, got %s", rr.Header().Get("Location"))
+	}
+	if changed, _ := Repo.DB.GetUserByID(context.Background(), user.ID); changed.Email != "after@example.com" {
+		t.Errorf("expected email to change, got %s", changed.Email)
+	}
+	if _, err := Repo.DB.GetToken(context.Background(), apiToken.PlainText, models.ScopeAuthentication); err == nil {
+		t.Error("expected API token issued for the old email to be revoked")
+	}
+	confirm(link)
+	if session.GetString(ctx, "error") != "Invalid or expired link" {
+		t.Error("expected the link to work only once")
+	}
+}
+
+func TestConfirmEmailChange_Taken(t *testing.T) {
+	user := insertUser(t, "slow@example.com")
+	ctx, _ := signInWith(t, user.Email, "", false)
+	testMailer.Reset()
+	accountRequest(ctx, Repo.ChangeEmail, "/account/email", url.Values{"email": {"fast@example.com"}, "email-password": {"password"}})
+	link := tokenFromLink(t)
+
+	// Someone else takes the address before the link is followed
+	insertUser(t, "fast@example.com")
+
+	req, _ := http.NewRequest("GET", "/auth/confirm-email?token="+link, nil)
+	http.HandlerFunc(Repo.ConfirmEmailChange).ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	if unchanged, _ := Repo.DB.GetUserByID(context.Background(), user.ID); unchanged.Email != "slow@example.com" {
+		t.Errorf("expected email not to change, got %s", unchanged.Email)
+	}
+}
+
+func TestCheckPassword_NoSignInSideEffects(t *testing.T) {
+	app.LockoutAttempts = 3
+	app.LockoutDuration = time.Minute
+	defer func() { app.LockoutAttempts = 0 }()
+	user := insertUser(t, "confirming@example.com")
+	ctx, _ := signInWith(t, user.Email, "", false)
+	testMailer.Reset()
+
+	// Wrong passwords entered on the account page neither lock the account nor are audited as sign-ins
+	for attempt := 1; attempt <= 5; attempt++ {
+		rr := accountRequest(ctx, Repo.ChangeEmail, "/account/email", url.Values{"email": {"other@example.com"}, "email-password": {"wrong"}})
+		if !strings.Contains(rr.Body.String(), "Incorrect password") {
+			t.Fatalf("attempt %d: expected wrong password to be refused", attempt)
+		}
+	}
+	if _, _, err := Repo.DB.Authenticate(context.Background(), user.Email, "password"); err != nil {
+		t.Errorf("expected account not to be locked, got %v", err)
+	}
+	if len(testMailer.Messages()) != 0 {
+		t.Error("expected no unlock email to be sent")
+	}
+	if _, types := auditEvents(t, user.ID); strings.Contains(strings.Join(types, " "), models.AuditSignInFailed) {
+		t.Errorf("expected no failed sign-ins to be recorded, got %v", types)
+	}
+}
+
+var withoutPasswordTests = []struct {
+	name       string
+	signedInAt time.Duration
+	confirmed  bool
+}{
+	{"not-signed-in-here", 0, false},
+	{"signed-in-long-ago", -reauthWindow - time.Minute, false},
+	{"signed-in-recently", -time.Minute, true},
+}
+
+func TestCheckPassword_WithoutPassword(t *testing.T) {
+	id, err := Repo.DB.InsertUser(context.Background(), models.User{FirstName: "Open", LastName: "Id", Email: "openid@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Repo.DB.DeleteUser(context.Background(), id)
+
+	for _, e := range withoutPasswordTests {
+		req, _ := http.NewRequest("POST", "/account/delete", nil)
+		ctx := getCtx(req)
+		session.Put(ctx, "user_id", id)
+		if e.signedInAt != 0 {
+			session.Put(ctx, "signed_in_at", time.Now().Add(e.signedInAt).Unix())
+		}
+
+		// Users without a password confirm by a recent sign-in, so the field is not shown
+		rr := accountRequest(ctx, Repo.RequestAccountDeletion, "/account/delete", url.Values{})
+		if confirmed := rr.Code == http.StatusSeeOther; confirmed != e.confirmed {
+			t.Errorf("for %s expected confirmed %v, got %d", e.name, e.confirmed, rr.Code)
+		}
+		if !e.confirmed && (!strings.Contains(rr.Body.String(), "sign in again") || strings.Contains(rr.Body.String(), `id="delete-password"`)) {
+			t.Errorf("for %s expected to be asked to sign in again instead of the password", e.name)
+		}
+
+		// A recent sign-in also lets them set the first password
+		rr = accountRequest(ctx, Repo.ChangePassword, "/account/password", url.Values{"new-password": {"correct horse battery"}, "verify-password": {"correct horse battery"}})
+		if confirmed := rr.Code == http.StatusSeeOther; confirmed != e.confirmed {
+			t.Errorf("for %s expected password to be set: %v, got %d", e.name, e.confirmed, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/forms"
+	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/render"
+)
+
+// accountExport is everything stored about a user, as downloaded by ExportAccountData. Hashes of
+// passwords, tokens and cookies are left out.
+type accountExport struct {
+	ExportedAt       time.Time           `json:"exportedAt"`
+	User             models.User         `json:"user"`
+	Roles            []string            `json:"roles"`
+	TwoFactorEnabled bool                `json:"twoFactorEnabled"`
+	Identities       []exportedIdentity  `json:"identities"`
+	Sessions         []exportedSession   `json:"sessions"`
+	Tokens           []exportedToken     `json:"tokens"`
+	AuditEvents      []models.AuditEvent `json:"auditEvents"`
+}
+
+type exportedIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type exportedSession struct {
+	UserAgent       string     `json:"userAgent"`
+	IP              string     `json:"ip"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	LastSeenAt      time.Time  `json:"lastSeenAt"`
+	RememberedUntil *time.Time `json:"rememberedUntil,omitempty"`
+}
+
+type exportedToken struct {
+	Scope      string     `json:"scope"`
+	Email      string     `json:"email"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	Expiry     time.Time  `json:"expiry"`
+	ConsumedAt *time.Time `json:"consumedAt,omitempty"`
+}
+
+/*******************************************************************
+                   ACCOUNT DATA HANDLERS
+********************************************************************/
+
+// ExportAccountData handler - downloads everything stored about the signed in user as JSON, or as a zip
+// archive holding the JSON file with ?format=zip
+func (m *Repository) ExportAccountData(w http.ResponseWriter, r *http.Request) {
+	export, err := m.accountExport(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	out, err := json.MarshalIndent(export, "", "    ")
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	format := "json"
+	if r.URL.Query().Get("format") == "zip" {
+		format = "zip"
+	}
+	m.audit(r, models.AuditEvent{Type: models.AuditAccountExported, TargetUserID: export.User.ID, Metadata: map[string]string{"format": format}})
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="account-data.json"`)
+		_, _ = w.Write(out)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="account-data.zip"`)
+	archive := zip.NewWriter(w)
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: "account-data.json", Method: zip.Deflate, Modified: export.ExportedAt})
+	if err == nil {
+		_, err = file.Write(out)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// Headers have been sent already, so the error can only be logged
+		m.logger(r).Error("could not write account data", "user_id", export.User.ID, "err", err)
+	}
+}
+
+// RequestAccountDeletion handler - emails the signed in user a link for deleting the account, once the
+// password is confirmed
+func (m *Repository) RequestAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	err = m.checkPassword(r, form, "delete-password", user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if !form.Valid() {
+		m.renderAccount(w, r, form)
+		return
+	}
+
+	err = m.sendAccountDeletionLink(r.Context(), user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("We sent a link to %s, follow it to delete your account", user.Email))
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// ShowDeleteAccount handler - renders page with a button which deletes the account. Like with sign-in
+// links, opening the link does not use it up.
+func (m *Repository) ShowDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	plainText := r.URL.Query().Get("token")
+	_, err := m.DB.GetToken(r.Context(), plainText, models.ScopeAccountDeletion)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "deletion_token", plainText)
+	render.Template(w, r, "auth-delete-account.page.gohtml", &models.TemplateData{})
+}
+
+// DeleteAccount handler - uses up the deletion link opened in this session and deletes the account. The
+// account is anonymized and signed out everywhere right away, and removed once App.DeletionGracePeriod
+// is over.
+func (m *Repository) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	// Step 1. Consume the token; it is no longer valid if the address has been changed in the meantime
+	token, err := m.DB.ConsumeToken(r.Context(), m.App.Session.PopString(r.Context(), "deletion_token"), models.ScopeAccountDeletion)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	user, err := m.DB.GetUserByID(r.Context(), token.UserID)
+	if err != nil || user.Email != token.Email {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// Step 2. Anonymize the account and sign it out everywhere
+
+	err = m.DB.SoftDeleteUser(r.Context(), token.UserID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{Type: models.AuditAccountDeleted, TargetUserID: token.UserID})
+
+	if m.currentUserID(r) == token.UserID {
+		m.signOut(w, r)
+	}
+	m.App.Session.Put(r.Context(), "flash", "Your account has been deleted")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+/*******************************************************************
+                   ACCOUNT DATA HELPERS
+********************************************************************/
+
+// accountExport collects everything stored about the user
+func (m *Repository) accountExport(ctx context.Context, userID int64) (accountExport, error) {
+	export := accountExport{
+		ExportedAt:  time.Now().UTC(),
+		Roles:       []string{},
+		Identities:  []exportedIdentity{},
+		Sessions:    []exportedSession{},
+		Tokens:      []exportedToken{},
+		AuditEvents: []models.AuditEvent{},
+	}
+
+	var err error
+	export.User, err = m.DB.GetUserByID(ctx, userID)
+	if err != nil {
+		return export, err
+	}
+
+	roles, err := m.DB.GetRolesForUser(ctx, userID)
+	if err != nil {
+		return export, err
+	}
+	for _, role := range roles {
+		export.Roles = append(export.Roles, role.Name)
+	}
+
+	twoFactor, err := m.DB.GetTwoFactor(ctx, userID)
+	if err != nil {
+		return export, err
+	}
+	export.TwoFactorEnabled = twoFactor.Enabled
+
+	identities, err := m.DB.GetIdentitiesForUser(ctx, userID)
+	if err != nil {
+		return export, err
+	}
+	for _, identity := range identities {
+		export.Identities = append(export.Identities, exportedIdentity{
+			Provider:  identity.Provider,
+			Subject:   identity.Subject,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt,
+		})
+	}
+
+	sessions, err := m.DB.GetUserSessionsForUser(ctx, userID)
+	if err != nil {
+		return export, err
+	}
+	for _, s := range sessions {
+		exported := exportedSession{
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+		}
+		if !s.RememberExpiry.IsZero() {
+			expiry := s.RememberExpiry
+			exported.RememberedUntil = &expiry
+		}
+		export.Sessions = append(export.Sessions, exported)
+	}
+
+	tokens, err := m.DB.GetTokensForUser(ctx, userID)
+	if err != nil {
+		return export, err
+	}
+	for _, token := range tokens {
+		export.Tokens = append(export.Tokens, exportedToken{
+			Scope:      token.Scope,
+			Email:      token.Email,
+			CreatedAt:  token.CreatedAt,
+			Expiry:     token.Expiry,
+			ConsumedAt: token.ConsumedAt,
+		})
+	}
+
+	events, _, err := m.DB.AuditEvents(ctx, models.AuditFilter{UserID: userID}, 0, 0)
+	if err != nil {
+		return export, err
+	}
+	export.AuditEvents = append(export.AuditEvents, events...)
+
+	return export, nil
+}
+
+// sendAccountDeletionLink issues an account deletion token and queues email with the link to it. Only the
+// newest link is valid.
+func (m *Repository) sendAccountDeletionLink(ctx context.Context, user models.User) error {
+	err := m.DB.RevokeTokens(ctx, user.Email, models.ScopeAccountDeletion)
+	if err != nil {
+		return err
+	}
+
+	token, err := models.GenerateToken(user.ID, user.Email, tokenTTL, models.ScopeAccountDeletion)
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertToken(ctx, *token)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		Link string
+	}
+	data.Link = fmt.Sprintf("%s/auth/delete-account?token=%s", m.App.FrontEnd, token.PlainText)
+	msg := models.MailData{
+		To:           user.Email,
+		From:         m.App.MailFrom,
+		Subject:      "Confirm deleting your account",
+		TemplateName: "delete-account",
+		Data:         data,
+	}
+
+	_, err = m.DB.EnqueueMail(ctx, msg)
+	return err
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/models"
+)
+
+func TestExportAccountData(t *testing.T) {
+	user := insertUser(t, "export@example.com")
+	ctx, _ := signInWith(t, user.Email, "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", true)
+	apiToken, _ := models.GenerateToken(user.ID, user.Email, time.Hour, models.ScopeAuthentication)
+	Repo.DB.InsertToken(context.Background(), *apiToken)
+
+	download := func(target string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", target, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.ExportAccountData).ServeHTTP(rr, req.WithContext(ctx))
+		return rr
+	}
+	check := func(format string, data []byte) {
+		var export accountExport
+		if err := json.Unmarshal(data, &export); err != nil {
+			t.Fatalf("for %s could not decode export - %v", format, err)
+		}
+		if export.User.Email != user.Email || len(export.Roles) != 1 || len(export.Sessions) != 1 || len(export.Tokens) != 1 {
+			t.Errorf("for %s unexpected export %+v", format, export)
+		}
+		if len(export.AuditEvents) == 0 || export.AuditEvents[len(export.AuditEvents)-1].Type != models.AuditSignIn {
+			t.Errorf("for %s expected sign-in to be among audit events, got %+v", format, export.AuditEvents)
+		}
+		if export.Sessions[0].RememberedUntil == nil || export.Tokens[0].Scope != models.ScopeAuthentication {
+			t.Errorf("for %s expected remembered session and API token, got %+v", format, export)
+		}
+		if strings.Contains(string(data), `"password":`) || strings.Contains(string(data), "hash") {
+			t.Errorf("for %s expected no hashes in export: %s", format, data)
+		}
+	}
+
+	rr := download("/account/export")
+	if rr.Header().Get("Content-Type") != "application/json" || !strings.Contains(rr.Header().Get("Content-Disposition"), "attachment") {
+		t.Errorf("expected JSON download, got %v", rr.Header())
+	}
+	check("json", rr.Body.Bytes())
+
+	rr = download("/account/export?format=zip")
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil || len(archive.File) != 1 || archive.File[0].Name != "account-data.json" {
+		t.Fatalf("expected zip archive with account-data.json, got %v", err)
+	}
+	file, _ := archive.File[0].Open()
+	data, _ := io.ReadAll(file)
+	check("zip", data)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	user := insertUser(t, "leaving@example.com")
+	ctx, _ := signInWith(t, user.Email, "", false)
+	other, _ := signInWith(t, user.Email, "", false)
+	apiToken, _ := models.GenerateToken(user.ID, user.Email, time.Hour, models.ScopeAuthentication)
+	Repo.DB.InsertToken(context.Background(), *apiToken)
+
+	// Step 1. The password is required before the link is sent
+	testMailer.Reset()
+	rr := accountRequest(ctx, Repo.RequestAccountDeletion, "/account/delete", url.Values{"delete-password": {"wrong"}})
+	if rr.Code != http.StatusOK || len(testMailer.Messages()) != 0 {
+		t.Fatalf("expected wrong password to be refused, got %d", rr.Code)
+	}
+	rr = accountRequest(ctx, Repo.RequestAccountDeletion, "/account/delete", url.Values{"delete-password": {"password"}})
+	if rr.Code != http.StatusSeeOther || testMailer.Messages()[0].To != user.Email {
+		t.Fatalf("expected the link to be emailed, got %d", rr.Code)
+	}
+	link := tokenFromLink(t)
+
+	// Step 2. Opening the link does not delete the account yet
+	req, _ := http.NewRequest("GET", "/auth/delete-account?token="+link, nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowDeleteAccount).ServeHTTP(rr, req.WithContext(ctx))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected confirmation page, got %d", rr.Code)
+	}
+	if _, err := Repo.DB.GetUserByEmail(context.Background(), user.Email); err != nil {
+		t.Fatal("expected account to exist until deletion is confirmed")
+	}
+
+	// Step 3. Confirming anonymizes the account and signs it out everywhere
+	Repo.DB.InsertAuditEvent(context.Background(), models.AuditEvent{
+		Type:         models.AuditEmailChanged,
+		ActorID:      user.ID,
+		TargetUserID: user.ID,
+		IP:           "10.0.0.1",
+		UserAgent:    "Firefox",
+		Metadata:     map[string]string{"from": user.Email, "to": "new@example.com", "note": "kept"},
+	})
+	rr = accountRequest(ctx, Repo.DeleteAccount, "/auth/delete-account", nil)
+	if rr.Header().Get("Location") != "/" || session.GetInt64(ctx, "user_id") != 0 {
+		t.Errorf("expected to be signed out and redirected home, got %s", rr.Header().Get("Location"))
+	}
+	deleted, err := Repo.DB.GetUserByID(context.Background(), user.ID)
+	if err != nil || deleted.Email == user.Email || deleted.FirstName == user.FirstName || deleted.Password != "" {
+		t.Errorf("expected account to be anonymized, got %+v", deleted)
+	}
+	if _, _, err = Repo.DB.Authenticate(context.Background(), user.Email, "password"); err == nil {
+		t.Error("expected deleted account not to sign in")
+	}
+	loadUserSession(other)
+	if session.GetInt64(other, "user_id") != 0 {
+		t.Error("expected other sessions to be signed out")
+	}
+	if _, err = Repo.DB.GetToken(context.Background(), apiToken.PlainText, models.ScopeAuthentication); err == nil {
+		t.Error("expected API tokens to be revoked")
+	}
+	if users, _, _ := Repo.DB.AllUsers(context.Background(), "Deleted User", 100, 0); len(users) != 0 {
+		t.Error("expected deleted accounts not to be listed")
+	}
+	events, _ := auditEvents(t, user.ID)
+	for _, event := range events {
+		if event.Type == models.AuditAccountDeleted {
+			continue
+		}
+		if event.IP != "" || event.UserAgent != "" || event.Metadata["from"] != "" || event.Metadata["to"] != "" || event.Metadata["email"] != "" {
+			t.Errorf("expected audit event to be anonymized, got %+v", event)
+		}
+		if event.Type == models.AuditEmailChanged && event.Metadata["note"] != "kept" {
+			t.Errorf("expected other metadata to be kept, got %+v", event.Metadata)
+		}
+	}
+
+	// Step 4. The account is removed once the grace period is over
+	if purged, _ := Repo.DB.PurgeDeletedUsers(context.Background(), time.Now().Add(-time.Hour)); purged != 0 {
+		t.Errorf("expected no account to be removed within the grace period, got %d", purged)
+	}
+	if purged, _ := Repo.DB.PurgeDeletedUsers(context.Background(), time.Now().Add(time.Second)); purged != 1 {
+		t.Errorf("expected one account to be removed, got %d", purged)
+	}
+	if _, err = Repo.DB.GetUserByID(context.Background(), user.ID); err == nil {
+		t.Error("expected account to be removed")
+	}
+}
+
+func TestDeleteAccount_AfterEmailChange(t *testing.T) {
+	user := insertUser(t, "moving@example.com")
+	ctx, _ := signInWith(t, user.Email, "", false)
+	requestLink := func() string {
+		testMailer.Reset()
+		accountRequest(ctx, Repo.RequestAccountDeletion, "/account/delete", url.Values{"delete-password": {"password"}})
+		return tokenFromLink(t)
+	}
+	deleteWith := func(link string) {
+		req, _ := http.NewRequest("GET", "/auth/delete-account?token="+link, nil)
+		http.HandlerFunc(Repo.ShowDeleteAccount).ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		accountRequest(ctx, Repo.DeleteAccount, "/auth/delete-account", nil)
+	}
+
+	// Step 1. Confirming an email change revokes deletion links sent to the old address
+	link := requestLink()
+	accountRequest(ctx, Repo.ChangeEmail, "/account/email", url.Values{"email": {"moved@example.com"}, "email-password": {"password"}})
+	req, _ := http.NewRequest("GET", "/auth/confirm-email?token="+tokenFromLink(t), nil)
+	http.HandlerFunc(Repo.ConfirmEmailChange).ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	if _, err := Repo.DB.GetToken(context.Background(), link, models.ScopeAccountDeletion); err == nil {
+		t.Error("expected deletion link sent to the old address to be revoked")
+	}
+
+	// Step 2. A link which was not revoked does not work for another address either
+	link = requestLink()
+	moved, _ := Repo.DB.GetUserByID(context.Background(), user.ID)
+	moved.Email = "moved-again@example.com"
+	Repo.DB.UpdateUser(context.Background(), moved)
+	deleteWith(link)
+	if session.GetString(ctx, "error") != "Invalid or expired link" {
+		t.Error("expected deletion link sent to the old address to be refused")
+	}
+	if kept, _ := Repo.DB.GetUserByID(context.Background(), user.ID); kept.Email != moved.Email {
+		t.Errorf("expected account not to be deleted, got %+v", kept)
+	}
+}
+
+func TestDeleteAccount_InvalidLink(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/auth/delete-account?token=INVALID", nil)
+	ctx := getCtx(req)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowDeleteAccount).ServeHTTP(rr, req.WithContext(ctx))
+	if rr.Header().Get("Location") != "/" || session.GetString(ctx, "error") != "Invalid or expired link" {
+		t.Errorf("expected invalid link to be refused, got %s", rr.Header().Get("Location"))
+	}
+
+	rr = accountRequest(ctx, Repo.DeleteAccount, "/auth/delete-account", nil)
+	if rr.Header().Get("Location") != "/" || session.GetString(ctx, "error") != "Invalid or expired link" {
+		t.Errorf("expected deletion without an opened link to be refused, got %s", rr.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cepa995/go-web-template/internal/forms"
+	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/render"
+	"github.com/go-chi/chi"
+)
+
+// usersPerPage is the number of users shown on one page of the admin user list
+const usersPerPage = 20
+
+// pagination describes the page of a list which is currently shown
+type pagination struct {
+	Page  int
+	Pages int
+	Total int
+	Query string
+}
+
+// HasPrev returns true if there is a page before the current one
+func (p pagination) HasPrev() bool {
+	return p.Page > 1
+}
+
+// HasNext returns true if there is a page after the current one
+func (p pagination) HasNext() bool {
+	return p.Page < p.Pages
+}
+
+// Prev returns number of the previous page
+func (p pagination) Prev() int {
+	return p.Page - 1
+}
+
+// Next returns number of the next page
+func (p pagination) Next() int {
+	return p.Page + 1
+}
+
+/*******************************************************************
+                   ADMIN HANDLERS
+********************************************************************/
+
+// Admin handler - renders admin dashboard.
+func (m *Repository) Admin(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "admin.page.gohtml", &models.TemplateData{})
+}
+
+// AdminUsers handler - renders paginated list of users, optionally filtered by name or email in ?q=
+func (m *Repository) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	users, total, err := m.DB.AllUsers(r.Context(), query, usersPerPage, (page-1)*usersPerPage)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	pages := (total + usersPerPage - 1) / usersPerPage
+	if pages == 0 {
+		pages = 1
+	}
+
+	data := map[string]interface{}{
+		"users":      users,
+		"pagination": pagination{Page: page, Pages: pages, Total: total, Query: query},
+	}
+	render.Template(w, r, "admin-users.page.gohtml", &models.TemplateData{Data: data})
+}
+
+// AdminShowUser handler - renders user details together with forms for managing the account
+func (m *Repository) AdminShowUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderAdminUser(w, r, user, forms.New(nil))
+}
+
+// AdminUpdateUser handler - handles changing user's name and email
+func (m *Repository) AdminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("firstName", "lastName", "email")
+	form.MinLength("firstName", 3)
+	form.MinLength("lastName", 3)
+	form.IsEmail("email")
+
+	email := form.Get("email")
+	if existing, err := m.DB.GetUserByEmail(r.Context(), email); err == nil && existing.ID != user.ID {
+		form.Errors.Add("email", "Email address already exists!")
+	}
+
+	if !form.Valid() {
+		m.renderAdminUser(w, r, user, form)
+		return
+	}
+
+	changes := map[string]string{}
+	oldEmail := user.Email
+	if oldEmail != email {
+		changes["email"] = oldEmail + " -> " + email
+	}
+	if name := form.Get("firstName") + " " + form.Get("lastName"); name != user.FirstName+" "+user.LastName {
+		changes["name"] = user.FirstName + " " + user.LastName + " -> " + name
+	}
+
+	user.FirstName = form.Get("firstName")
+	user.LastName = form.Get("lastName")
+	user.Email = email
+	err = m.DB.UpdateUser(r.Context(), user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if oldEmail != email {
+		err = m.revokeEmailTokens(r.Context(), oldEmail)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+	m.audit(r, models.AuditEvent{Type: models.AuditUserUpdated, TargetUserID: user.ID, Metadata: changes})
+
+	m.App.Session.Put(r.Context(), "flash", "User updated")
+	http.Redirect(w, r, adminUserURL(user), http.StatusSeeOther)
+}
+
+// AdminUpdateRoles handler - handles assigning and removing roles; checked roles are posted as "role" values
+func (m *Repository) AdminUpdateRoles(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	selected := map[string]bool{}
+	for _, role := range r.PostForm["role"] {
+		selected[role] = true
+	}
+
+	// Admins can not lock themselves out of the admin area
+	if user.ID == m.currentUserID(r) && !selected[models.RoleAdmin] {
+		m.App.Session.Put(r.Context(), "error", "You can not remove admin role from your own account")
+		http.Redirect(w, r, adminUserURL(user), http.StatusSeeOther)
+		return
+	}
+
+	roles, err := m.DB.AllRoles(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	userRoles, err := m.DB.GetRolesForUser(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	assigned := map[string]bool{}
+	for _, role := range userRoles {
+		assigned[role.Name] = true
+	}
+
+	var added, removed []string
+	for _, role := range roles {
+		if selected[role.Name] {
+			err = m.DB.AssignRole(r.Context(), user.ID, role.Name)
+			if !assigned[role.Name] {
+				added = append(added, role.Name)
+			}
+		} else {
+			err = m.DB.RemoveRole(r.Context(), user.ID, role.Name)
+			if assigned[role.Name] {
+				removed = append(removed, role.Name)
+			}
+		}
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		m.audit(r, models.AuditEvent{
+			Type:         models.AuditRolesChanged,
+			TargetUserID: user.ID,
+			Metadata:     map[string]string{"added": strings.Join(added, ","), "removed": strings.Join(removed, ",")},
+		})
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Roles updated")
+	http.Redirect(w, r, adminUserURL(user), http.StatusSeeOther)
+}
+
+// AdminBlockUser handler - blocks the account, signs it out everywhere and revokes its API tokens
+func (m *Repository) AdminBlockUser(w http.ResponseWriter, r *http.Request) {
+	m.setBlocked(w, r, true)
+}
+
+// AdminUnblockUser handler - unblocks the account
+func (m *Repository) AdminUnblockUser(w http.ResponseWriter, r *http.Request) {
+	m.setBlocked(w, r, false)
+}
+
+// AdminResetPassword handler - forces password reset; the current password stops working and the user is
+// emailed a link for choosing a new one
+func (m *Repository) AdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	// An empty hash never matches any password
+	err := m.DB.UpdatePasswordForUser(r.Context(), user, "")
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.DB.RevokeTokensForUser(r.Context(), user.ID, models.ScopeAuthentication)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.DB.DeleteUserSessionsForUser(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.sendPasswordResetLink(r.Context(), user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{Type: models.AuditPasswordResetForced, TargetUserID: user.ID})
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Password reset link was sent to %s", user.Email))
+	http.Redirect(w, r, adminUserURL(user), http.StatusSeeOther)
+}
+
+// AdminResetTwoFactor handler - turns off two-factor authentication of a user who lost the authenticator
+// app and the recovery codes; the user can enroll again after signing in with the password alone
+func (m *Repository) AdminResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.DB.DisableTwoFactor(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{Type: models.AuditTwoFactorReset, TargetUserID: user.ID})
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication reset")
+	http.Redirect(w, r, adminUserURL(user), http.StatusSeeOther)
+}
+
+// AdminDeleteUser handler - deletes the account
+func (m *Repository) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == m.currentUserID(r) {
+		m.App.Session.Put(r.Context(), "error", "You can not delete your own account")
+		http.Redirect(w, r, adminUserURL(user), http.StatusSeeOther)
+		return
+	}
+
+	err := m.DB.DeleteUser(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	// The account is gone, so it can only be described in metadata
+	m.audit(r, models.AuditEvent{
+		Type:     models.AuditUserDeleted,
+		Metadata: map[string]string{"user": strconv.FormatInt(user.ID, 10)},
+	})
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("User %s deleted", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+/*******************************************************************
+                   ADMIN HELPERS
+********************************************************************/
+
+// adminUser returns the user whose ID is in the URL. If there is no such user it responds with 404.
+func (m *Repository) adminUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return models.User{}, false
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// renderAdminUser renders user details page with the specified edit form
+func (m *Repository) renderAdminUser(w http.ResponseWriter, r *http.Request, user models.User, form *forms.Form) {
+	roles, err := m.DB.AllRoles(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	userRoles, err := m.DB.GetRolesForUser(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	assigned := map[string]bool{}
+	for _, role := range userRoles {
+		assigned[role.Name] = true
+	}
+
+	twoFactor, err := m.DB.GetTwoFactor(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"user":      user,
+		"roles":     roles,
+		"assigned":  assigned,
+		"twoFactor": twoFactor.Enabled,
+	}
+	render.Template(w, r, "admin-user.page.gohtml", &models.TemplateData{Data: data, Form: form})
+}
+
+// setBlocked blocks or unblocks the user whose ID is in the URL
+func (m *Repository) setBlocked(w http.ResponseWriter, r *http.Request, blocked bool) {
+	user, ok := m.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == m.currentUserID(r) {
+		m.App.Session.Put(r.Context(), "error", "You can not block your own account")
+		http.Redirect(w, r, adminUserURL(user), http.StatusSeeOther)
+		return
+	}
+
+	user.Blocked = blocked
+	err := m.DB.UpdateUser(r.Context(), user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	eventType := models.AuditUserUnblocked
+	if blocked {
+		eventType = models.AuditUserBlocked
+	}
+	m.audit(r, models.AuditEvent{Type: eventType, TargetUserID: user.ID})
+
+	message := "User unblocked"
+	if blocked {
+		message = "User blocked"
+		err = m.DB.RevokeTokensForUser(r.Context(), user.ID, models.ScopeAuthentication)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		err = m.DB.DeleteUserSessionsForUser(r.Context(), user.ID)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", message)
+	http.Redirect(w, r, adminUserURL(user), http.StatusSeeOther)
+}
+
+// currentUserID returns ID of the signed in user
+func (m *Repository) currentUserID(r *http.Request) int64 {
+	return m.App.Session.GetInt64(r.Context(), "user_id")
+}
+
+// adminUserURL returns URL of the user's page in admin area
+func adminUserURL(user models.User) string {
+	return fmt.Sprintf("/admin/users/%d", user.ID)
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/go-chi/chi"
+)
+
+// adminRequest calls handler as signed in user 1, who is temporarily given admin role, with {id} URL
+// parameter set to id
+func adminRequest(handler http.HandlerFunc, method, target, id string, form url.Values) *httptest.ResponseRecorder {
+	Repo.DB.AssignRole(context.Background(), 1, models.RoleAdmin)
+	defer Repo.DB.RemoveRole(context.Background(), 1, models.RoleAdmin)
+
+	req, _ := http.NewRequest(method, target, nil)
+	ctx := getCtx(req)
+	session.Put(ctx, "user_id", int64(1))
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id)
+	ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+
+	req = req.WithContext(ctx)
+	req.PostForm = form
+
+	rr := httptest.NewRecorder()
+	Repo.LoadPermissions(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+var adminUsersTests = []struct {
+	name     string
+	url      string
+	expected []string
+	missing  []string
+}{
+	{"all", "/admin/users", []string{"test@gmail.com", "mary@gmail.com", "Page 1 of 1 (2 users)"}, nil},
+	{"search-name", "/admin/users?q=MARY", []string{"mary@gmail.com"}, []string{"test@gmail.com"}},
+	{"search-email", "/admin/users?q=test@", []string{"test@gmail.com"}, []string{"mary@gmail.com"}},
+	{"no-match", "/admin/users?q=nobody", []string{"No users found"}, nil},
+	{"page-out-of-range", "/admin/users?page=5", []string{"Page 5 of 1"}, []string{"test@gmail.com"}},
+}
+
+func TestAdminUsers(t *testing.T) {
+	for _, e := range adminUsersTests {
+		rr := adminRequest(Repo.AdminUsers, "GET", e.url, "", nil)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected %d, but got %d", e.name, http.StatusOK, rr.Code)
+		}
+		for _, s := range e.expected {
+			if !strings.Contains(rr.Body.String(), s) {
+				t.Errorf("%s: expected page to contain %q", e.name, s)
+			}
+		}
+		for _, s := range e.missing {
+			if strings.Contains(rr.Body.String(), s) {
+				t.Errorf("%s: expected page not to contain %q", e.name, s)
+			}
+		}
+	}
+}
+
+func TestAdminUsers_Cancelled(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/users", nil)
+	ctx, cancel := context.WithCancel(getCtx(req))
+	cancel()
+
+	// Step 1. Queries made for a request which is gone fail with the error of its context
+	if _, err := Repo.DB.GetUserByID(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, but got %v", context.Canceled, err)
+	}
+
+	// Step 2. Handlers do not render anything for it
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminUsers).ServeHTTP(rr, req.WithContext(ctx))
+	if rr.Code != http.StatusInternalServerError || strings.Contains(rr.Body.String(), "test@gmail.com") {
+		t.Errorf("expected %d without users, but got %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+func TestAdminShowUser(t *testing.T) {
+	rr := adminRequest(Repo.AdminShowUser, "GET", "/admin/users/2", "2", nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "mary@gmail.com") {
+		t.Errorf("expected user page, but got %d", rr.Code)
+	}
+
+	for _, id := range []string{"99", "abc"} {
+		if rr := adminRequest(Repo.AdminShowUser, "GET", "/admin/users/"+id, id, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("user %s: expected %d, but got %d", id, http.StatusNotFound, rr.Code)
+		}
+	}
+}
+
+func TestAdminUserActions(t *testing.T) {
+	testMailer.Reset()
+
+	// Edit details; email of another account is rejected
+	rr := adminRequest(Repo.AdminUpdateUser, "POST", "/admin/users/2", "2", url.Values{
+		"firstName": {"Mary"}, "lastName": {"Major"}, "email": {"test@gmail.com"},
+	})
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Email address already exists!") {
+		t.Errorf("duplicate email: expected form with error, but got %d", rr.Code)
+	}
+
+	rr = adminRequest(Repo.AdminUpdateUser, "POST", "/admin/users/2", "2", url.Values{
+		"firstName": {"Maria"}, "lastName": {"Major"}, "email": {"mary@gmail.com"},
+	})
+	if user, _ := Repo.DB.GetUserByID(context.Background(), 2); rr.Code != http.StatusSeeOther || user.FirstName != "Maria" {
+		t.Errorf("update: expected redirect and new name, but got %d %s", rr.Code, user.FirstName)
+	}
+
+	// Block and unblock; admins can not block themselves
+	adminRequest(Repo.AdminBlockUser, "POST", "/admin/users/2/block", "2", nil)
+	if user, _ := Repo.DB.GetUserByID(context.Background(), 2); !user.Blocked {
+		t.Error("expected user to be blocked")
+	}
+	adminRequest(Repo.AdminUnblockUser, "POST", "/admin/users/2/unblock", "2", nil)
+	if user, _ := Repo.DB.GetUserByID(context.Background(), 2); user.Blocked {
+		t.Error("expected user to be unblocked")
+	}
+	adminRequest(Repo.AdminBlockUser, "POST", "/admin/users/1/block", "1", nil)
+	if user, _ := Repo.DB.GetUserByID(context.Background(), 1); user.Blocked {
+		t.Error("admin must not be able to block own account")
+	}
+
+	// Roles
+	adminRequest(Repo.AdminUpdateRoles, "POST", "/admin/users/2/roles", "2", url.Values{"role": {models.RoleUser, models.RoleAdmin}})
+	if permissions, _ := Repo.DB.GetPermissionsForUser(context.Background(), 2); len(permissions) == 0 {
+		t.Error("expected admin role to be assigned")
+	}
+	adminRequest(Repo.AdminUpdateRoles, "POST", "/admin/users/2/roles", "2", url.Values{"role": {models.RoleUser}})
+	if permissions, _ := Repo.DB.GetPermissionsForUser(context.Background(), 2); len(permissions) != 0 {
+		t.Errorf("expected admin role to be removed, but got permissions %v", permissions)
+	}
+
+	// Forced password reset emails a reset link
+	adminRequest(Repo.AdminResetPassword, "POST", "/admin/users/2/reset-password", "2", nil)
+	if messages := testMailer.Messages(); len(messages) != 1 || messages[0].To != "mary@gmail.com" {
+		t.Errorf("expected reset link to be sent to mary@gmail.com, got %d emails", len(messages))
+	}
+
+	// Delete; admins can not delete themselves
+	adminRequest(Repo.AdminDeleteUser, "POST", "/admin/users/1/delete", "1", nil)
+	if _, err := Repo.DB.GetUserByID(context.Background(), 1); err != nil {
+		t.Error("admin must not be able to delete own account")
+	}
+	rr = adminRequest(Repo.AdminDeleteUser, "POST", "/admin/users/2/delete", "2", nil)
+	if _, err := Repo.DB.GetUserByID(context.Background(), 2); rr.Code != http.StatusSeeOther || err == nil {
+		t.Errorf("expected user to be deleted, got %d", rr.Code)
+	}
+}
+
+func TestAdminUpdateUser_RevokesTokens(t *testing.T) {
+	user := insertUser(t, "renamed@example.com")
+	id := strconv.FormatInt(user.ID, 10)
+
+	// Step 1. Tokens issued for the old address: an API token and a reset link
+	var tokens []*models.Token
+	for _, scope := range []string{models.ScopeAuthentication, models.ScopePasswordReset} {
+		token, err := models.GenerateToken(user.ID, user.Email, time.Hour, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Repo.DB.InsertToken(context.Background(), *token)
+		tokens = append(tokens, token)
+	}
+	if status, _ := apiRequest(t, "GET", "/api/v1/users/me", tokens[0].PlainText, ""); status != http.StatusOK {
+		t.Fatalf("expected API token to be accepted, but got %d", status)
+	}
+
+	// Step 2. Admin changes the address, then blocks and unblocks the user
+	rr := adminRequest(Repo.AdminUpdateUser, "POST", "/admin/users/"+id, id, url.Values{
+		"firstName": {"Test"}, "lastName": {"User"}, "email": {"renamed-new@example.com"},
+	})
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect after update, but got %d", rr.Code)
+	}
+	adminRequest(Repo.AdminBlockUser, "POST", "/admin/users/"+id+"/block", id, nil)
+	adminRequest(Repo.AdminUnblockUser, "POST", "/admin/users/"+id+"/unblock", id, nil)
+
+	// Step 3. Neither token works any more
+	if status, _ := apiRequest(t, "GET", "/api/v1/users/me", tokens[0].PlainText, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected API token of the old address to be rejected, but got %d", status)
+	}
+	if _, err := Repo.DB.GetToken(context.Background(), tokens[1].PlainText, models.ScopePasswordReset); err == nil {
+		t.Error("expected reset link of the old address to be revoked")
+	}
+}
+
+func TestAdminBlockUser_RevokesTokensForUser(t *testing.T) {
+	user := insertUser(t, "blocked-api@example.com")
+	id := strconv.FormatInt(user.ID, 10)
+
+	// A token bound to an address the user no longer has is still revoked by blocking
+	token, err := models.GenerateToken(user.ID, "previous@example.com", time.Hour, models.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Repo.DB.InsertToken(context.Background(), *token)
+
+	adminRequest(Repo.AdminBlockUser, "POST", "/admin/users/"+id+"/block", id, nil)
+	adminRequest(Repo.AdminUnblockUser, "POST", "/admin/users/"+id+"/unblock", id, nil)
+	if status, _ := apiRequest(t, "GET", "/api/v1/users/me", token.PlainText, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected API token to be revoked by blocking, but got %d", status)
+	}
+}
@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/forms"
+	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/repository"
+)
+
+// apiTokenTTL is how long a bearer token issued by APISignIn stays valid
+const apiTokenTTL = 24 * time.Hour
+
+// contextKey is the type of keys under which API handlers store values in request context
+type contextKey string
+
+const userContextKey = contextKey("user")
+
+// apiResponse is the envelope every /api/v1 endpoint responds with
+type apiResponse struct {
+	OK      bool                `json:"ok"`
+	Message string              `json:"message,omitempty"`
+	Data    interface{}         `json:"data,omitempty"`
+	Errors  map[string][]string `json:"errors,omitempty"`
+}
+
+// apiError writes an unsuccessful response with the specified status code
+func apiError(w http.ResponseWriter, status int, message string) {
+	helpers.WriteJSON(w, status, apiResponse{
+		OK:      false,
+		Message: message,
+	})
+}
+
+// apiValidationError writes 422 response with errors of every invalid field
+func apiValidationError(w http.ResponseWriter, form *forms.Form) {
+	helpers.WriteJSON(w, http.StatusUnprocessableEntity, apiResponse{
+		OK:      false,
+		Message: "Validation failed",
+		Errors:  form.Errors,
+	})
+}
+
+// userFromContext returns user authenticated by APIAuthenticate
+func userFromContext(ctx context.Context) (models.User, bool) {
+	user, ok := ctx.Value(userContextKey).(models.User)
+	return user, ok
+}
+
+// bearerToken extracts token from "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.Fields(r.Header.Get("Authorization"))
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// APIAuthenticate allows only requests with a valid bearer token and stores user the token
+// belongs to, together with its permissions, in the request context.
+func (m *Repository) APIAuthenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		plainText, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, http.StatusUnauthorized, "Missing or malformed authentication token")
+			return
+		}
+
+		token, err := m.DB.GetToken(r.Context(), plainText, models.ScopeAuthentication)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, http.StatusUnauthorized, "Invalid or expired authentication token")
+			return
+		}
+
+		user, err := m.DB.GetUserByID(r.Context(), token.UserID)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, http.StatusUnauthorized, "Invalid or expired authentication token")
+			return
+		}
+		if user.Blocked {
+			apiError(w, http.StatusForbidden, "Your account has been blocked")
+			return
+		}
+
+		permissions, err := m.DB.GetPermissionsForUser(r.Context(), user.ID)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = helpers.WithPermissions(ctx, permissions)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// APISignIn exchanges email and password for a bearer token
+func (m *Repository) APISignIn(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := helpers.ReadJSON(w, r, &input); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form := forms.New(url.Values{
+		"email":    {input.Email},
+		"password": {input.Password},
+		"code":     {input.Code},
+	})
+	form.Required("email", "password")
+	form.IsEmail("email")
+	if !form.Valid() {
+		apiValidationError(w, form)
+		return
+	}
+
+	id, err := m.authenticate(r, input.Email, input.Password)
+	switch {
+	case errors.Is(err, repository.ErrAccountBlocked):
+		apiError(w, http.StatusForbidden, signInError(err))
+		return
+	case errors.Is(err, repository.ErrAccountLocked), errors.Is(err, repository.ErrTooManyAttempts):
+		apiError(w, http.StatusLocked, signInError(err))
+		return
+	case err != nil:
+		apiError(w, http.StatusUnauthorized, signInError(err))
+		return
+	}
+
+	// Accounts with two-factor authentication need a TOTP or recovery code as well
+	twoFactor, err := m.DB.GetTwoFactor(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if twoFactor.Enabled {
+		form.Required("code")
+		if !form.Valid() {
+			helpers.WriteJSON(w, http.StatusUnauthorized, apiResponse{
+				OK:      false,
+				Message: "Two-factor authentication code required",
+				Errors:  form.Errors,
+			})
+			return
+		}
+
+		if allowed, wait := m.allowTwoFactorAttempt(r, id); !allowed {
+			m.rateLimited(w, r, wait)
+			return
+		}
+		valid, _, err := m.verifyTwoFactorCode(r.Context(), id, input.Code)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		if !valid {
+			m.audit(r, models.AuditEvent{
+				Type:         models.AuditSignInFailed,
+				TargetUserID: id,
+				Metadata:     map[string]string{"reason": "invalid two-factor code"},
+			})
+			apiError(w, http.StatusUnauthorized, "Invalid two-factor authentication code")
+			return
+		}
+	}
+
+	token, err := models.GenerateToken(id, input.Email, apiTokenTTL, models.ScopeAuthentication)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.DB.InsertToken(r.Context(), *token)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{
+		Type:         models.AuditSignIn,
+		ActorID:      id,
+		TargetUserID: id,
+		Metadata:     map[string]string{"method": "api"},
+	})
+
+	var data struct {
+		Token  string    `json:"token"`
+		Expiry time.Time `json:"expiry"`
+	}
+	data.Token = token.PlainText
+	data.Expiry = token.Expiry
+
+	helpers.WriteJSON(w, http.StatusCreated, apiResponse{OK: true, Data: data})
+}
+
+// APISignOut revokes bearer token the request was authenticated with
+func (m *Repository) APISignOut(w http.ResponseWriter, r *http.Request) {
+	plainText, _ := bearerToken(r)
+	token, err := m.DB.ConsumeToken(r.Context(), plainText, models.ScopeAuthentication)
+	if err != nil {
+		apiError(w, http.StatusUnauthorized, "Invalid or expired authentication token")
+		return
+	}
+	m.audit(r, models.AuditEvent{
+		Type:         models.AuditSignOut,
+		TargetUserID: token.UserID,
+		Metadata:     map[string]string{"method": "api"},
+	})
+
+	helpers.WriteJSON(w, http.StatusOK, apiResponse{OK: true, Message: "Signed out"})
+}
+
+// APISignUp sends activation link to a new user
+func (m *Repository) APISignUp(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		FirstName string `json:"firstName"`
+		LastName  string `json:"lastName"`
+		Email     string `json:"email"`
+	}
+	if err := helpers.ReadJSON(w, r, &input); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form := forms.New(url.Values{
+		"firstName": {input.FirstName},
+		"lastName":  {input.LastName},
+		"email":     {input.Email},
+	})
+	form.Required("firstName", "lastName", "email")
+	form.IsEmail("email")
+	form.MinLength("firstName", 3)
+	form.MinLength("lastName", 3)
+	if !form.Valid() {
+		apiValidationError(w, form)
+		return
+	}
+
+	if _, err := m.DB.GetUserByEmail(r.Context(), input.Email); err == nil {
+		apiError(w, http.StatusConflict, "Email address already exists!")
+		return
+	}
+
+	err := m.sendActivationLink(r.Context(), input.FirstName, input.LastName, input.Email)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusAccepted, apiResponse{OK: true, Message: "Activation link was sent to your email"})
+}
+
+// APIActivateAccount creates the account from activation token and the password user has chosen
+func (m *Repository) APIActivateAccount(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := helpers.ReadJSON(w, r, &input); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form := forms.New(url.Values{
+		"token":    {input.Token},
+		"password": {input.Password},
+	})
+	form.Required("token", "password")
+	form.Password("password", m.App.PasswordPolicy, m.passwordPersonalInfo(r.Context(), input.Token, models.ScopeActivation)...)
+	if !form.Valid() {
+		apiValidationError(w, form)
+		return
+	}
+
+	id, err := m.activateAccount(r.Context(), input.Token, input.Password)
+	if errors.Is(err, errInvalidToken) {
+		apiError(w, http.StatusBadRequest, "Activation token is invalid or has expired")
+		return
+	} else if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.audit(r, models.AuditEvent{Type: models.AuditAccountActivated, TargetUserID: id})
+
+	user, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusCreated, apiResponse{OK: true, Data: user})
+}
+
+// APIForgotPassword sends password reset link. It responds the same way whether or not the account
+// exists, so it cannot be used to find out which email addresses are registered.
+func (m *Repository) APIForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := helpers.ReadJSON(w, r, &input); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form := forms.New(url.Values{"email": {input.Email}})
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		apiValidationError(w, form)
+		return
+	}
+
+	if user, err := m.DB.GetUserByEmail(r.Context(), input.Email); err == nil {
+		err = m.sendPasswordResetLink(r.Context(), user)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		m.audit(r, models.AuditEvent{Type: models.AuditPasswordResetRequest, TargetUserID: user.ID})
+	}
+
+	helpers.WriteJSON(w, http.StatusAccepted, apiResponse{OK: true, Message: "If the account exists, password reset link was sent to it"})
+}
+
+// APIResetPassword sets new password using password reset token
+func (m *Repository) APIResetPassword(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := helpers.ReadJSON(w, r, &input); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form := forms.New(url.Values{
+		"token":    {input.Token},
+		"password": {input.Password},
+	})
+	form.Required("token", "password")
+	form.Password("password", m.App.PasswordPolicy, m.passwordPersonalInfo(r.Context(), input.Token, models.ScopePasswordReset)...)
+	if !form.Valid() {
+		apiValidationError(w, form)
+		return
+	}
+
+	userID, err := m.resetPassword(r.Context(), input.Token, input.Password)
+	if errors.Is(err, errInvalidToken) {
+		apiError(w, http.StatusBadRequest, "Password reset token is invalid or has expired")
+		return
+	} else if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{Type: models.AuditPasswordReset, TargetUserID: userID})
+
+	helpers.WriteJSON(w, http.StatusOK, apiResponse{OK: true, Message: "Password changed successfully"})
+}
+
+// APICurrentUser returns the authenticated user
+func (m *Repository) APICurrentUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, apiResponse{OK: true, Data: user})
+}
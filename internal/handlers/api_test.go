@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apiResult is apiResponse with Data left undecoded, so each test can decode it into what it expects
+type apiResult struct {
+	OK      bool                `json:"ok"`
+	Message string              `json:"message"`
+	Data    json.RawMessage     `json:"data"`
+	Errors  map[string][]string `json:"errors"`
+}
+
+// apiRequest sends a request to the API router with an optional bearer token and decodes the response envelope
+func apiRequest(t *testing.T, method, path, token, body string) (int, apiResult) {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	getRoutes().ServeHTTP(rr, req)
+
+	var res apiResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s %s: could not decode response %q - %v", method, path, rr.Body.String(), err)
+	}
+	return rr.Code, res
+}
+
+var apiSignInTests = []struct {
+	name               string
+	body               string
+	expectedStatusCode int
+}{
+	{"valid-credentials", `{"email": "test@gmail.com", "password": "password"}`, http.StatusCreated},
+	{"invalid-credentials", `{"email": "test@gmail.com", "password": "wrong"}`, http.StatusUnauthorized},
+	{"invalid-email", `{"email": "test", "password": "password"}`, http.StatusUnprocessableEntity},
+	{"malformed-json", `{"email": `, http.StatusBadRequest},
+	{"unknown-field", `{"email": "test@gmail.com", "password": "password", "remember": true}`, http.StatusCreated},
+}
+
+func TestAPISignIn(t *testing.T) {
+	for _, e := range apiSignInTests {
+		status, res := apiRequest(t, "POST", "/api/v1/auth/signin", "", e.body)
+		if status != e.expectedStatusCode {
+			t.Errorf("%s: expected %d, but got %d (%s)", e.name, e.expectedStatusCode, status, res.Message)
+		}
+		if res.OK != (status < 300) {
+			t.Errorf("%s: ok is %v for status %d", e.name, res.OK, status)
+		}
+	}
+}
+
+func TestAPIBearerToken(t *testing.T) {
+	status, res := apiRequest(t, "POST", "/api/v1/auth/signin", "", `{"email": "test@gmail.com", "password": "password"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("expected %d, but got %d", http.StatusCreated, status)
+	}
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(res.Data, &data); err != nil || data.Token == "" {
+		t.Fatalf("response does not contain a token: %s", res.Data)
+	}
+
+	// The token authenticates requests until it is revoked by signing out
+	status, res = apiRequest(t, "GET", "/api/v1/users/me", data.Token, "")
+	if status != http.StatusOK {
+		t.Fatalf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if strings.Contains(string(res.Data), "password") {
+		t.Errorf("password must not be exposed: %s", res.Data)
+	}
+	var user struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(res.Data, &user); err != nil || user.Email != "test@gmail.com" {
+		t.Errorf("unexpected user %s", res.Data)
+	}
+
+	if status, _ = apiRequest(t, "POST", "/api/v1/auth/signout", data.Token, ""); status != http.StatusOK {
+		t.Errorf("sign out: expected %d, but got %d", http.StatusOK, status)
+	}
+	if status, _ = apiRequest(t, "GET", "/api/v1/users/me", data.Token, ""); status != http.StatusUnauthorized {
+		t.Errorf("revoked token: expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+
+	if status, _ = apiRequest(t, "GET", "/api/v1/users/me", "", ""); status != http.StatusUnauthorized {
+		t.Errorf("missing token: expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+	if status, _ = apiRequest(t, "GET", "/api/v1/users/me", "NOTATOKEN", ""); status != http.StatusUnauthorized {
+		t.Errorf("unknown token: expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+}
+
+func TestAPISignUpAndActivate(t *testing.T) {
+	testMailer.Reset()
+
+	status, res := apiRequest(t, "POST", "/api/v1/auth/signup", "", `{"firstName": "Jon", "lastName": "Doe", "email": "test@gmail.com"}`)
+	if status != http.StatusConflict {
+		t.Errorf("existing email: expected %d, but got %d", http.StatusConflict, status)
+	}
+
+	status, res = apiRequest(t, "POST", "/api/v1/auth/signup", "", `{"firstName": "Jo", "lastName": "Doe", "email": "api@gmail"}`)
+	if status != http.StatusUnprocessableEntity || len(res.Errors["firstName"]) == 0 || len(res.Errors["email"]) == 0 {
+		t.Errorf("invalid input: expected %d with field errors, but got %d %v", http.StatusUnprocessableEntity, status, res.Errors)
+	}
+
+	status, _ = apiRequest(t, "POST", "/api/v1/auth/signup", "", `{"firstName": "Jon", "lastName": "Doe", "email": "api-user@gmail.com"}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("expected %d, but got %d", http.StatusAccepted, status)
+	}
+
+	token := tokenFromLink(t)
+	for _, password := range []string{"secret", "doe-family-2024", "password1"} {
+		status, res = apiRequest(t, "POST", "/api/v1/auth/activate-account", "", `{"token": "`+token+`", "password": "`+password+`"}`)
+		if status != http.StatusUnprocessableEntity || len(res.Errors["password"]) == 0 {
+			t.Errorf("weak password %s: expected %d with field errors, but got %d %v", password, http.StatusUnprocessableEntity, status, res.Errors)
+		}
+	}
+
+	body := `{"token": "` + token + `", "password": "correct horse battery"}`
+	if status, _ = apiRequest(t, "POST", "/api/v1/auth/activate-account", "", body); status != http.StatusCreated {
+		t.Errorf("expected %d, but got %d", http.StatusCreated, status)
+	}
+	if status, _ = apiRequest(t, "POST", "/api/v1/auth/activate-account", "", body); status != http.StatusBadRequest {
+		t.Errorf("reused token: expected %d, but got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestAPIResetPassword(t *testing.T) {
+	testMailer.Reset()
+
+	status, _ := apiRequest(t, "POST", "/api/v1/auth/forgot-password", "", `{"email": "nobody@gmail.com"}`)
+	if status != http.StatusAccepted || len(testMailer.Messages()) != 0 {
+		t.Errorf("unknown email: expected %d and no email, but got %d and %d emails", http.StatusAccepted, status, len(testMailer.Messages()))
+	}
+
+	status, _ = apiRequest(t, "POST", "/api/v1/auth/forgot-password", "", `{"email": "test@gmail.com"}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("expected %d, but got %d", http.StatusAccepted, status)
+	}
+
+	body := `{"token": "` + tokenFromLink(t) + `", "password": "new-password"}`
+	if status, _ = apiRequest(t, "POST", "/api/v1/auth/reset-password", "", body); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if status, _ = apiRequest(t, "POST", "/api/v1/auth/reset-password", "", body); status != http.StatusBadRequest {
+		t.Errorf("reused token: expected %d, but got %d", http.StatusBadRequest, status)
+	}
+}
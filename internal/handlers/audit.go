@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/render"
+)
+
+// auditEventsPerPage is the number of events shown on one page of the audit log
+const auditEventsPerPage = 50
+
+// auditDateLayout is the format of the since and until filters, as sent by date inputs
+const auditDateLayout = "2006-01-02"
+
+// auditFilterForm holds the audit log filters as entered, so they can be shown in the form and kept in
+// page links
+type auditFilterForm struct {
+	User  string
+	Type  string
+	Since string
+	Until string
+}
+
+/*******************************************************************
+                   AUDIT LOG HANDLERS
+********************************************************************/
+
+// AdminAudit handler - renders paginated audit log, optionally filtered by user ID (?user=), event type
+// (?type=) and dates (?since= and ?until=, both inclusive)
+func (m *Repository) AdminAudit(w http.ResponseWriter, r *http.Request) {
+	filter, form := auditFilter(r)
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	events, total, err := m.DB.AuditEvents(r.Context(), filter, auditEventsPerPage, (page-1)*auditEventsPerPage)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	pages := (total + auditEventsPerPage - 1) / auditEventsPerPage
+	if pages == 0 {
+		pages = 1
+	}
+
+	data := map[string]interface{}{
+		"events":     events,
+		"types":      models.AuditEventTypes,
+		"filter":     form,
+		"pagination": pagination{Page: page, Pages: pages, Total: total},
+	}
+	render.Template(w, r, "admin-audit.page.gohtml", &models.TemplateData{Data: data})
+}
+
+// AdminAuditExport handler - downloads every audit event matching the filters of AdminAudit as CSV, or
+// as JSON with ?format=json
+func (m *Repository) AdminAuditExport(w http.ResponseWriter, r *http.Request) {
+	filter, _ := auditFilter(r)
+	events, _, err := m.DB.AuditEvents(r.Context(), filter, 0, 0)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if events == nil {
+		events = []models.AuditEvent{}
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		out, err := json.MarshalIndent(events, "", "    ")
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit-log.json"`)
+		_, _ = w.Write(out)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-log.csv"`)
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"id", "created_at", "type", "actor_id", "target_user_id", "ip", "user_agent", "metadata"})
+	for _, event := range events {
+		metadata, _ := json.Marshal(event.Metadata)
+		_ = out.Write([]string{
+			strconv.FormatInt(event.ID, 10),
+			event.CreatedAt.UTC().Format(time.RFC3339),
+			event.Type,
+			strconv.FormatInt(event.ActorID, 10),
+			strconv.FormatInt(event.TargetUserID, 10),
+			event.IP,
+			event.UserAgent,
+			string(metadata),
+		})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		// Headers have been sent already, so the error can only be logged
+		m.logger(r).Error("could not write audit log export", "err", err)
+	}
+}
+
+/*******************************************************************
+                   AUDIT LOG HELPERS
+********************************************************************/
+
+// audit records event caused by the request. Unless set, the actor is the signed in user or the user
+// the API token belongs to. Failing to record the event is logged, but does not fail the request.
+func (m *Repository) audit(r *http.Request, event models.AuditEvent) {
+	if event.ActorID == 0 {
+		if user, ok := userFromContext(r.Context()); ok {
+			event.ActorID = user.ID
+		} else {
+			event.ActorID = m.currentUserID(r)
+		}
+	}
+	event.IP = clientIP(r)
+	event.UserAgent = truncate(r.UserAgent(), 512)
+
+	if err := m.DB.InsertAuditEvent(r.Context(), event); err != nil {
+		m.logger(r).Error("could not record audit event", "type", event.Type, "err", err)
+	}
+}
+
+// auditFilter parses audit log filters from the query string. Filters which can not be parsed are ignored.
+func auditFilter(r *http.Request) (models.AuditFilter, auditFilterForm) {
+	query := r.URL.Query()
+	form := auditFilterForm{
+		User:  strings.TrimSpace(query.Get("user")),
+		Type:  strings.TrimSpace(query.Get("type")),
+		Since: strings.TrimSpace(query.Get("since")),
+		Until: strings.TrimSpace(query.Get("until")),
+	}
+
+	filter := models.AuditFilter{Type: form.Type}
+	if id, err := strconv.ParseInt(form.User, 10, 64); err == nil {
+		filter.UserID = id
+	}
+	if since, err := time.Parse(auditDateLayout, form.Since); err == nil {
+		filter.Since = since
+	}
+	if until, err := time.Parse(auditDateLayout, form.Until); err == nil {
+		filter.Until = until.AddDate(0, 0, 1)
+	}
+	return filter, form
+}
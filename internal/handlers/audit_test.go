@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cepa995/go-web-template/internal/models"
+)
+
+// auditEvents returns types of the audit events of user, newest first
+func auditEvents(t *testing.T, userID int64) ([]models.AuditEvent, []string) {
+	events, _, err := Repo.DB.AuditEvents(context.Background(), models.AuditFilter{UserID: userID}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return events, types
+}
+
+func TestAudit_SignIn(t *testing.T) {
+	user := insertUser(t, "audited@example.com")
+
+	// Step 1. Failed and successful sign-ins, and signing out
+	for _, email := range []string{user.Email, "nobody@example.com"} {
+		req, _ := http.NewRequest("POST", "/auth/signin", nil)
+		req = req.WithContext(getCtx(req))
+		req.PostForm = url.Values{"email": {email}, "password": {"wrong"}}
+		http.HandlerFunc(Repo.PostSignIn).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	ctx, _ := signInWith(t, user.Email, "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", false)
+	req, _ := http.NewRequest("GET", "/auth/signout", nil)
+	http.HandlerFunc(Repo.SignOut).ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	// Step 2. Every one of them is recorded against the user
+	events, types := auditEvents(t, user.ID)
+	expected := []string{models.AuditSignOut, models.AuditSignIn, models.AuditSignInFailed}
+	if strings.Join(types, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+	if signIn := events[1]; signIn.ActorID != user.ID || signIn.Metadata["method"] != "password" || !strings.Contains(signIn.UserAgent, "Firefox") {
+		t.Errorf("unexpected sign-in event %+v", signIn)
+	}
+	if failed := events[2]; failed.ActorID != 0 || failed.Metadata["reason"] == "" {
+		t.Errorf("unexpected failed sign-in event %+v", failed)
+	}
+
+	// Step 3. Failed sign-ins of unknown emails are recorded without a user
+	unknown, _, _ := Repo.DB.AuditEvents(context.Background(), models.AuditFilter{Type: models.AuditSignInFailed}, 0, 0)
+	found := false
+	for _, event := range unknown {
+		found = found || (event.Metadata["email"] == "nobody@example.com" && event.TargetUserID == 0)
+	}
+	if !found {
+		t.Error("expected failed sign-in of an unknown email to be recorded")
+	}
+}
+
+func TestAudit_AdminActions(t *testing.T) {
+	user := insertUser(t, "managed@example.com")
+	id := strconv.FormatInt(user.ID, 10)
+
+	adminRequest(Repo.AdminUpdateRoles, "POST", "/admin/users/"+id+"/roles", id, url.Values{"role": {models.RoleUser, models.RoleAdmin}})
+	adminRequest(Repo.AdminBlockUser, "POST", "/admin/users/"+id+"/block", id, nil)
+
+	events, types := auditEvents(t, user.ID)
+	expected := []string{models.AuditUserBlocked, models.AuditRolesChanged}
+	if strings.Join(types, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+	if roles := events[1]; roles.ActorID != 1 || roles.Metadata["added"] != models.RoleAdmin || roles.Metadata["removed"] != "" {
+		t.Errorf("unexpected roles event %+v", roles)
+	}
+
+	// The account is gone after deletion, so the event records only its ID
+	adminRequest(Repo.AdminDeleteUser, "POST", "/admin/users/"+id+"/delete", id, nil)
+	deleted, _, _ := Repo.DB.AuditEvents(context.Background(), models.AuditFilter{Type: models.AuditUserDeleted}, 1, 0)
+	if len(deleted) != 1 || deleted[0].Metadata["user"] != id || len(deleted[0].Metadata) != 1 {
+		t.Errorf("expected deletion event with only the user ID, got %+v", deleted)
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	user := insertUser(t, "filtered@example.com")
+	for _, eventType := range []string{models.AuditPasswordChanged, models.AuditEmailChanged, models.AuditPasswordChanged} {
+		Repo.DB.InsertAuditEvent(context.Background(), models.AuditEvent{Type: eventType, TargetUserID: user.ID})
+	}
+	id := strconv.FormatInt(user.ID, 10)
+
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+	}{
+		{"user", "/admin/audit?user=" + id, "(3 events)"},
+		{"user-and-type", "/admin/audit?user=" + id + "&type=" + models.AuditEmailChanged, "(1 events)"},
+		{"since-tomorrow", "/admin/audit?user=" + id + "&since=2999-01-01", "No events found"},
+		{"until-long-ago", "/admin/audit?user=" + id + "&until=2000-01-01", "No events found"},
+	}
+	for _, e := range tests {
+		rr := adminRequest(Repo.AdminAudit, "GET", e.url, "", nil)
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), e.expected) {
+			t.Errorf("%s: expected %d with %q, but got %d", e.name, http.StatusOK, e.expected, rr.Code)
+		}
+	}
+}
+
+func TestAdminAuditExport(t *testing.T) {
+	user := insertUser(t, "exported@example.com")
+	Repo.DB.InsertAuditEvent(context.Background(), models.AuditEvent{Type: models.AuditPasswordChanged, TargetUserID: user.ID, IP: "10.0.0.1", Metadata: map[string]string{"note": "a, b"}})
+	id := strconv.FormatInt(user.ID, 10)
+
+	rr := adminRequest(Repo.AdminAuditExport, "GET", "/admin/audit/export?user="+id, "", nil)
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil || rr.Header().Get("Content-Type") != "text/csv" || len(records) != 2 {
+		t.Fatalf("expected CSV with header and one event, got %v %v", records, err)
+	}
+	if records[1][2] != models.AuditPasswordChanged || records[1][4] != id || records[1][7] != `{"note":"a, b"}` {
+		t.Errorf("unexpected CSV record %v", records[1])
+	}
+
+	rr = adminRequest(Repo.AdminAuditExport, "GET", "/admin/audit/export?format=json&user="+id, "", nil)
+	var events []models.AuditEvent
+	if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil || len(events) != 1 || events[0].Metadata["note"] != "a, b" {
+		t.Errorf("expected JSON with one event, got %s", rr.Body.String())
+	}
+}
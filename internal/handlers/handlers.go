@@ -1,22 +1,25 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cepa995/go-web-template/internal/config"
 	"github.com/cepa995/go-web-template/internal/driver"
-	"github.com/cepa995/go-web-template/internal/encryption"
 	"github.com/cepa995/go-web-template/internal/forms"
 	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/logging"
 	"github.com/cepa995/go-web-template/internal/models"
 	render "github.com/cepa995/go-web-template/internal/render"
 	"github.com/cepa995/go-web-template/internal/repository"
 	"github.com/cepa995/go-web-template/internal/repository/dbrepo"
 	"github.com/cepa995/go-web-template/internal/urlsigner"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Repo the repository used by the handlers
@@ -50,6 +53,13 @@ func NewHandlers(r *Repository) {
 	Repo = r
 }
 
+// tokenTTL is how long links sent via email (activation, password reset) remain valid
+const tokenTTL = 60 * time.Minute
+
+// reauthWindow is how long after signing in users without a password can change account settings which
+// otherwise need the password
+const reauthWindow = 10 * time.Minute
+
 type jsonResponse struct {
 	OK      bool   `json:"ok"`
 	Message string `json:"message"`
@@ -64,6 +74,12 @@ func (m *Repository) Home(w http.ResponseWriter, r *http.Request) {
 	render.Template(w, r, "home.page.gohtml", &models.TemplateData{})
 }
 
+// Unauthorized handler - renders page shown to users who lack permission for the page they requested.
+func (m *Repository) Unauthorized(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	render.Template(w, r, "unauthorized.page.gohtml", &models.TemplateData{})
+}
+
 /*******************************************************************
                    AUTHENTICATION HANDLERS
 ********************************************************************/
@@ -71,15 +87,23 @@ func (m *Repository) Home(w http.ResponseWriter, r *http.Request) {
 func (m *Repository) ShowAuth(w http.ResponseWriter, r *http.Request) {
 	render.Template(w, r, "auth.page.gohtml", &models.TemplateData{
 		Form: forms.New(nil),
+		Data: map[string]interface{}{"providers": m.App.OIDC},
 	})
 }
 
 // SignOut handles user signing out
 func (m *Repository) SignOut(w http.ResponseWriter, r *http.Request) {
-	// Step 1. Destroy current user Session
-	_ = m.App.Session.Destroy(r.Context())
-	// Step 2. Renew Session token
-	_ = m.App.Session.RenewToken(r.Context())
+	// Step 1. Revoke the recorded session, so its remember me cookie stops working as well
+	if userID := m.currentUserID(r); userID != 0 {
+		m.audit(r, models.AuditEvent{Type: models.AuditSignOut, TargetUserID: userID})
+	}
+	if id := m.App.Session.GetInt64(r.Context(), "user_session_id"); id != 0 {
+		if err := m.DB.DeleteUserSession(r.Context(), id); err != nil {
+			m.logger(r).Error("could not revoke session", "session_id", id, "err", err)
+		}
+	}
+	// Step 2. Destroy current user Session and renew Session token
+	m.signOut(w, r)
 	// Step 3. Redirect to login page
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -103,6 +127,7 @@ func (m *Repository) PostSignIn(w http.ResponseWriter, r *http.Request) {
 	if !form.Valid() {
 		render.Template(w, r, "auth.page.gohtml", &models.TemplateData{
 			Form: form,
+			Data: map[string]interface{}{"providers": m.App.OIDC},
 		})
 		return
 	}
@@ -111,25 +136,21 @@ func (m *Repository) PostSignIn(w http.ResponseWriter, r *http.Request) {
 	password := form.Get("password")
 
 	// Step 1. Authenticate th user; get user by email and compare hashed password with password user provided
-	id, _, err := m.DB.Authenticate(email, password)
+	id, err := m.authenticate(r, email, password)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Invalid Login credentials")
+		m.App.Session.Put(r.Context(), "error", signInError(err))
 		http.Redirect(w, r, "/auth", http.StatusSeeOther)
 		return
 	}
-	user, err := m.DB.GetUserByID(id)
+	user, err := m.DB.GetUserByID(r.Context(), id)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Could not get %s from the database", email))
 		http.Redirect(w, r, "/auth", http.StatusSeeOther)
 		return
 	}
 
-	// Step 4. Log in the user by storing userID in the session
-	m.App.Session.Put(r.Context(), "user_id", user.ID)
-	m.App.Session.Put(r.Context(), "access_level", user.AccessLevel)
-	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	// Step 2. Log in the user, unless a two-factor code is required first
+	m.completeSignIn(w, r, user.ID, form.Get("remember") != "", "password")
 }
 
 // PostSignUp handler - renders sign in page
@@ -165,7 +186,7 @@ func (m *Repository) PostSignUp(w http.ResponseWriter, r *http.Request) {
 
 		out, err := json.MarshalIndent(resp, "", "    ")
 		if err != nil {
-			helpers.ServerError(w, err)
+			helpers.ServerError(w, r, err)
 			return
 		}
 
@@ -178,36 +199,22 @@ func (m *Repository) PostSignUp(w http.ResponseWriter, r *http.Request) {
 	lastName := form.Get("lastName")
 
 	email := form.Get("email")
-	_, err = m.DB.GetUserByEmail(email)
+	_, err = m.DB.GetUserByEmail(r.Context(), email)
 	if err == nil {
 		resp := jsonResponse{
 			OK:      false,
 			Message: "Email address already exists!",
 		}
-		helpers.WriteJSON(w, http.StatusBadRequest, resp)
+		helpers.WriteJSON(w, http.StatusOK, resp)
 		return
 	}
 
-	link := fmt.Sprintf("%s/activate-account?firstName=%s&lastName=%s&email=%s", m.App.FrontEnd, firstName, lastName, email)
-
-	sign := urlsigner.Signer{
-		Secret: []byte(m.App.SecretKey),
-	}
-	signedLink := sign.GenerateTokenFromString(link)
-	var data struct {
-		Link string
-	}
-	data.Link = signedLink
-	msg := models.MailData{
-		To:           email,
-		From:         "admin@muscle-factory.pro",
-		Subject:      "Activate Account",
-		TemplateName: "activate-account",
-		Data:         data,
+	err = m.sendActivationLink(r.Context(), firstName, lastName, email)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
 	}
 
-	m.App.MailChan <- msg
-
 	resp := jsonResponse{
 		OK:      true,
 		Message: "Success!",
@@ -227,7 +234,7 @@ func (m *Repository) SendPasswordResetEmail(w http.ResponseWriter, r *http.Reque
 	err := r.ParseForm()
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "Could not parse the form")
-		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		http.Redirect(w, r, "/auth/forgot-password", http.StatusSeeOther)
 	}
 
 	form := forms.New(r.PostForm)
@@ -243,71 +250,37 @@ func (m *Repository) SendPasswordResetEmail(w http.ResponseWriter, r *http.Reque
 	email := form.Get("email")
 
 	// Verify that User with specified email exists
-	_, err = m.DB.GetUserByEmail(email)
+	user, err := m.DB.GetUserByEmail(r.Context(), email)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("User with %s email does not exist", email))
-		http.Redirect(w, r, "/forgot-password", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, "/auth/forgot-password", http.StatusSeeOther)
 		return
 	}
 
-	link := fmt.Sprintf("%s/reset-password?email=%s", m.App.FrontEnd, email)
-	sign := urlsigner.Signer{
-		Secret: []byte(m.App.SecretKey),
-	}
-
-	signedLink := sign.GenerateTokenFromString(link)
-
-	var data struct {
-		Link string
-	}
-	data.Link = signedLink
-	msg := models.MailData{
-		To:           email,
-		From:         "admin@muscle-factory.pro",
-		Subject:      "Password Reset Request",
-		TemplateName: "password-reset",
-		Data:         data,
+	err = m.sendPasswordResetLink(r.Context(), user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
 	}
+	m.audit(r, models.AuditEvent{Type: models.AuditPasswordResetRequest, TargetUserID: user.ID})
 
-	m.App.MailChan <- msg
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Password reset link was sent to %s", email))
+	http.Redirect(w, r, "/auth", http.StatusSeeOther)
 }
 
 // ShowResetPassword handles rendering page for entering new password after clicking on reset link
 func (m *Repository) ShowResetPassword(w http.ResponseWriter, r *http.Request) {
-	theURL := r.RequestURI
-	testURL := fmt.Sprintf("%s%s", m.App.FrontEnd, theURL)
-	signer := urlsigner.Signer{
-		Secret: []byte(m.App.SecretKey),
-	}
-
-	valid := signer.VerifyToken(testURL)
-	if !valid {
-		m.App.Session.Put(r.Context(), "error", "Invalid URL - tampering detected")
-		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
-		return
-	}
-
-	// Step 2. Make sure password token has not expired
-	expired := signer.IsExpired(testURL, 60)
-	if expired {
-		m.App.Session.Put(r.Context(), "error", "Link has expired")
-		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
-		return
-	}
-
-	encryptor := encryption.Encryption{
-		Key: []byte(m.App.SecretKey),
-	}
-
-	email := r.URL.Query().Get("email")
-	encryptedEmail, err := encryptor.Encrypt(email)
+	// Step 1. Make sure token exists, has not expired and has not been used yet
+	plainText := r.URL.Query().Get("token")
+	_, err := m.DB.GetToken(r.Context(), plainText, models.ScopePasswordReset)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Could not encrypt email")
-		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", m.linkError(r, models.ScopePasswordReset))
+		http.Redirect(w, r, "/auth/forgot-password", http.StatusSeeOther)
 		return
 	}
 
-	m.App.Session.Put(r.Context(), "email", encryptedEmail)
+	// Step 2. Keep the token in the session; it is consumed once the new password is submitted
+	m.App.Session.Put(r.Context(), "reset_token", plainText)
 	render.Template(w, r, "auth-reset-password.page.gohtml", &models.TemplateData{
 		Form: forms.New(nil),
 	})
@@ -319,7 +292,8 @@ func (m *Repository) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "Could not parse the form")
-		http.Redirect(w, r, "/reset-password", http.StatusSeeOther)
+		http.Redirect(w, r, "/auth/reset-password", http.StatusSeeOther)
+		return
 	}
 
 	form := forms.New(r.PostForm)
@@ -332,188 +306,436 @@ func (m *Repository) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Step 2. Make sure user has re-entered his password correctly
+	// Step 2. Make sure user has re-entered his password correctly and the password satisfies the policy
+	plainText := m.App.Session.GetString(r.Context(), "reset_token")
 	newPassword := form.Get("password")
 	verifyPassword := form.Get("verify-password")
 	if newPassword != verifyPassword {
+		form.Errors.Add("verify-password", "Passwords do not match")
+	}
+	form.Password("password", m.App.PasswordPolicy, m.passwordPersonalInfo(r.Context(), plainText, models.ScopePasswordReset)...)
+	if !form.Valid() {
 		render.Template(w, r, "auth-reset-password.page.gohtml", &models.TemplateData{
 			Form: form,
 		})
 		return
 	}
 
-	// Step 3. Get user by email that has been stored in the session
-	if !m.App.Session.Exists(r.Context(), "email") {
-		render.Template(w, r, "auth-reset-password.page.gohtml", &models.TemplateData{
-			Form: form,
-		})
+	// Step 3. Consume reset token stored in the session and update password of the user it was issued for
+	userID, err := m.resetPassword(r.Context(), plainText, newPassword)
+	if errors.Is(err, errInvalidToken) {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/auth/forgot-password", http.StatusSeeOther)
 		return
-	}
-	encryptedEmail, ok := m.App.Session.Get(r.Context(), "email").(string)
-	if !ok {
-		m.App.ErrorLog.Println(fmt.Sprintf("could not convert interface - %v to string", m.App.Session.Get(r.Context(), "email")))
-		helpers.ServerError(w, err)
+	} else if err != nil {
+		helpers.ServerError(w, r, err)
 		return
 	}
+	m.App.Session.Remove(r.Context(), "reset_token")
+	m.audit(r, models.AuditEvent{Type: models.AuditPasswordReset, TargetUserID: userID})
 
-	encryptor := encryption.Encryption{
-		Key: []byte(m.App.SecretKey),
-	}
+	m.App.Session.Put(r.Context(), "flash", "Password changed successfully, you can sign in now")
+	http.Redirect(w, r, "/auth", http.StatusSeeOther)
+}
 
-	email, err := encryptor.Decrypt(encryptedEmail)
+// ShowActivateUserAccount handles rendering page when user visits link sent via his email for activating has account
+func (m *Repository) ShowActivateUserAccount(w http.ResponseWriter, r *http.Request) {
+	// Step 1. Make sure token exists, has not expired and has not been used yet
+	plainText := r.URL.Query().Get("token")
+	_, err := m.DB.GetToken(r.Context(), plainText, models.ScopeActivation)
 	if err != nil {
-		m.App.ErrorLog.Println("could not decrypt email address")
-		helpers.ServerError(w, err)
+		m.App.Session.Put(r.Context(), "error", m.linkError(r, models.ScopeActivation))
+		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	user, err := m.DB.GetUserByEmail(email)
+	// Step 2. Keep the token in the session; it is consumed once the password is submitted
+	m.App.Session.Put(r.Context(), "activation_token", plainText)
+	render.Template(w, r, "auth-activate-account.page.gohtml", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// ActivateUserAccount handles inserting new user to the database
+func (m *Repository) ActivateUserAccount(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
-		helpers.ServerError(w, err)
+		m.App.Session.Put(r.Context(), "error", "Could not parse the form")
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	// Activation token stored in the session holds the details entered during sign up
+	plainText := m.App.Session.GetString(r.Context(), "activation_token")
+
+	form := forms.New(r.PostForm)
+	form.Required("password")
+	form.Password("password", m.App.PasswordPolicy, m.passwordPersonalInfo(r.Context(), plainText, models.ScopeActivation)...)
+
+	if !form.Valid() {
+		resp := jsonResponse{
+			OK:      false,
+			Message: form.Errors.Get("password"),
+		}
+		helpers.WriteJSON(w, http.StatusBadRequest, resp)
+		return
+	}
+
+	password := form.Get("password")
+
+	// Consume the activation token, so the link can be used only once
+	userID, err := m.activateAccount(r.Context(), plainText, password)
+	if errors.Is(err, errInvalidToken) {
+		resp := jsonResponse{
+			OK:      false,
+			Message: "Activation link is invalid or has expired!",
+		}
+		helpers.WriteJSON(w, http.StatusBadRequest, resp)
+		return
+	} else if err != nil {
+		helpers.ServerError(w, r, err)
 		return
 	}
+	m.App.Session.Remove(r.Context(), "activation_token")
+	m.audit(r, models.AuditEvent{Type: models.AuditAccountActivated, TargetUserID: userID})
 
-	// Step 4. Generate new password hash
-	newHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), 12)
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Successfully registered user!",
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, resp)
+}
+
+// UnlockAccount handles the link emailed when an account gets locked after too many failed sign-ins
+func (m *Repository) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	token, err := m.DB.ConsumeToken(r.Context(), r.URL.Query().Get("token"), models.ScopeUnlock)
 	if err != nil {
-		helpers.ServerError(w, err)
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
 		return
 	}
 
-	// Step 5. Update the user password
-	err = m.DB.UpdatePasswordForUser(user, string(newHash))
+	err = m.DB.UnlockUser(r.Context(), token.UserID)
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 		return
 	}
+	m.audit(r, models.AuditEvent{Type: models.AuditAccountUnlocked, TargetUserID: token.UserID})
+
+	m.App.Session.Put(r.Context(), "flash", "Your account has been unlocked, you can sign in now")
+	http.Redirect(w, r, "/auth", http.StatusSeeOther)
 }
 
-// ShowActivateUserAccount handles rendering page when user visits link sent via his email for activating has account
-func (m *Repository) ShowActivateUserAccount(w http.ResponseWriter, r *http.Request) {
-	theURL := r.RequestURI
+/*******************************************************************
+                   ACCOUNT HELPERS
+********************************************************************/
 
-	testURL := fmt.Sprintf("%s%s", m.App.FrontEnd, theURL)
-	testURL = strings.ReplaceAll(testURL, "amp;", "")
+// logger returns application logger which adds ID of the request to every entry
+func (m *Repository) logger(r *http.Request) *logging.Logger {
+	return m.App.Logger.FromContext(r.Context())
+}
 
-	signer := urlsigner.Signer{
-		Secret: []byte(m.App.SecretKey),
+// errInvalidToken is returned when a token does not exist, has expired or has already been used
+var errInvalidToken = errors.New("invalid or expired token")
+
+// authenticate checks email and password. Failed attempts are recorded in the audit log. When the
+// attempt locks the account because of too many failures, the owner is emailed a link for unlocking it.
+func (m *Repository) authenticate(r *http.Request, email, password string) (int64, error) {
+	id, _, err := m.DB.Authenticate(r.Context(), email, password)
+	if err == nil {
+		return id, nil
 	}
 
-	// Step 1. Verify URL token
-	valid := signer.VerifyToken(testURL)
-	if !valid {
-		m.App.Session.Put(r.Context(), "error", "Invalid URL - tampering detected")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+	user, userErr := m.DB.GetUserByEmail(r.Context(), email)
+	m.audit(r, models.AuditEvent{
+		Type:         models.AuditSignInFailed,
+		TargetUserID: user.ID,
+		Metadata:     map[string]string{"email": truncate(email, 255), "reason": err.Error()},
+	})
+	if errors.Is(err, repository.ErrTooManyAttempts) && userErr == nil {
+		if mailErr := m.sendUnlockLink(r.Context(), user); mailErr != nil {
+			m.logger(r).Error("could not send unlock link", "user_id", user.ID, "err", mailErr)
+		}
 	}
+	return id, err
+}
 
-	// Step 2. Make sure password token has not expired
-	expired := signer.IsExpired(testURL, 60)
-	if expired {
-		m.App.Session.Put(r.Context(), "error", "Link has expired")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+// checkPassword adds an error to field of form unless it holds the password of the signed in user. Unlike
+// authenticate it only compares the password, so failed attempts neither lock the account nor are
+// recorded. Users without a password (e.g. signed up with OpenID Connect) confirm by having signed in
+// within reauthWindow instead.
+func (m *Repository) checkPassword(r *http.Request, form *forms.Form, field string, user models.User) error {
+	if user.Password == "" {
+		signedInAt := time.Unix(m.App.Session.GetInt64(r.Context(), "signed_in_at"), 0)
+		if time.Since(signedInAt) > reauthWindow {
+			form.Errors.Add(field, "You have no password, please sign in again to confirm this change")
+		}
+		return nil
 	}
 
-	encryptor := encryption.Encryption{
-		Key: []byte(m.App.SecretKey),
+	form.Required(field)
+	if form.Get(field) == "" {
+		return nil
 	}
+	err := m.DB.CheckPassword(r.Context(), user.ID, form.Get(field))
+	if errors.Is(err, repository.ErrInvalidCredentials) {
+		form.Errors.Add(field, "Incorrect password")
+		return nil
+	}
+	return err
+}
+
+// completeSignIn signs in the user whose identity has been verified (by password, OpenID Connect provider
+// or emailed link); method is recorded in the audit log. Users with two-factor authentication are sent to
+// enter a code first. With remember the user stays signed in for App.RememberMeDuration.
+func (m *Repository) completeSignIn(w http.ResponseWriter, r *http.Request, userID int64, remember bool, method string) {
+	// Step 1. Prevent session fixation by renewing the session token
+	_ = m.App.Session.RenewToken(r.Context())
 
-	firstName := r.URL.Query().Get("firstName")
-	lastName := r.URL.Query().Get("lastName")
-	email := r.URL.Query().Get("email")
-	encryptedEmail, err := encryptor.Encrypt(email)
+	// Step 2. Users with two-factor authentication have to enter a code before they are signed in
+	twoFactor, err := m.DB.GetTwoFactor(r.Context(), userID)
 	if err != nil {
-		m.App.ErrorLog.Println("could not decrypt email address")
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if twoFactor.Enabled {
+		m.startTwoFactorChallenge(r, userID, remember, method)
+		http.Redirect(w, r, "/auth/two-factor", http.StatusSeeOther)
 		return
 	}
 
-	m.App.Session.Put(r.Context(), "firstName", firstName)
-	m.App.Session.Put(r.Context(), "lastName", lastName)
-	m.App.Session.Put(r.Context(), "email", encryptedEmail)
-	render.Template(w, r, "auth-activate-account.page.gohtml", &models.TemplateData{
-		Form: forms.New(nil),
+	// Step 3. Log in the user by storing userID in the session
+	err = m.startUserSession(w, r, userID, remember)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "signed_in_at", time.Now().Unix())
+	m.audit(r, models.AuditEvent{
+		Type:         models.AuditSignIn,
+		TargetUserID: userID,
+		Metadata:     map[string]string{"method": method, "remember": strconv.FormatBool(remember)},
 	})
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// ActivateUserAccount handles inserting new user to the database
-func (m *Repository) ActivateUserAccount(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+// signInError returns message shown to the user when authentication fails
+func signInError(err error) string {
+	switch {
+	case errors.Is(err, repository.ErrAccountBlocked):
+		return "Your account has been blocked"
+	case errors.Is(err, repository.ErrAccountLocked), errors.Is(err, repository.ErrTooManyAttempts):
+		return "Too many failed sign-in attempts. Your account is temporarily locked, we emailed you a link to unlock it"
+	default:
+		return "Invalid Login credentials"
+	}
+}
+
+// signedLink returns link to path on the front end with token, signed for the scope of the token until it
+// expires. The token decides whether the link can be used; the signature lets linkError explain why not.
+// Only path and query are signed, the front end is prepended afterwards.
+func (m *Repository) signedLink(path string, token *models.Token) (string, error) {
+	signed, err := m.App.URLSigner.Sign(token.Scope, path+"?token="+token.PlainText, time.Until(token.Expiry), nil)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Could not parse the form")
-		helpers.ServerError(w, err)
-		return
+		return "", err
 	}
+	return strings.TrimSuffix(m.App.FrontEnd, "/") + signed, nil
+}
 
-	form := forms.New(r.PostForm)
-	form.Required("password")
-	form.MinLength("password", 3)
+// linkError returns message shown when the token of a link made by signedLink for scope can not be used.
+// Links without a signature (e.g. sent before links were signed) get the generic message.
+func (m *Repository) linkError(r *http.Request, scope string) string {
+	_, err := m.App.URLSigner.Verify(scope, r.URL.RequestURI())
+	switch {
+	case err == nil:
+		return "This link has already been used or a newer one has been sent"
+	case errors.Is(err, urlsigner.ErrExpired):
+		return "This link has expired, please request a new one"
+	case errors.Is(err, urlsigner.ErrMissing):
+		return "Invalid or expired link"
+	default:
+		return "This link is not valid, make sure you opened all of it"
+	}
+}
 
-	if !form.Valid() {
-		resp := jsonResponse{
-			OK:      false,
-			Message: "Make sure your password is at least 3 characters long!",
-		}
-		helpers.WriteJSON(w, http.StatusBadRequest, resp)
-		return
+// sendActivationLink issues an activation token for a new account and queues email with the link to it.
+// Only the newest activation link sent to an email address is valid.
+func (m *Repository) sendActivationLink(ctx context.Context, firstName, lastName, email string) error {
+	err := m.DB.RevokeTokens(ctx, email, models.ScopeActivation)
+	if err != nil {
+		return err
 	}
 
-	password := form.Get("password")
-	firstName, ok := m.App.Session.Get(r.Context(), "firstName").(string)
-	if !ok {
-		m.App.ErrorLog.Println(fmt.Sprintf("could not convert interface - %v to string", m.App.Session.Get(r.Context(), "firstName")))
-		return
+	token, err := models.GenerateToken(0, email, tokenTTL, models.ScopeActivation)
+	if err != nil {
+		return err
 	}
-	lastName, ok := m.App.Session.Get(r.Context(), "lastName").(string)
-	if !ok {
-		m.App.ErrorLog.Println(fmt.Sprintf("could not convert interface - %v to string", m.App.Session.Get(r.Context(), "lastName")))
-		return
+	token.Data["firstName"] = firstName
+	token.Data["lastName"] = lastName
+
+	err = m.DB.InsertToken(ctx, *token)
+	if err != nil {
+		return err
 	}
-	encryptedEmail, ok := m.App.Session.Get(r.Context(), "email").(string)
-	if !ok {
-		m.App.ErrorLog.Println(fmt.Sprintf("could not convert interface - %v to string", m.App.Session.Get(r.Context(), "email")))
-		helpers.ServerError(w, err)
-		return
+
+	var data struct {
+		Link string
+	}
+	data.Link, err = m.signedLink("/auth/activate-account", token)
+	if err != nil {
+		return err
+	}
+	msg := models.MailData{
+		To:           email,
+		From:         m.App.MailFrom,
+		Subject:      "Activate Account",
+		TemplateName: "activate-account",
+		Data:         data,
 	}
 
-	encryptor := encryption.Encryption{
-		Key: []byte(m.App.SecretKey),
+	_, err = m.DB.EnqueueMail(ctx, msg)
+	return err
+}
+
+// sendPasswordResetLink issues a password reset token and queues email with the link to it. Requesting
+// a new link invalidates links sent earlier.
+func (m *Repository) sendPasswordResetLink(ctx context.Context, user models.User) error {
+	err := m.DB.RevokeTokens(ctx, user.Email, models.ScopePasswordReset)
+	if err != nil {
+		return err
 	}
 
-	email, err := encryptor.Decrypt(encryptedEmail)
+	token, err := models.GenerateToken(user.ID, user.Email, tokenTTL, models.ScopePasswordReset)
 	if err != nil {
-		m.App.ErrorLog.Println("could not decrypt email address")
-		helpers.ServerError(w, err)
-		return
+		return err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	err = m.DB.InsertToken(ctx, *token)
 	if err != nil {
-		m.App.ErrorLog.Println("could not hash user password")
-		helpers.ServerError(w, err)
-		return
+		return err
+	}
+
+	var data struct {
+		Link string
+	}
+	data.Link, err = m.signedLink("/auth/reset-password", token)
+	if err != nil {
+		return err
+	}
+	msg := models.MailData{
+		To:           user.Email,
+		From:         m.App.MailFrom,
+		Subject:      "Password Reset Request",
+		TemplateName: "password-reset",
+		Data:         data,
+	}
+
+	_, err = m.DB.EnqueueMail(ctx, msg)
+	return err
+}
+
+// sendUnlockLink issues an unlock token and queues email with the link to it.
+func (m *Repository) sendUnlockLink(ctx context.Context, user models.User) error {
+	err := m.DB.RevokeTokens(ctx, user.Email, models.ScopeUnlock)
+	if err != nil {
+		return err
+	}
+
+	token, err := models.GenerateToken(user.ID, user.Email, tokenTTL, models.ScopeUnlock)
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertToken(ctx, *token)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		Link string
+	}
+	data.Link = fmt.Sprintf("%s/auth/unlock-account?token=%s", m.App.FrontEnd, token.PlainText)
+	msg := models.MailData{
+		To:           user.Email,
+		From:         m.App.MailFrom,
+		Subject:      "Your account has been locked",
+		TemplateName: "unlock-account",
+		Data:         data,
+	}
+
+	_, err = m.DB.EnqueueMail(ctx, msg)
+	return err
+}
+
+// passwordPersonalInfo returns email and name of the user a password is being chosen for with token, which
+// the password must not contain. Invalid tokens give nothing; they are rejected once the token is consumed.
+func (m *Repository) passwordPersonalInfo(ctx context.Context, plainText, scope string) []string {
+	token, err := m.DB.GetToken(ctx, plainText, scope)
+	if err != nil {
+		return nil
+	}
+
+	personal := []string{token.Email, token.Data["firstName"], token.Data["lastName"]}
+	if token.UserID != 0 {
+		if user, err := m.DB.GetUserByID(ctx, token.UserID); err == nil {
+			personal = append(personal, user.Email, user.FirstName, user.LastName)
+		}
+	}
+	return personal
+}
+
+// activateAccount consumes an activation token and creates the user it was issued for.
+func (m *Repository) activateAccount(ctx context.Context, plainText, password string) (int64, error) {
+	token, err := m.DB.ConsumeToken(ctx, plainText, models.ScopeActivation)
+	if err != nil {
+		return 0, errInvalidToken
+	}
+
+	hashedPassword, err := m.App.PasswordHasher.Hash(password)
+	if err != nil {
+		return 0, err
 	}
 
 	user := models.User{
-		FirstName:   firstName,
-		LastName:    lastName,
-		Email:       email,
-		Password:    string(hashedPassword),
-		AccessLevel: 1,
+		FirstName: token.Data["firstName"],
+		LastName:  token.Data["lastName"],
+		Email:     token.Email,
+		Password:  hashedPassword,
 	}
 
-	_, err = m.DB.InsertUser(user)
+	return m.DB.InsertUser(ctx, user)
+}
+
+// resetPassword consumes a password reset token, sets new password for the user it was issued for and
+// returns ID of the user. Every API token and session of the user is revoked, so a stolen token or cookie
+// cannot outlive the password change.
+func (m *Repository) resetPassword(ctx context.Context, plainText, password string) (int64, error) {
+	token, err := m.DB.ConsumeToken(ctx, plainText, models.ScopePasswordReset)
 	if err != nil {
-		m.App.ErrorLog.Println("could not insert user into the database")
-		helpers.ServerError(w, err)
-		return
+		return 0, errInvalidToken
 	}
 
-	resp := jsonResponse{
-		OK:      true,
-		Message: "Successfully registered user!",
+	user, err := m.DB.GetUserByID(ctx, token.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	newHash, err := m.App.PasswordHasher.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.DB.UpdatePasswordForUser(ctx, user, newHash)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.DB.DeleteUserSessionsForUser(ctx, user.ID)
+	if err != nil {
+		return 0, err
 	}
 
-	helpers.WriteJSON(w, http.StatusBadRequest, resp)
+	return user.ID, m.DB.RevokeTokensForUser(ctx, user.ID, models.ScopeAuthentication)
 }
@@ -9,8 +9,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/logging"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/passwords"
+	"github.com/cepa995/go-web-template/internal/ratelimit"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type postData struct {
@@ -28,6 +36,7 @@ var theTests = []struct {
 	{"home", "/", "GET", []postData{}, http.StatusOK},
 	{"auth", "/auth", "GET", []postData{}, http.StatusOK},
 	{"signout", "/auth/signout", "GET", []postData{}, http.StatusOK},
+	{"unauthorized", "/unauthorized_access", "GET", []postData{}, http.StatusForbidden},
 	{"signin", "/auth/signin", "POST", []postData{
 		{key: "email", value: "test@gmail.com"},
 		{key: "password", value: "test123"},
@@ -200,43 +209,43 @@ var registerTests = []struct {
 	},
 	{
 		"invalid-info-pt1",
-		"Jon",
+		"J",
 		"Doe",
-		"",
-		"test2@gmail.com",
+		"password",
+		"test3@gmail.com",
 		http.StatusOK,
 		"/auth",
 		jsonResponse{
 			OK:      false,
-			Message: "Missing Password",
+			Message: "Name is too small",
 		},
 		"",
 	},
 	{
 		"invalid-info-pt1",
-		"J",
+		"Jon",
 		"Doe",
 		"password",
-		"test3@gmail.com",
+		"test@gmail.com",
 		http.StatusOK,
 		"/auth",
 		jsonResponse{
 			OK:      false,
-			Message: "Name is too small",
+			Message: "Email Exists",
 		},
 		"",
 	},
 	{
-		"invalid-info-pt1",
+		"invalid-email",
 		"Jon",
 		"Doe",
-		"password",
-		"test@gmail.com",
+		"",
+		"test2@gmail",
 		http.StatusOK,
 		"/auth",
 		jsonResponse{
 			OK:      false,
-			Message: "Email Exists",
+			Message: "Invalid Email",
 		},
 		"",
 	},
@@ -292,3 +301,476 @@ func TestSignUp(t *testing.T) {
 		}
 	}
 }
+
+func TestSignUp_SendsActivationEmail(t *testing.T) {
+	testMailer.Reset()
+
+	postedData := url.Values{}
+	postedData.Add("firstName", "Jon")
+	postedData.Add("lastName", "Doe")
+	postedData.Add("email", "new-user@gmail.com")
+
+	req, _ := http.NewRequest("POST", "/auth/signup", nil)
+	ctx := logging.WithRequestID(getCtx(req), "signup-1")
+	req = req.WithContext(ctx)
+	req.PostForm = postedData
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(Repo.PostSignUp)
+	handler.ServeHTTP(rr, req)
+
+	messages := testMailer.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 email to be sent, but got %d", len(messages))
+	}
+	if messages[0].To != "new-user@gmail.com" || messages[0].Subject != "Activate Account" {
+		t.Errorf("unexpected email %+v", messages[0])
+	}
+	if messages[0].From != app.MailFrom {
+		t.Errorf("expected email from %s, but got %s", app.MailFrom, messages[0].From)
+	}
+	if messages[0].HTML == "" || messages[0].Text == "" {
+		t.Error("expected both HTML and plain text versions of the email")
+	}
+	if messages[0].RequestID != "signup-1" {
+		t.Errorf("expected email to carry ID of the request, but got %q", messages[0].RequestID)
+	}
+}
+
+// tokenFromLink extracts token query parameter from the last email sent with testMailer
+func tokenFromLink(t *testing.T) string {
+	messages := testMailer.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no email was sent")
+	}
+
+	match := regexp.MustCompile(`token=([A-Z2-7]+)`).FindStringSubmatch(messages[len(messages)-1].Text)
+	if match == nil {
+		t.Fatal("email does not contain a link with token")
+	}
+	return match[1]
+}
+
+func TestActivateUserAccount(t *testing.T) {
+	testMailer.Reset()
+
+	// Step 1. Sign up, which sends activation link
+	req, _ := http.NewRequest("POST", "/auth/signup", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.PostForm = url.Values{
+		"firstName": {"Jane"},
+		"lastName":  {"Doe"},
+		"email":     {"jane@gmail.com"},
+	}
+	http.HandlerFunc(Repo.PostSignUp).ServeHTTP(httptest.NewRecorder(), req)
+
+	token := tokenFromLink(t)
+	if len(token) > 32 {
+		t.Errorf("expected short opaque token, but got %s", token)
+	}
+
+	// Step 2. Open activation link
+	req, _ = http.NewRequest("GET", "/auth/activate-account?token="+token, nil)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowActivateUserAccount).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected activation page to render, but got code %d", rr.Code)
+	}
+
+	// Step 3. Submit password; the link can be used only once
+	for i, expected := range []bool{true, false} {
+		req, _ = http.NewRequest("POST", "/auth/activate-account", nil)
+		req = req.WithContext(ctx)
+		req.PostForm = url.Values{"password": {"correct horse battery"}}
+		Repo.App.Session.Put(ctx, "activation_token", token)
+
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(Repo.ActivateUserAccount).ServeHTTP(rr, req)
+
+		var d jsonResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		if d.OK != expected {
+			t.Errorf("attempt %d: expected ok=%v, but got %v (%s)", i+1, expected, d.OK, d.Message)
+		}
+	}
+}
+
+var invalidTokenTests = []struct {
+	name     string
+	url      string
+	handler  func(m *Repository, w http.ResponseWriter, r *http.Request)
+	location string
+}{
+	{"activate-missing-token", "/auth/activate-account", (*Repository).ShowActivateUserAccount, "/"},
+	{"activate-unknown-token", "/auth/activate-account?token=ABCDEFGHIJKLMNOPQRSTUVWXYZ", (*Repository).ShowActivateUserAccount, "/"},
+	{"reset-unknown-token", "/auth/reset-password?token=ABCDEFGHIJKLMNOPQRSTUVWXYZ", (*Repository).ShowResetPassword, "/auth/forgot-password"},
+}
+
+func TestInvalidTokens(t *testing.T) {
+	for _, e := range invalidTokenTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		req = req.WithContext(getCtx(req))
+		rr := httptest.NewRecorder()
+
+		e.handler(Repo, rr, req)
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != e.location {
+			t.Errorf("failed %s: expected redirect to %s, but got code %d and location %q", e.name, e.location, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+	// Expired reset links send the user to request a new one
+	token, err := models.GenerateToken(1, "test@gmail.com", -time.Minute, models.ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Repo.DB.InsertToken(context.Background(), *token)
+
+	req, _ := http.NewRequest("GET", "/auth/reset-password?token="+token.PlainText, nil)
+	req = req.WithContext(getCtx(req))
+	rr := httptest.NewRecorder()
+	Repo.ShowResetPassword(rr, req)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/auth/forgot-password" {
+		t.Errorf("expired reset token: expected redirect to /auth/forgot-password, but got code %d and location %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+// signedLinkTests open reset links whose token is not valid (anymore); the signature tells why
+var signedLinkTests = []struct {
+	name    string
+	link    func(token *models.Token) string
+	message string
+}{
+	{"used", func(token *models.Token) string {
+		link, _ := Repo.signedLink("/auth/reset-password", token)
+		return link
+	}, "already been used"},
+	{"expired", func(token *models.Token) string {
+		link, _ := app.URLSigner.Sign(models.ScopePasswordReset, "/auth/reset-password?token="+token.PlainText, -time.Minute, nil)
+		return link
+	}, "has expired"},
+	{"modified", func(token *models.Token) string {
+		link, _ := Repo.signedLink("/auth/reset-password", token)
+		return strings.Replace(link, token.PlainText, "ABCDEFGHIJKLMNOPQRSTUVWXYZ", 1)
+	}, "not valid"},
+	{"wrong-purpose", func(token *models.Token) string {
+		link, _ := app.URLSigner.Sign(models.ScopeActivation, "/auth/reset-password?token="+token.PlainText, time.Hour, nil)
+		return link
+	}, "not valid"},
+	{"unsigned", func(token *models.Token) string {
+		return "/auth/reset-password?token=" + token.PlainText
+	}, "Invalid or expired link"},
+}
+
+func TestSignedLinks(t *testing.T) {
+	for _, e := range signedLinkTests {
+		// The token is never stored, so only the signature can explain why the link does not work
+		token, err := models.GenerateToken(1, "test@gmail.com", time.Hour, models.ScopePasswordReset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("GET", e.link(token), nil)
+		ctx := getCtx(req)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.ShowResetPassword).ServeHTTP(rr, req.WithContext(ctx))
+		if message := session.GetString(ctx, "error"); rr.Header().Get("Location") != "/auth/forgot-password" || !strings.Contains(message, e.message) {
+			t.Errorf("for %s expected %q, but got %q", e.name, e.message, message)
+		}
+	}
+
+	// Emailed links are signed whatever the front end looks like, and lead to the page
+	defer func() { app.FrontEnd = "" }()
+	for _, frontEnd := range []string{"", "http://localhost:8080", "https://example.com/", "localhost:8080"} {
+		app.FrontEnd = frontEnd
+		testMailer.Reset()
+		if err := Repo.sendPasswordResetLink(context.Background(), models.User{ID: 1, Email: "test@gmail.com"}); err != nil {
+			t.Fatal(err)
+		}
+		text := testMailer.Messages()[0].Text
+		link := regexp.MustCompile(`/auth/reset-password\?\S+`).FindString(text)
+		if !strings.Contains(text, strings.TrimSuffix(frontEnd, "/")+"/auth/reset-password?") || !strings.Contains(link, "signature=") {
+			t.Fatalf("for front end %q expected signed link, got %q", frontEnd, link)
+		}
+
+		req, _ := http.NewRequest("GET", link, nil)
+		ctx := getCtx(req)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.ShowResetPassword).ServeHTTP(rr, req.WithContext(ctx))
+		if rr.Code != http.StatusOK {
+			t.Errorf("for front end %q expected emailed link to open the page, got %d (%s)", frontEnd, rr.Code, session.GetString(ctx, "error"))
+		}
+
+		// Once the link has been used, the signature still matches and tells the user so
+		Repo.DB.RevokeTokens(context.Background(), "test@gmail.com", models.ScopePasswordReset)
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(Repo.ShowResetPassword).ServeHTTP(rr, req.WithContext(ctx))
+		if message := session.GetString(ctx, "error"); !strings.Contains(message, "already been used") {
+			t.Errorf("for front end %q expected used link message, got %q", frontEnd, message)
+		}
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	testMailer.Reset()
+
+	// Step 1. Request password reset link
+	req, _ := http.NewRequest("POST", "/auth/forgot-password", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.PostForm = url.Values{"email": {"test@gmail.com"}}
+	http.HandlerFunc(Repo.SendPasswordResetEmail).ServeHTTP(httptest.NewRecorder(), req)
+
+	token := tokenFromLink(t)
+
+	// Step 2. Open reset link
+	req, _ = http.NewRequest("GET", "/auth/reset-password?token="+token, nil)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowResetPassword).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected reset password page to render, but got code %d", rr.Code)
+	}
+
+	// Step 3. Passwords which do not satisfy the policy are refused without using up the link
+	for _, password := range []string{"short", "12345678", "my-test-password"} {
+		req, _ = http.NewRequest("POST", "/auth/reset-password", nil)
+		req = req.WithContext(ctx)
+		req.PostForm = url.Values{"password": {password}, "verify-password": {password}}
+		Repo.App.Session.Put(ctx, "reset_token", token)
+
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(Repo.ResetPassword).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("weak password %s: expected the form to be rendered again, but got code %d", password, rr.Code)
+		}
+	}
+
+	// Step 4. Submit new password twice; only the first attempt may succeed
+	for i, expected := range []string{"/auth", "/auth/forgot-password"} {
+		req, _ = http.NewRequest("POST", "/auth/reset-password", nil)
+		req = req.WithContext(ctx)
+		req.PostForm = url.Values{"password": {"new-password"}, "verify-password": {"new-password"}}
+		Repo.App.Session.Put(ctx, "reset_token", token)
+
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(Repo.ResetPassword).ServeHTTP(rr, req)
+
+		loc, _ := rr.Result().Location()
+		if rr.Code != http.StatusSeeOther || loc == nil || loc.String() != expected {
+			t.Errorf("attempt %d: expected redirect to %s, but got code %d and location %v", i+1, expected, rr.Code, loc)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	handler := Repo.LoadPermissions(Repo.RequirePermission(models.PermissionAdminAccess)(http.HandlerFunc(Repo.Admin)))
+
+	serve := func(userID int64) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/admin", nil)
+		ctx := getCtx(req)
+		if userID != 0 {
+			session.Put(ctx, "user_id", userID)
+		}
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Signed out users are sent to sign in page
+	if rr := serve(0); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/auth" {
+		t.Errorf("signed out: expected redirect to /auth, but got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Regular users are not allowed in
+	if rr := serve(1); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/unauthorized_access" {
+		t.Errorf("regular user: expected redirect to /unauthorized_access, but got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Role changes take effect on the next request
+	if err := Repo.DB.AssignRole(context.Background(), 1, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	defer Repo.DB.RemoveRole(context.Background(), 1, models.RoleAdmin)
+
+	if rr := serve(1); rr.Code != http.StatusOK {
+		t.Errorf("admin: expected %d, but got %d", http.StatusOK, rr.Code)
+	}
+}
+
+// signIn posts credentials to PostSignIn and returns the error stored in the session, if any
+func signIn(email, password string) (*httptest.ResponseRecorder, string) {
+	req, _ := http.NewRequest("POST", "/auth/signin", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.PostForm = url.Values{"email": {email}, "password": {password}}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostSignIn).ServeHTTP(rr, req)
+	return rr, session.GetString(ctx, "error")
+}
+
+func TestSignIn_Rehash(t *testing.T) {
+	hash, _ := passwords.Bcrypt{Cost: bcrypt.MinCost}.Hash("correct horse battery")
+	id, err := Repo.DB.InsertUser(context.Background(), models.User{FirstName: "Old", LastName: "Hash", Email: "old-hash@example.com", Password: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Repo.DB.DeleteUser(context.Background(), id)
+
+	// A failed sign-in leaves the hash alone
+	signIn("old-hash@example.com", "wrong password")
+	if user, _ := Repo.DB.GetUserByID(context.Background(), id); user.Password != hash {
+		t.Errorf("expected hash not to change after failed sign-in, but got %s", user.Password)
+	}
+
+	if _, message := signIn("old-hash@example.com", "correct horse battery"); message != "" {
+		t.Fatalf("expected sign-in to succeed, but got %q", message)
+	}
+	user, _ := Repo.DB.GetUserByID(context.Background(), id)
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Errorf("expected bcrypt hash to be upgraded to Argon2id, but got %s", user.Password)
+	}
+
+	// The upgraded hash works and is not replaced again
+	if _, message := signIn("old-hash@example.com", "correct horse battery"); message != "" {
+		t.Errorf("expected sign-in with upgraded hash to succeed, but got %q", message)
+	}
+	if again, _ := Repo.DB.GetUserByID(context.Background(), id); again.Password != user.Password {
+		t.Error("expected current hash not to be replaced")
+	}
+}
+
+func TestSignIn_Lockout(t *testing.T) {
+	app.LockoutAttempts = 3
+	app.LockoutDuration = time.Minute
+	defer func() {
+		app.LockoutAttempts = 0
+		Repo.DB.UnlockUser(context.Background(), 1)
+	}()
+	testMailer.Reset()
+	// Failures left over from other tests must not count
+	Repo.DB.UnlockUser(context.Background(), 1)
+
+	// Step 1. Third failure in a row locks the account and emails unlock link
+	for attempt := 1; attempt <= 3; attempt++ {
+		_, message := signIn("test@gmail.com", "wrong_password")
+		locked := strings.Contains(message, "locked")
+		if locked != (attempt == 3) {
+			t.Errorf("attempt %d: unexpected message %q", attempt, message)
+		}
+	}
+	if messages := testMailer.Messages(); len(messages) != 1 || messages[0].To != "test@gmail.com" {
+		t.Fatalf("expected unlock email to be sent, got %d emails", len(messages))
+	}
+
+	// Step 2. Locked account can not sign in even with correct password, and no more emails are sent
+	if _, message := signIn("test@gmail.com", "password"); !strings.Contains(message, "locked") {
+		t.Errorf("expected account to be locked, got %q", message)
+	}
+	if len(testMailer.Messages()) != 1 {
+		t.Error("unlock email must be sent only when the account gets locked")
+	}
+
+	// Step 3. Unlock link can be used once
+	token := tokenFromLink(t)
+	for i, expected := range []string{"flash", "error"} {
+		req, _ := http.NewRequest("GET", "/auth/unlock-account?token="+token, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		http.HandlerFunc(Repo.UnlockAccount).ServeHTTP(httptest.NewRecorder(), req)
+		if !session.Exists(ctx, expected) {
+			t.Errorf("unlock attempt %d: expected %s message", i+1, expected)
+		}
+	}
+
+	if rr, message := signIn("test@gmail.com", "password"); message != "" || rr.Header().Get("Location") != "/" {
+		t.Errorf("expected successful sign in after unlocking, got %q", message)
+	}
+}
+
+func TestSignIn_Blocked(t *testing.T) {
+	user, _ := Repo.DB.GetUserByID(context.Background(), 1)
+	user.Blocked = true
+	Repo.DB.UpdateUser(context.Background(), user)
+	defer func() {
+		user.Blocked = false
+		Repo.DB.UpdateUser(context.Background(), user)
+	}()
+
+	if _, message := signIn("test@gmail.com", "password"); message != "Your account has been blocked" {
+		t.Errorf("expected blocked message, got %q", message)
+	}
+	if status, _ := apiRequest(t, "POST", "/api/v1/auth/signin", "", `{"email": "test@gmail.com", "password": "password"}`); status != http.StatusForbidden {
+		t.Errorf("api: expected %d, but got %d", http.StatusForbidden, status)
+	}
+}
+
+var rateLimitTests = []struct {
+	name             string
+	url              string
+	accept           string
+	referer          string
+	expectedStatus   int
+	expectedLocation string
+}{
+	{"api", "/api/v1/auth/signin", "", "", http.StatusTooManyRequests, ""},
+	{"accepts json", "/auth/signup", "application/json", "", http.StatusTooManyRequests, ""},
+	{"html", "/auth/forgot-password", "", "http://example.com/auth/forgot-password", http.StatusSeeOther, "/auth/forgot-password"},
+	{"html other site", "/auth/signin", "", "http://other.com/", http.StatusSeeOther, "/auth"},
+}
+
+func TestRateLimit(t *testing.T) {
+	defer func(store ratelimit.Store) { app.RateLimiter = store }(app.RateLimiter)
+	app.RateLimiter = ratelimit.NewMemoryStore(0)
+
+	rule := ratelimit.Rule{Name: "test", Limit: 1, Window: time.Minute, Key: ratelimit.ByIP}
+	handler := Repo.RateLimit(rule)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, e := range rateLimitTests {
+		send := func() (*httptest.ResponseRecorder, context.Context) {
+			req, _ := http.NewRequest("POST", e.url, nil)
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Host = "example.com"
+			req.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i+1)
+			req.Header.Set("Accept", e.accept)
+			req.Header.Set("Referer", e.referer)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			return rr, ctx
+		}
+
+		if rr, _ := send(); rr.Code != http.StatusOK {
+			t.Errorf("for %s expected first request to pass, got %d", e.name, rr.Code)
+		}
+
+		rr, ctx := send()
+		if rr.Code != e.expectedStatus {
+			t.Errorf("for %s expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "60" {
+			t.Errorf("for %s expected Retry-After 60, got %q", e.name, retryAfter)
+		}
+		if e.expectedLocation == "" {
+			if !strings.Contains(rr.Body.String(), "Too many requests") {
+				t.Errorf("for %s expected JSON error, got %s", e.name, rr.Body.String())
+			}
+			continue
+		}
+		if location := rr.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("for %s expected redirect to %s, got %s", e.name, e.expectedLocation, location)
+		}
+		if message := session.GetString(ctx, "error"); !strings.Contains(message, "Too many requests") {
+			t.Errorf("for %s expected error flash, got %q", e.name, message)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/forms"
+	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/render"
+)
+
+// magicLinkTTL is how long an emailed sign-in link remains valid
+const magicLinkTTL = 15 * time.Minute
+
+/*******************************************************************
+                   MAGIC LINK HANDLERS
+********************************************************************/
+
+// SendMagicLink handler - emails a single-use sign-in link. The response does not tell whether an
+// account with the email exists.
+func (m *Repository) SendMagicLink(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Could not parse the form")
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "auth.page.gohtml", &models.TemplateData{
+			Form: form,
+			Data: map[string]interface{}{"providers": m.App.OIDC},
+		})
+		return
+	}
+
+	email := form.Get("email")
+
+	// Blocked users would not be signed in by the link, so they are not sent one
+	user, err := m.DB.GetUserByEmail(r.Context(), email)
+	if err == nil && !user.Blocked {
+		err = m.sendMagicLink(r.Context(), user)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("If there is an account for %s, we emailed it a sign-in link", email))
+	http.Redirect(w, r, "/auth", http.StatusSeeOther)
+}
+
+// ShowMagicLink handler - renders page with a button which signs the user in. Opening the link does not
+// use it up, so mail scanners which fetch links in email can not spend it before the user does.
+func (m *Repository) ShowMagicLink(w http.ResponseWriter, r *http.Request) {
+	plainText := r.URL.Query().Get("token")
+	_, err := m.DB.GetToken(r.Context(), plainText, models.ScopeMagicLink)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "magic_link_token", plainText)
+	render.Template(w, r, "auth-magic-link.page.gohtml", &models.TemplateData{})
+}
+
+// MagicLinkSignIn handler - uses up the sign-in link opened in this session and signs the user in
+func (m *Repository) MagicLinkSignIn(w http.ResponseWriter, r *http.Request) {
+	// Step 1. Consume the token, so the link can be used only once
+	token, err := m.DB.ConsumeToken(r.Context(), m.App.Session.PopString(r.Context(), "magic_link_token"), models.ScopeMagicLink)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	// Step 2. Blocked users can not sign in, the same as with a password
+	user, err := m.DB.GetUserByID(r.Context(), token.UserID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	if user.Blocked {
+		m.App.Session.Put(r.Context(), "error", "Your account has been blocked")
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	// Step 3. Log in the user, unless a two-factor code is required first
+	m.completeSignIn(w, r, user.ID, false, "magic-link")
+}
+
+/*******************************************************************
+                   MAGIC LINK HELPERS
+********************************************************************/
+
+// sendMagicLink issues a sign-in token and queues email with the link to it. Only the newest link sent to
+// the user is valid.
+func (m *Repository) sendMagicLink(ctx context.Context, user models.User) error {
+	err := m.DB.RevokeTokens(ctx, user.Email, models.ScopeMagicLink)
+	if err != nil {
+		return err
+	}
+
+	token, err := models.GenerateToken(user.ID, user.Email, magicLinkTTL, models.ScopeMagicLink)
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertToken(ctx, *token)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		Link string
+	}
+	data.Link = fmt.Sprintf("%s/auth/magic-link?token=%s", m.App.FrontEnd, token.PlainText)
+	msg := models.MailData{
+		To:           user.Email,
+		From:         m.App.MailFrom,
+		Subject:      "Your sign-in link",
+		TemplateName: "magic-link",
+		Data:         data,
+	}
+
+	_, err = m.DB.EnqueueMail(ctx, msg)
+	return err
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cepa995/go-web-template/internal/ratelimit"
+)
+
+// requestMagicLink posts email to SendMagicLink through its rate limits and returns the flash message
+func requestMagicLink(email string) (*httptest.ResponseRecorder, string) {
+	req, _ := http.NewRequest("POST", "/auth/magic-link", strings.NewReader(url.Values{"email": {email}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	handler := Repo.RateLimit(MagicLinkLimit)(Repo.RateLimit(MagicLinkEmailLimit)(http.HandlerFunc(Repo.SendMagicLink)))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr, session.GetString(ctx, "flash") + session.GetString(ctx, "error")
+}
+
+// openMagicLink opens the link with token in a new session and returns the session
+func openMagicLink(t *testing.T, token string, expectedStatus int) context.Context {
+	req, _ := http.NewRequest("GET", "/auth/magic-link?token="+token, nil)
+	ctx := getCtx(req)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowMagicLink).ServeHTTP(rr, req.WithContext(ctx))
+	if rr.Code != expectedStatus {
+		t.Fatalf("expected %d when opening the link, got %d", expectedStatus, rr.Code)
+	}
+	return ctx
+}
+
+// magicLinkSignIn submits the sign in button of the link opened in session ctx
+func magicLinkSignIn(ctx context.Context) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/auth/magic-link/signin", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.MagicLinkSignIn).ServeHTTP(rr, req.WithContext(ctx))
+	return rr
+}
+
+func TestMagicLink(t *testing.T) {
+	app.RateLimiter = ratelimit.NewMemoryStore(0)
+	testMailer.Reset()
+	user := insertUser(t, "magic@example.com")
+
+	// Unknown emails get the same answer, but no email
+	_, unknown := requestMagicLink("nobody@example.com")
+	if len(testMailer.Messages()) != 0 {
+		t.Error("expected no email for unknown address")
+	}
+
+	_, known := requestMagicLink("magic@example.com")
+	if strings.Replace(unknown, "nobody@example.com", "magic@example.com", 1) != known {
+		t.Errorf("expected the same message for known and unknown emails, got %q and %q", known, unknown)
+	}
+	token := tokenFromLink(t)
+
+	// Opening the link, e.g. by a mail scanner, does not use it up
+	openMagicLink(t, token, http.StatusOK)
+	ctx := openMagicLink(t, token, http.StatusOK)
+
+	rr := magicLinkSignIn(ctx)
+	if rr.Header().Get("Location") != "/" || session.GetInt64(ctx, "user_id") != user.ID {
+		t.Errorf("expected user %d to be signed in, got %s (%s)", user.ID, rr.Header().Get("Location"), session.GetString(ctx, "error"))
+	}
+
+	// The link works only once
+	openMagicLink(t, token, http.StatusSeeOther)
+	if rr = magicLinkSignIn(ctx); rr.Header().Get("Location") != "/auth" {
+		t.Errorf("expected used link to be rejected, got %s", rr.Header().Get("Location"))
+	}
+
+	// Only the newest link is valid
+	requestMagicLink("magic@example.com")
+	older := tokenFromLink(t)
+	requestMagicLink("magic@example.com")
+	openMagicLink(t, older, http.StatusSeeOther)
+
+	// The email limit applies to requesting links
+	if rr, message := requestMagicLink("magic@example.com"); rr.Code != http.StatusSeeOther || !strings.Contains(message, "Too many requests") {
+		t.Errorf("expected too many requests, got %d %q", rr.Code, message)
+	}
+}
+
+func TestMagicLink_BlockedAndTwoFactor(t *testing.T) {
+	app.RateLimiter = ratelimit.NewMemoryStore(0)
+	testMailer.Reset()
+
+	blocked := insertUser(t, "magic-blocked@example.com")
+	requestMagicLink(blocked.Email)
+	ctx := openMagicLink(t, tokenFromLink(t), http.StatusOK)
+
+	// Blocked after the link was sent
+	blocked.Blocked = true
+	Repo.DB.UpdateUser(context.Background(), blocked)
+	if rr := magicLinkSignIn(ctx); rr.Header().Get("Location") != "/auth" || session.GetInt64(ctx, "user_id") != 0 {
+		t.Errorf("expected blocked user not to be signed in, got %s", rr.Header().Get("Location"))
+	}
+
+	// Blocked users are not sent links at all
+	testMailer.Reset()
+	requestMagicLink(blocked.Email)
+	if len(testMailer.Messages()) != 0 {
+		t.Error("expected no email for blocked user")
+	}
+
+	user := insertUser(t, "magic-2fa@example.com")
+	Repo.DB.SetTwoFactorSecret(context.Background(), user.ID, "secret")
+	Repo.DB.EnableTwoFactor(context.Background(), user.ID, nil)
+	requestMagicLink(user.Email)
+	ctx = openMagicLink(t, tokenFromLink(t), http.StatusOK)
+	if rr := magicLinkSignIn(ctx); rr.Header().Get("Location") != "/auth/two-factor" || session.GetInt64(ctx, "user_id") != 0 {
+		t.Errorf("expected two-factor challenge, got %s", rr.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/cepa995/go-web-template/internal/helpers"
+)
+
+// LoadPermissions looks up permissions of the signed in user and stores them in the request context,
+// where helpers.HasPermission and templates can see them. Permissions are read on every request, so
+// role changes take effect immediately.
+func (m *Repository) LoadPermissions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := m.App.Session.Get(r.Context(), "user_id").(int64)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		permissions, err := m.DB.GetPermissionsForUser(r.Context(), userID)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(helpers.WithPermissions(r.Context(), permissions)))
+	})
+}
+
+// RequireAuth allows only signed in users.
+func (m *Repository) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.App.Session.Exists(r.Context(), "user_id") {
+			m.App.Session.Put(r.Context(), "error", "Sign in first!")
+			http.Redirect(w, r, "/auth", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission allows only signed in users who have been granted permission. It must be used
+// after LoadPermissions, e.g. mux.With(Repo.RequirePermission("users:write")).
+func (m *Repository) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !m.App.Session.Exists(r.Context(), "user_id") {
+				m.App.Session.Put(r.Context(), "error", "Sign in first!")
+				http.Redirect(w, r, "/auth", http.StatusSeeOther)
+				return
+			}
+
+			if !helpers.HasPermission(r, permission) {
+				m.App.Session.Put(r.Context(), "error", "Requires authorized access!")
+				http.Redirect(w, r, "/unauthorized_access", http.StatusSeeOther)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
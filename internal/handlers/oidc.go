@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/oidc"
+	"github.com/go-chi/chi"
+)
+
+// oidcLoginTTL is how long the user has for signing in at the identity provider
+const oidcLoginTTL = 10 * time.Minute
+
+// Errors returned by oidcUser
+var (
+	errUnverifiedEmail = errors.New("identity provider did not report a verified email address")
+	errIdentityTaken   = errors.New("identity is linked to another account")
+)
+
+/*******************************************************************
+                   OPENID CONNECT HANDLERS
+********************************************************************/
+
+// OIDCSignIn handler - redirects to the sign in page of an OpenID Connect provider. Signed in users are
+// redirected as well, their account is linked to the identity once they come back.
+func (m *Repository) OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	provider, ok := m.oidcProvider(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Step 1. Generate values which tie the callback to this browser session
+	state, err := oidc.RandomString()
+	if err != nil {
+		m.oidcFailed(w, r, provider, err)
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		m.oidcFailed(w, r, provider, err)
+		return
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		m.oidcFailed(w, r, provider, err)
+		return
+	}
+
+	// Step 2. Redirect to the provider
+	authURL, err := provider.AuthCodeURL(r.Context(), m.oidcRedirectURL(r, provider), state, nonce, verifier)
+	if err != nil {
+		m.oidcFailed(w, r, provider, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "oidc_provider", provider.Name)
+	m.App.Session.Put(r.Context(), "oidc_state", state)
+	m.App.Session.Put(r.Context(), "oidc_nonce", nonce)
+	m.App.Session.Put(r.Context(), "oidc_verifier", verifier)
+	m.App.Session.Put(r.Context(), "oidc_expires", time.Now().Add(oidcLoginTTL).Unix())
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback handler - handles the redirect back from an OpenID Connect provider. The identity is
+// linked to the signed in user, or the user linked to it is signed in. Unknown identities with a verified
+// email are linked to the account with that email, or a new account is created for them.
+func (m *Repository) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := m.oidcProvider(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Step 1. Make sure the callback belongs to the sign in started in this session; values are removed,
+	// so a callback can be handled only once
+	ctx := r.Context()
+	name := m.App.Session.PopString(ctx, "oidc_provider")
+	state := m.App.Session.PopString(ctx, "oidc_state")
+	nonce := m.App.Session.PopString(ctx, "oidc_nonce")
+	verifier := m.App.Session.PopString(ctx, "oidc_verifier")
+	expires := m.App.Session.GetInt64(ctx, "oidc_expires")
+	m.App.Session.Remove(ctx, "oidc_expires")
+
+	if r.URL.Query().Get("error") != "" {
+		m.App.Session.Put(ctx, "error", fmt.Sprintf("Sign in with %s was cancelled", provider.Label))
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	if name != provider.Name || state == "" || time.Now().Unix() > expires ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(r.URL.Query().Get("state"))) != 1 {
+		m.App.Session.Put(ctx, "error", fmt.Sprintf("Sign in with %s has expired, please try again", provider.Label))
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	// Step 2. Exchange the code for a verified ID token
+	claims, err := provider.Exchange(ctx, m.oidcRedirectURL(r, provider), r.URL.Query().Get("code"), verifier, nonce)
+	if err != nil {
+		m.oidcFailed(w, r, provider, err)
+		return
+	}
+
+	// Step 3. Signed in users link the identity to their account
+	if userID := m.currentUserID(r); userID != 0 {
+		err = m.linkIdentity(r.Context(), userID, provider, claims)
+		switch {
+		case errors.Is(err, errIdentityTaken):
+			m.App.Session.Put(ctx, "error", fmt.Sprintf("This %s account is already linked to another user", provider.Label))
+		case err != nil:
+			m.oidcFailed(w, r, provider, err)
+			return
+		default:
+			m.App.Session.Put(ctx, "flash", fmt.Sprintf("Your %s account has been linked", provider.Label))
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// Step 4. Find, link or create the user
+	user, err := m.oidcUser(r.Context(), provider, claims)
+	if errors.Is(err, errUnverifiedEmail) {
+		m.App.Session.Put(ctx, "error", fmt.Sprintf("Your %s account has no verified email address", provider.Label))
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.oidcFailed(w, r, provider, err)
+		return
+	}
+	if user.Blocked {
+		m.App.Session.Put(ctx, "error", "Your account has been blocked")
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	// Step 5. Sign the user in; two-factor authentication still applies
+	m.completeSignIn(w, r, user.ID, false, "oidc:"+provider.Name)
+}
+
+/*******************************************************************
+                   OPENID CONNECT HELPERS
+********************************************************************/
+
+// oidcProvider returns the provider named in the URL
+func (m *Repository) oidcProvider(r *http.Request) (*oidc.Provider, bool) {
+	name := chi.URLParam(r, "provider")
+	for _, provider := range m.App.OIDC {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+	return nil, false
+}
+
+// oidcRedirectURL returns the callback URL of provider. Unless it is configured, it is built from
+// FrontEnd like links sent via email, or from the request when FrontEnd is not set.
+func (m *Repository) oidcRedirectURL(r *http.Request, provider *oidc.Provider) string {
+	if provider.RedirectURL != "" {
+		return provider.RedirectURL
+	}
+
+	base := strings.TrimSuffix(m.App.FrontEnd, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil || m.App.InProduction {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return fmt.Sprintf("%s/auth/oidc/%s/callback", base, provider.Name)
+}
+
+// oidcFailed logs err and tells the user that sign in with provider failed
+func (m *Repository) oidcFailed(w http.ResponseWriter, r *http.Request, provider *oidc.Provider, err error) {
+	m.logger(r).Error("sign in with OpenID Connect failed", "provider", provider.Name, "err", err)
+	m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Sign in with %s failed, please try again", provider.Label))
+	http.Redirect(w, r, "/auth", http.StatusSeeOther)
+}
+
+// oidcUser returns user linked to the identity in claims. Identities which are not linked yet are linked to
+// the user with the same email, or to a new user, but only if the provider verified the email.
+func (m *Repository) oidcUser(ctx context.Context, provider *oidc.Provider, claims oidc.Claims) (models.User, error) {
+	user, err := m.DB.GetUserByIdentity(ctx, provider.Name, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return user, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return user, errUnverifiedEmail
+	}
+
+	user, err = m.DB.GetUserByEmail(ctx, claims.Email)
+	if err != nil {
+		// The new user has no password; one can be set on the account page or with the forgot password link
+		user, err = m.provisionUser(ctx, claims)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	return user, m.linkIdentity(ctx, user.ID, provider, claims)
+}
+
+// provisionUser creates user for a new identity. The user has no password until one is set on the account
+// page or with a reset link.
+func (m *Repository) provisionUser(ctx context.Context, claims oidc.Claims) (models.User, error) {
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" && lastName == "" {
+		firstName, lastName = splitName(claims.Name)
+	}
+
+	user := models.User{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     claims.Email,
+	}
+	id, err := m.DB.InsertUser(ctx, user)
+	user.ID = id
+	return user, err
+}
+
+// linkIdentity links the identity in claims to the user. Linking an identity which is already linked to
+// the same user is not an error.
+func (m *Repository) linkIdentity(ctx context.Context, userID int64, provider *oidc.Provider, claims oidc.Claims) error {
+	linked, err := m.DB.GetUserByIdentity(ctx, provider.Name, claims.Subject)
+	if err == nil {
+		if linked.ID != userID {
+			return errIdentityTaken
+		}
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	return m.DB.InsertIdentity(ctx, models.Identity{
+		UserID:   userID,
+		Provider: provider.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	})
+}
+
+// splitName splits full name into first and last name
+func splitName(name string) (string, string) {
+	fields := strings.Fields(name)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	return fields[0], strings.Join(fields[1:], " ")
+}
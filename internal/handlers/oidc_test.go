@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/oidc"
+	"github.com/cepa995/go-web-template/internal/oidc/oidctest"
+	"github.com/go-chi/chi"
+)
+
+// startIdentityProvider starts stub identity provider configured as provider "test"
+func startIdentityProvider(t *testing.T) *oidctest.Server {
+	idp := oidctest.NewServer()
+	app.OIDC = []*oidc.Provider{oidc.NewProvider(idp.Config("test"), nil)}
+	t.Cleanup(func() {
+		app.OIDC = nil
+		idp.Close()
+	})
+	return idp
+}
+
+// insertUser creates user with the specified email which is deleted when the test finishes
+func insertUser(t *testing.T, email string) models.User {
+	id, err := Repo.DB.InsertUser(context.Background(), models.User{FirstName: "Test", LastName: "User", Email: email, Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Repo.DB.DeleteUser(context.Background(), id) })
+
+	user, _ := Repo.DB.GetUserByID(context.Background(), id)
+	return user
+}
+
+// oidcRequest calls handler with the provider URL parameter set to provider within session ctx
+func oidcRequest(ctx context.Context, handler http.HandlerFunc, provider, target string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", target, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("provider", provider)
+	req = req.WithContext(context.WithValue(ctx, chi.RouteCtxKey, rctx))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// oidcAuthorize starts sign in with the stub provider within session ctx, signs in identity there and
+// returns URL of the callback the provider redirected back to
+func oidcAuthorize(t *testing.T, idp *oidctest.Server, ctx context.Context, identity oidctest.Identity) string {
+	idp.Identity = identity
+
+	rr := oidcRequest(ctx, Repo.OIDCSignIn, "test", "http://localhost/auth/oidc/test")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected redirect to the provider, got %d", rr.Code)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	callback := resp.Header.Get("Location")
+	if u, err := url.Parse(callback); err != nil || u.Path != "/auth/oidc/test/callback" {
+		t.Fatalf("unexpected callback URL %q", callback)
+	}
+	return callback
+}
+
+// oidcSignIn signs in identity at the stub provider in a new session and handles the callback
+func oidcSignIn(t *testing.T, idp *oidctest.Server, identity oidctest.Identity) (*httptest.ResponseRecorder, context.Context) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	ctx := getCtx(req)
+	callback := oidcAuthorize(t, idp, ctx, identity)
+	return oidcRequest(ctx, Repo.OIDCCallback, "test", callback), ctx
+}
+
+func TestOIDC_Provisioning(t *testing.T) {
+	idp := startIdentityProvider(t)
+
+	req, _ := http.NewRequest("GET", "/auth", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowAuth).ServeHTTP(rr, req.WithContext(getCtx(req)))
+	if !strings.Contains(rr.Body.String(), `href='/auth/oidc/test'`) || !strings.Contains(rr.Body.String(), "Sign in with Test Provider") {
+		t.Error("expected auth page to link to the provider")
+	}
+
+	identity := oidctest.Identity{Subject: "new-1", Email: "new@example.com", EmailVerified: true, GivenName: "New", FamilyName: "User"}
+	rr, ctx := oidcSignIn(t, idp, identity)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/" {
+		t.Fatalf("expected redirect to /, got %d %s (%s)", rr.Code, rr.Header().Get("Location"), session.GetString(ctx, "error"))
+	}
+
+	user, err := Repo.DB.GetUserByEmail(context.Background(), "new@example.com")
+	if err != nil {
+		t.Fatal("expected user to be created")
+	}
+	defer Repo.DB.DeleteUser(context.Background(), user.ID)
+	if user.FirstName != "New" || user.LastName != "User" || user.Password != "" {
+		t.Errorf("unexpected user %+v", user)
+	}
+	if session.GetInt64(ctx, "user_id") != user.ID {
+		t.Errorf("expected user %d to be signed in", user.ID)
+	}
+
+	// The identity stays linked even when the email at the provider changes
+	identity.Email = "changed@example.com"
+	rr, ctx = oidcSignIn(t, idp, identity)
+	if rr.Code != http.StatusSeeOther || session.GetInt64(ctx, "user_id") != user.ID {
+		t.Errorf("expected user %d to be signed in again, got %d", user.ID, session.GetInt64(ctx, "user_id"))
+	}
+	if _, err = Repo.DB.GetUserByEmail(context.Background(), "changed@example.com"); err == nil {
+		t.Error("expected no new user for a linked identity")
+	}
+}
+
+func TestOIDC_LinkByVerifiedEmail(t *testing.T) {
+	idp := startIdentityProvider(t)
+	user := insertUser(t, "linked@example.com")
+
+	// Unverified email must not give access to the account with that email
+	rr, ctx := oidcSignIn(t, idp, oidctest.Identity{Subject: "linked-unverified", Email: "linked@example.com"})
+	if rr.Header().Get("Location") != "/auth" || session.GetInt64(ctx, "user_id") != 0 || session.GetString(ctx, "error") == "" {
+		t.Errorf("expected unverified email to be rejected, got %s", rr.Header().Get("Location"))
+	}
+	if identities, _ := Repo.DB.GetIdentitiesForUser(context.Background(), user.ID); len(identities) != 0 {
+		t.Errorf("expected no identity to be linked, got %+v", identities)
+	}
+
+	rr, ctx = oidcSignIn(t, idp, oidctest.Identity{Subject: "linked-verified", Email: "linked@example.com", EmailVerified: true})
+	if rr.Header().Get("Location") != "/" || session.GetInt64(ctx, "user_id") != user.ID {
+		t.Errorf("expected user %d to be signed in, got %s (%s)", user.ID, rr.Header().Get("Location"), session.GetString(ctx, "error"))
+	}
+	identities, _ := Repo.DB.GetIdentitiesForUser(context.Background(), user.ID)
+	if len(identities) != 1 || identities[0].Subject != "linked-verified" || identities[0].Provider != "test" {
+		t.Errorf("expected identity to be linked, got %+v", identities)
+	}
+}
+
+func TestOIDC_LinkSignedInUser(t *testing.T) {
+	idp := startIdentityProvider(t)
+	owner := insertUser(t, "owner@example.com")
+	other := insertUser(t, "other@example.com")
+	identity := oidctest.Identity{Subject: "owner-work", Email: "owner@work.example.com", EmailVerified: true}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	ctx := getCtx(req)
+	session.Put(ctx, "user_id", owner.ID)
+	rr := oidcRequest(ctx, Repo.OIDCCallback, "test", oidcAuthorize(t, idp, ctx, identity))
+	if rr.Header().Get("Location") != "/" || session.GetString(ctx, "flash") == "" {
+		t.Errorf("expected identity to be linked, got %s (%s)", rr.Header().Get("Location"), session.GetString(ctx, "error"))
+	}
+	if user, err := Repo.DB.GetUserByIdentity(context.Background(), "test", "owner-work"); err != nil || user.ID != owner.ID {
+		t.Errorf("expected identity to be linked to user %d, got %d (%v)", owner.ID, user.ID, err)
+	}
+
+	// Another user can not take over the linked identity
+	ctx = getCtx(req)
+	session.Put(ctx, "user_id", other.ID)
+	oidcRequest(ctx, Repo.OIDCCallback, "test", oidcAuthorize(t, idp, ctx, identity))
+	if session.GetString(ctx, "error") == "" {
+		t.Error("expected linking an identity of another user to fail")
+	}
+	if user, _ := Repo.DB.GetUserByIdentity(context.Background(), "test", "owner-work"); user.ID != owner.ID {
+		t.Errorf("expected identity to stay linked to user %d, got %d", owner.ID, user.ID)
+	}
+}
+
+func TestOIDC_Callback_Rejected(t *testing.T) {
+	idp := startIdentityProvider(t)
+	insertUser(t, "rejected@example.com")
+	identity := oidctest.Identity{Subject: "rejected", Email: "rejected@example.com", EmailVerified: true}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// Callback replayed in the same session
+	ctx := getCtx(req)
+	callback := oidcAuthorize(t, idp, ctx, identity)
+	oidcRequest(ctx, Repo.OIDCCallback, "test", callback)
+	session.Remove(ctx, "user_id")
+	oidcRequest(ctx, Repo.OIDCCallback, "test", callback)
+	replayed := session.GetInt64(ctx, "user_id")
+
+	// Callback handled in another session, e.g. of a victim of login CSRF
+	other := getCtx(req)
+	oidcRequest(other, Repo.OIDCCallback, "test", oidcAuthorize(t, idp, getCtx(req), identity))
+
+	// State which does not match
+	forged := getCtx(req)
+	u, _ := url.Parse(oidcAuthorize(t, idp, forged, identity))
+	q := u.Query()
+	q.Set("state", "forged")
+	u.RawQuery = q.Encode()
+	oidcRequest(forged, Repo.OIDCCallback, "test", u.String())
+
+	// ID token with a wrong nonce
+	idp.Modify = func(claims map[string]interface{}) { claims["nonce"] = "other" }
+	_, badNonce := oidcSignIn(t, idp, identity)
+	idp.Modify = nil
+
+	tests := []struct {
+		name   string
+		userID int64
+	}{
+		{"replayed", replayed},
+		{"other session", session.GetInt64(other, "user_id")},
+		{"forged state", session.GetInt64(forged, "user_id")},
+		{"wrong nonce", session.GetInt64(badNonce, "user_id")},
+	}
+	for _, e := range tests {
+		if e.userID != 0 {
+			t.Errorf("for %s expected nobody to be signed in, got user %d", e.name, e.userID)
+		}
+	}
+
+	if rr := oidcRequest(getCtx(req), Repo.OIDCSignIn, "unknown", "/auth/oidc/unknown"); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown provider: expected %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestOIDC_BlockedAndTwoFactor(t *testing.T) {
+	idp := startIdentityProvider(t)
+
+	blocked := insertUser(t, "blocked@example.com")
+	blocked.Blocked = true
+	Repo.DB.UpdateUser(context.Background(), blocked)
+	rr, ctx := oidcSignIn(t, idp, oidctest.Identity{Subject: "blocked", Email: "blocked@example.com", EmailVerified: true})
+	if rr.Header().Get("Location") != "/auth" || session.GetInt64(ctx, "user_id") != 0 {
+		t.Errorf("expected blocked user not to be signed in, got %s", rr.Header().Get("Location"))
+	}
+
+	user := insertUser(t, "two-factor@example.com")
+	Repo.DB.SetTwoFactorSecret(context.Background(), user.ID, "secret")
+	Repo.DB.EnableTwoFactor(context.Background(), user.ID, nil)
+	rr, ctx = oidcSignIn(t, idp, oidctest.Identity{Subject: "two-factor", Email: "two-factor@example.com", EmailVerified: true})
+	if rr.Header().Get("Location") != "/auth/two-factor" || session.GetInt64(ctx, "user_id") != 0 {
+		t.Errorf("expected two-factor challenge, got %s", rr.Header().Get("Location"))
+	}
+	if userID, ok := Repo.twoFactorChallenge(httptest.NewRequest("GET", "/", nil).WithContext(ctx)); !ok || userID != user.ID {
+		t.Errorf("expected challenge for user %d, got %d", user.ID, userID)
+	}
+}
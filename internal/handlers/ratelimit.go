@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/ratelimit"
+)
+
+// Limits of endpoints which check passwords or send email. HTML and JSON versions of an endpoint share
+// the same buckets, so switching between them does not get around a limit.
+var (
+	SignInLimit              = ratelimit.Rule{Name: "signin", Limit: 20, Window: time.Minute, Key: ratelimit.ByIP}
+	SignUpLimit              = ratelimit.Rule{Name: "signup", Limit: 5, Window: time.Hour, Key: ratelimit.ByIP}
+	SignUpEmailLimit         = ratelimit.Rule{Name: "signup-email", Limit: 3, Window: time.Hour, Key: ratelimit.ByEmail}
+	ForgotPasswordLimit      = ratelimit.Rule{Name: "forgot-password", Limit: 10, Window: time.Hour, Key: ratelimit.ByIP}
+	ForgotPasswordEmailLimit = ratelimit.Rule{Name: "forgot-password-email", Limit: 3, Window: time.Hour, Key: ratelimit.ByEmail}
+	MagicLinkLimit           = ratelimit.Rule{Name: "magic-link", Limit: 10, Window: time.Hour, Key: ratelimit.ByIP}
+	MagicLinkEmailLimit      = ratelimit.Rule{Name: "magic-link-email", Limit: 3, Window: time.Hour, Key: ratelimit.ByEmail}
+	ConfirmPasswordLimit     = ratelimit.Rule{Name: "confirm-password", Limit: 20, Window: time.Hour, Key: ratelimit.ByIP}
+)
+
+// RateLimit allows requests only while they are within rule, counted in App.RateLimiter. If the limiter
+// fails the request is let through, so an outage of the store does not take sign-in down with it.
+func (m *Repository) RateLimit(rule ratelimit.Rule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, wait, err := rule.Allow(m.App.RateLimiter, r)
+			if err != nil {
+				m.logger(r).Error("rate limit failed", "rule", rule.Name, "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !allowed {
+				m.rateLimited(w, r, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimited responds to a request which is over its limit: JSON clients get 429, browsers are sent back
+// to the page they came from with an error message.
+func (m *Repository) rateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+	message := fmt.Sprintf("Too many requests, please try again in %s", humanWait(wait))
+
+	if strings.HasPrefix(r.URL.Path, "/api/") || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		apiError(w, http.StatusTooManyRequests, message)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "error", message)
+	http.Redirect(w, r, refererPath(r, "/auth"), http.StatusSeeOther)
+}
+
+// refererPath returns path of the page on this site the request came from, or fallback
+func refererPath(r *http.Request, fallback string) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil || u.Path == "" || (u.Host != "" && u.Host != r.Host) {
+		return fallback
+	}
+	return u.RequestURI()
+}
+
+// humanWait rounds wait up to whole seconds or minutes
+func humanWait(wait time.Duration) string {
+	if wait <= time.Minute {
+		return fmt.Sprintf("%s seconds", ratelimit.RetryAfter(wait))
+	}
+	return fmt.Sprintf("%d minutes", int((wait+time.Minute-1)/time.Minute))
+}
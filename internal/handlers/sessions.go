@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/ratelimit"
+	"github.com/cepa995/go-web-template/internal/render"
+	"github.com/go-chi/chi"
+)
+
+// rememberMeCookie is the name of the cookie which signs back in users who chose "remember me". Its value
+// is <selector>:<validator>; the selector finds the session, the validator proves the cookie is current.
+const rememberMeCookie = "remember_me"
+
+// sessionSeenInterval is how often last seen time, device and IP address of a session are updated
+const sessionSeenInterval = 5 * time.Minute
+
+// sessionView is a session of the signed in user shown on the sessions page
+type sessionView struct {
+	ID         int64
+	Device     string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Remembered bool
+	Current    bool
+}
+
+/*******************************************************************
+                   USER SESSION HANDLERS
+********************************************************************/
+
+// ShowSessions handler - lists browsers and devices the user is signed in on
+func (m *Repository) ShowSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := m.DB.GetUserSessionsForUser(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	current := m.App.Session.GetInt64(r.Context(), "user_session_id")
+	views := make([]sessionView, 0, len(sessions))
+	for _, s := range sessions {
+		views = append(views, sessionView{
+			ID:         s.ID,
+			Device:     describeDevice(s.UserAgent),
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			Remembered: s.RememberExpiry.After(time.Now()),
+			Current:    s.ID == current,
+		})
+	}
+
+	render.Template(w, r, "account-sessions.page.gohtml", &models.TemplateData{
+		Data: map[string]interface{}{"sessions": views},
+	})
+}
+
+// RevokeSession handler - signs out one session of the user. Revoking the current session signs the
+// user out.
+func (m *Repository) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	s, err := m.DB.GetUserSession(r.Context(), id)
+	if err != nil || s.UserID != m.currentUserID(r) {
+		m.App.Session.Put(r.Context(), "error", "Session not found")
+		http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DeleteUserSession(r.Context(), s.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{
+		Type:         models.AuditSessionRevoked,
+		TargetUserID: s.UserID,
+		Metadata:     map[string]string{"session": strconv.FormatInt(s.ID, 10), "device": describeDevice(s.UserAgent)},
+	})
+
+	if s.ID == m.App.Session.GetInt64(r.Context(), "user_session_id") {
+		m.signOut(w, r)
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Session signed out")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+// RevokeAllSessions handler - signs the user out everywhere, including this browser
+func (m *Repository) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	err := m.DB.DeleteUserSessionsForUser(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{
+		Type:         models.AuditSessionRevoked,
+		TargetUserID: m.currentUserID(r),
+		Metadata:     map[string]string{"session": "all"},
+	})
+
+	m.signOut(w, r)
+	m.App.Session.Put(r.Context(), "flash", "You have been signed out everywhere")
+	http.Redirect(w, r, "/auth", http.StatusSeeOther)
+}
+
+/*******************************************************************
+                   USER SESSION MIDDLEWARE
+********************************************************************/
+
+// LoadUserSession keeps track of the session of the signed in user and signs out sessions which have been
+// revoked. Users who are not signed in but have a remember me cookie are signed back in. It must be used
+// after the session is loaded and before LoadPermissions.
+func (m *Repository) LoadUserSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if m.App.Session.Exists(r.Context(), "user_id") {
+			err = m.touchUserSession(w, r)
+		} else if _, cookieErr := r.Cookie(rememberMeCookie); cookieErr == nil {
+			err = m.restoreRememberedSession(w, r)
+		}
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*******************************************************************
+                   USER SESSION HELPERS
+********************************************************************/
+
+// startUserSession signs in the user and records the session, so it can be listed and revoked. With
+// remember the user also gets a cookie which signs them back in once the session expires. The session
+// token must have been renewed already.
+func (m *Repository) startUserSession(w http.ResponseWriter, r *http.Request, userID int64, remember bool) error {
+	ctx := r.Context()
+	s := models.UserSession{
+		UserID:    userID,
+		Token:     m.App.Session.Token(ctx),
+		UserAgent: truncate(r.UserAgent(), 512),
+		IP:        clientIP(r),
+	}
+
+	var validator string
+	if remember && m.App.RememberMeDuration > 0 {
+		var err error
+		s.RememberSelector, err = randomCookieValue(12)
+		if err != nil {
+			return err
+		}
+		validator, s.RememberHash, err = newRememberValidator()
+		if err != nil {
+			return err
+		}
+		s.RememberExpiry = time.Now().Add(m.App.RememberMeDuration)
+	}
+
+	id, err := m.DB.InsertUserSession(r.Context(), s)
+	if err != nil {
+		return err
+	}
+
+	m.App.Session.Put(ctx, "user_id", userID)
+	m.App.Session.Put(ctx, "user_session_id", id)
+	if validator != "" {
+		m.setRememberMeCookie(w, s.RememberSelector+":"+validator, s.RememberExpiry)
+	}
+	return nil
+}
+
+// touchUserSession signs out the session if it has been revoked, otherwise it updates the token, device,
+// IP address and last seen time of the session every sessionSeenInterval
+func (m *Repository) touchUserSession(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := m.currentUserID(r)
+
+	id, ok := m.App.Session.Get(ctx, "user_session_id").(int64)
+	if !ok {
+		// Signed in before sessions were recorded
+		return m.startUserSession(w, r, userID, false)
+	}
+
+	s, err := m.DB.GetUserSession(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && s.UserID != userID) {
+		m.signOut(w, r)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token := m.App.Session.Token(ctx)
+	if s.Token == token && time.Since(s.LastSeenAt) < sessionSeenInterval {
+		return nil
+	}
+	s.Token = token
+	s.UserAgent = truncate(r.UserAgent(), 512)
+	s.IP = clientIP(r)
+	s.LastSeenAt = time.Now()
+	return m.DB.UpdateUserSession(r.Context(), s)
+}
+
+// restoreRememberedSession signs in the user whose remember me cookie is valid. The cookie is replaced with
+// a new one, so a stolen cookie stops working once the user comes back, and the other way around.
+func (m *Repository) restoreRememberedSession(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	cookie, _ := r.Cookie(rememberMeCookie)
+
+	// Step 1. Find the session by the selector; unknown and expired cookies are removed
+	parts := strings.SplitN(cookie.Value, ":", 2)
+	if len(parts) != 2 {
+		m.clearRememberMeCookie(w)
+		return nil
+	}
+	s, err := m.DB.GetUserSessionBySelector(r.Context(), parts[0])
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && time.Now().After(s.RememberExpiry)) {
+		m.clearRememberMeCookie(w)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Step 2. Check the validator. A cookie which has already been replaced is ignored rather than removed,
+	// since concurrent requests of the same browser may carry the old one.
+	hash := sha256.Sum256([]byte(parts[1]))
+	if subtle.ConstantTimeCompare(hash[:], s.RememberHash) != 1 {
+		return nil
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), s.UserID)
+	if err != nil || user.Blocked {
+		m.clearRememberMeCookie(w)
+		return m.DB.DeleteUserSession(r.Context(), s.ID)
+	}
+
+	// Step 3. Sign the user in with a new session token and a new validator
+	_ = m.App.Session.Store.Delete(s.Token)
+	_ = m.App.Session.RenewToken(ctx)
+
+	validator, validatorHash, err := newRememberValidator()
+	if err != nil {
+		return err
+	}
+	s.Token = m.App.Session.Token(ctx)
+	s.RememberHash = validatorHash
+	s.UserAgent = truncate(r.UserAgent(), 512)
+	s.IP = clientIP(r)
+	s.LastSeenAt = time.Now()
+	err = m.DB.UpdateUserSession(r.Context(), s)
+	if err != nil {
+		return err
+	}
+
+	m.App.Session.Put(ctx, "user_id", s.UserID)
+	m.App.Session.Put(ctx, "user_session_id", s.ID)
+	m.setRememberMeCookie(w, s.RememberSelector+":"+validator, s.RememberExpiry)
+	m.audit(r, models.AuditEvent{
+		Type:         models.AuditSignIn,
+		TargetUserID: s.UserID,
+		Metadata:     map[string]string{"method": "remember-me"},
+	})
+	return nil
+}
+
+// signOut ends the session in this browser and removes the remember me cookie
+func (m *Repository) signOut(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.Destroy(r.Context())
+	_ = m.App.Session.RenewToken(r.Context())
+	m.clearRememberMeCookie(w)
+}
+
+// setRememberMeCookie sets the remember me cookie to value until expiry
+func (m *Repository) setRememberMeCookie(w http.ResponseWriter, value string, expiry time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberMeCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expiry,
+		MaxAge:   int(time.Until(expiry).Seconds()),
+		HttpOnly: true,
+		Secure:   m.App.InProduction,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearRememberMeCookie removes the remember me cookie
+func (m *Repository) clearRememberMeCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberMeCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.App.InProduction,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// newRememberValidator returns a new validator of a remember me cookie and its SHA-256 hash
+func newRememberValidator() (string, []byte, error) {
+	validator, err := randomCookieValue(32)
+	if err != nil {
+		return "", nil, err
+	}
+	hash := sha256.Sum256([]byte(validator))
+	return validator, hash[:], nil
+}
+
+// randomCookieValue returns n random bytes encoded for use in a cookie
+func randomCookieValue(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// clientIP returns IP address the request came from
+func clientIP(r *http.Request) string {
+	ip, _ := ratelimit.ByIP(r)
+	return ip
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// describeDevice returns short description of the browser and operating system in userAgent, e.g.
+// "Firefox on Linux"
+func describeDevice(userAgent string) string {
+	browsers := []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	}
+	systems := []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+
+	browser := "Unknown browser"
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			return browser + " on " + s.name
+		}
+	}
+	return browser
+}
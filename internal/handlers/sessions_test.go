@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// signInWith signs in with the password of users created by insertUser in a new session, which is committed
+// to the session store like at the end of a real request
+func signInWith(t *testing.T, email, userAgent string, remember bool) (context.Context, *httptest.ResponseRecorder) {
+	req, _ := http.NewRequest("POST", "/auth/signin", nil)
+	req.Header.Set("User-Agent", userAgent)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.PostForm = url.Values{"email": {email}, "password": {"password"}}
+	if remember {
+		req.PostForm.Set("remember", "1")
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostSignIn).ServeHTTP(rr, req)
+	if rr.Header().Get("Location") != "/" {
+		t.Fatalf("expected sign in to succeed, got %s (%s)", rr.Header().Get("Location"), session.GetString(ctx, "error"))
+	}
+	if _, _, err := session.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return ctx, rr
+}
+
+// loadUserSession runs LoadUserSession for a request within session ctx carrying cookies
+func loadUserSession(ctx context.Context, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rr := httptest.NewRecorder()
+	Repo.LoadUserSession(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(rr, req.WithContext(ctx))
+	return rr
+}
+
+// rememberCookie returns the remember me cookie set in the response, if any
+func rememberCookie(rr *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == rememberMeCookie {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// newSession returns context of a new, empty session
+func newSession() context.Context {
+	req, _ := http.NewRequest("GET", "/", nil)
+	return getCtx(req)
+}
+
+func TestRememberMe(t *testing.T) {
+	user := insertUser(t, "remember@example.com")
+
+	_, rr := signInWith(t, user.Email, "", false)
+	if rememberCookie(rr) != nil {
+		t.Error("expected no remember me cookie without the checkbox")
+	}
+
+	_, rr = signInWith(t, user.Email, "", true)
+	cookie := rememberCookie(rr)
+	if cookie == nil || cookie.MaxAge <= 0 || !cookie.HttpOnly {
+		t.Fatalf("expected persistent remember me cookie, got %+v", cookie)
+	}
+
+	// The cookie signs the user back in once the session is gone and is replaced with a new one
+	ctx := newSession()
+	rr = loadUserSession(ctx, cookie)
+	if session.GetInt64(ctx, "user_id") != user.ID {
+		t.Fatalf("expected user %d to be signed back in, got %d", user.ID, session.GetInt64(ctx, "user_id"))
+	}
+	rotated := rememberCookie(rr)
+	if rotated == nil || rotated.Value == cookie.Value || strings.Split(rotated.Value, ":")[0] != strings.Split(cookie.Value, ":")[0] {
+		t.Fatalf("expected the validator to be replaced, got %+v", rotated)
+	}
+
+	// The replaced cookie no longer works
+	ctx = newSession()
+	loadUserSession(ctx, cookie)
+	if session.GetInt64(ctx, "user_id") != 0 {
+		t.Error("expected replaced cookie not to sign the user in")
+	}
+
+	// Signing out revokes the cookie
+	ctx = newSession()
+	loadUserSession(ctx, rotated)
+	req, _ := http.NewRequest("GET", "/auth/signout", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.SignOut).ServeHTTP(rr, req.WithContext(ctx))
+	if cleared := rememberCookie(rr); cleared == nil || cleared.MaxAge >= 0 {
+		t.Errorf("expected remember me cookie to be removed, got %+v", cleared)
+	}
+
+	ctx = newSession()
+	rr = loadUserSession(ctx, rotated)
+	if session.GetInt64(ctx, "user_id") != 0 {
+		t.Error("expected cookie of a signed out session not to sign the user in")
+	}
+	if cleared := rememberCookie(rr); cleared == nil || cleared.MaxAge >= 0 {
+		t.Errorf("expected unknown remember me cookie to be removed, got %+v", cleared)
+	}
+}
+
+func TestRememberMe_TwoFactor(t *testing.T) {
+	user := insertUser(t, "remember-2fa@example.com")
+	Repo.DB.SetTwoFactorSecret(context.Background(), user.ID, "secret")
+	Repo.DB.EnableTwoFactor(context.Background(), user.ID, nil)
+
+	req, _ := http.NewRequest("POST", "/auth/signin", nil)
+	ctx := getCtx(req)
+	req.PostForm = url.Values{"email": {user.Email}, "password": {"password"}, "remember": {"1"}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostSignIn).ServeHTTP(rr, req.WithContext(ctx))
+	if rr.Header().Get("Location") != "/auth/two-factor" || rememberCookie(rr) != nil {
+		t.Fatalf("expected two-factor challenge without a cookie, got %s", rr.Header().Get("Location"))
+	}
+
+	// Signing in once the code is entered issues the cookie
+	rr = httptest.NewRecorder()
+	Repo.startUserSession(rr, httptest.NewRequest("POST", "/auth/two-factor", nil).WithContext(ctx), user.ID, session.PopBool(ctx, "twofactor_remember"))
+	if rememberCookie(rr) == nil {
+		t.Error("expected remember me cookie after the two-factor challenge")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	user := insertUser(t, "sessions@example.com")
+	laptop, _ := signInWith(t, user.Email, "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", false)
+	phone, phoneResponse := signInWith(t, user.Email, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Version/17.0 Mobile/15E148 Safari/604.1", true)
+
+	req, _ := http.NewRequest("GET", "/account/sessions", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowSessions).ServeHTTP(rr, req.WithContext(laptop))
+	body := rr.Body.String()
+	if !strings.Contains(body, "Firefox on Linux") || !strings.Contains(body, "Safari on iOS") || strings.Count(body, "This browser") != 1 {
+		t.Errorf("expected both sessions to be listed, got %s", body)
+	}
+
+	// Another user can not revoke the sessions
+	other := insertUser(t, "sessions-other@example.com")
+	otherCtx, _ := signInWith(t, other.Email, "", false)
+	phoneID := session.GetInt64(phone, "user_session_id")
+	revoke := func(ctx context.Context, handler http.HandlerFunc, id int64) *httptest.ResponseRecorder {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", fmt.Sprint(id))
+		req, _ := http.NewRequest("POST", "/account/sessions", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req.WithContext(context.WithValue(ctx, chi.RouteCtxKey, rctx)))
+		return rr
+	}
+	revoke(otherCtx, Repo.RevokeSession, phoneID)
+	if _, err := Repo.DB.GetUserSession(context.Background(), phoneID); err != nil {
+		t.Error("expected session of another user not to be revoked")
+	}
+
+	// Revoking the phone signs it out and its remember me cookie stops working
+	revoke(laptop, Repo.RevokeSession, phoneID)
+	loadUserSession(phone)
+	if session.GetInt64(phone, "user_id") != 0 {
+		t.Error("expected revoked session to be signed out")
+	}
+	restored := newSession()
+	loadUserSession(restored, rememberCookie(phoneResponse))
+	if session.GetInt64(restored, "user_id") != 0 {
+		t.Error("expected remember me cookie of revoked session not to work")
+	}
+	loadUserSession(laptop)
+	if session.GetInt64(laptop, "user_id") != user.ID {
+		t.Error("expected the other session to stay signed in")
+	}
+
+	// Signing out everywhere includes this browser
+	tablet, _ := signInWith(t, user.Email, "", false)
+	rr = revoke(laptop, Repo.RevokeAllSessions, 0)
+	if rr.Header().Get("Location") != "/auth" || session.GetInt64(laptop, "user_id") != 0 {
+		t.Errorf("expected to be signed out, got %s", rr.Header().Get("Location"))
+	}
+	loadUserSession(tablet)
+	if session.GetInt64(tablet, "user_id") != 0 {
+		t.Error("expected every session to be signed out")
+	}
+	if sessions, _ := Repo.DB.GetUserSessionsForUser(context.Background(), user.ID); len(sessions) != 0 {
+		t.Errorf("expected no sessions, got %d", len(sessions))
+	}
+}
+
+func TestLoadUserSession_Touch(t *testing.T) {
+	user := insertUser(t, "touch@example.com")
+	ctx, _ := signInWith(t, user.Email, "", false)
+	id := session.GetInt64(ctx, "user_session_id")
+
+	// Last seen time is updated only every sessionSeenInterval
+	s, _ := Repo.DB.GetUserSession(context.Background(), id)
+	s.LastSeenAt = time.Now().Add(-sessionSeenInterval - time.Minute)
+	s.IP = "192.0.2.1"
+	Repo.DB.UpdateUserSession(context.Background(), s)
+
+	loadUserSession(ctx)
+	if updated, _ := Repo.DB.GetUserSession(context.Background(), id); time.Since(updated.LastSeenAt) > time.Minute || updated.IP == "192.0.2.1" {
+		t.Errorf("expected last seen time and IP address to be updated, got %+v", updated)
+	}
+
+	// Sessions signed in before they were recorded are recorded on the next request
+	ctx = newSession()
+	session.Put(ctx, "user_id", user.ID)
+	session.Commit(ctx)
+	loadUserSession(ctx)
+	if session.GetInt64(ctx, "user_id") != user.ID || session.GetInt64(ctx, "user_session_id") == 0 {
+		t.Error("expected the session to be recorded")
+	}
+}
+
+func TestDescribeDevice(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		expected  string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0", "Edge on Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", "Chrome on macOS"},
+		{"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", "Chrome on Android"},
+		{"curl/8.4.0", "Unknown browser"},
+	}
+	for _, e := range tests {
+		if got := describeDevice(e.userAgent); got != e.expected {
+			t.Errorf("for %s expected %q, but got %q", e.userAgent, e.expected, got)
+		}
+	}
+}
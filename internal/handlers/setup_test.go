@@ -3,6 +3,7 @@ package handlers
 import (
 	"fmt"
 	"html/template"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -11,8 +12,16 @@ import (
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/cepa995/go-web-template/internal/config"
+	"github.com/cepa995/go-web-template/internal/encryption"
+	"github.com/cepa995/go-web-template/internal/forms"
 	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/logging"
+	"github.com/cepa995/go-web-template/internal/mailer"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/passwords"
+	"github.com/cepa995/go-web-template/internal/ratelimit"
 	render "github.com/cepa995/go-web-template/internal/render"
+	"github.com/cepa995/go-web-template/internal/urlsigner"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
@@ -21,10 +30,15 @@ import (
 
 var app config.AppConfig
 var session *scs.SessionManager
+var testMailer = mailer.NewMemory()
 var pathToTemplates = "./../../templates"
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
 
 //template.FuncMap is map of custom functions that we can use in a particular TEMPLATE (usually functions that are not built in the templating language)
-var functions = template.FuncMap{}
+var functions = template.FuncMap{
+	"humanDate": render.HumanDate,
+	"can":       render.Can,
+}
 
 // CreateTemplateCache creates a Template Cache map[string]*tempalte.Template{} which stores all application templates in memory
 // and makes them easier to load; loading from internal memory is faster then loading from disk each time.
@@ -96,20 +110,18 @@ func StopPageCache(next http.Handler) http.Handler {
 	})
 }
 
-// IsAdmin checks if logged in user has Administrative access level for accesing particular page.
-func IsAdmin(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !helpers.CheckAuthorization(r, 3) {
-			session.Put(r.Context(), "error", "Requires authorized access!")
-			http.Redirect(w, r, "/unauthorized_access", http.StatusSeeOther)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
 func TestMain(m *testing.M) {
 	app.InProduction = false
+	app.Logger, _ = logging.New(os.Stdout, logging.FormatLogfmt, logging.LevelInfo)
+	app.Mailer = testMailer
+	app.MailFrom = "no-reply@example.com"
+	app.RateLimiter = ratelimit.NewMemoryStore(0)
+	app.Encryption, _ = encryption.NewKeyRing([]encryption.Key{{ID: "test", Secret: testEncryptionKey}}, nil)
+	app.URLSigner = urlsigner.New([]byte("test-secret"))
+	app.PasswordPolicy = forms.DefaultPasswordPolicy()
+	// Cheap parameters keep tests fast
+	app.PasswordHasher = passwords.Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	app.RememberMeDuration = 24 * time.Hour
 
 	// Step 1. Create User Session
 	session = scs.New()
@@ -123,7 +135,7 @@ func TestMain(m *testing.M) {
 	// Step 3. Create Template Cache
 	tc, err := CreateTestTemplateCache()
 	if err != nil {
-		app.ErrorLog.Fatal(fmt.Sprintf("Cannot create Template Cache due to - %v", err))
+		log.Fatal(fmt.Sprintf("Cannot create Template Cache due to - %v", err))
 	}
 	app.TemplateCache = tc
 	// We do not want to rebuild the page on every request because when rebuilding the page it will call CreateTemplateCache from render package
@@ -145,6 +157,8 @@ func getRoutes() http.Handler {
 	// We DO NOT want to use NoSurf while testing handlers - it expects CSRF token during POST requests
 	//mux.Use(NoSurf)
 	mux.Use(SessionLoad)
+	mux.Use(Repo.LoadUserSession)
+	mux.Use(Repo.LoadPermissions)
 	//mux.Use(StopPageCache)
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
@@ -158,20 +172,90 @@ func getRoutes() http.Handler {
 	mux.Handle("/assets/*", http.StripPrefix("/assets", assetsFileServer))
 
 	mux.Get("/", Repo.Home)
+	mux.Get("/unauthorized_access", Repo.Unauthorized)
+
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(Repo.RequirePermission(models.PermissionAdminAccess))
+		mux.Get("/", Repo.Admin)
+
+		mux.With(Repo.RequirePermission(models.PermissionUsersRead)).Get("/users", Repo.AdminUsers)
+		mux.With(Repo.RequirePermission(models.PermissionUsersRead)).Get("/users/{id}", Repo.AdminShowUser)
+		mux.With(Repo.RequirePermission(models.PermissionRolesWrite)).Post("/users/{id}/roles", Repo.AdminUpdateRoles)
+		mux.With(Repo.RequirePermission(models.PermissionAuditRead)).Get("/audit", Repo.AdminAudit)
+		mux.With(Repo.RequirePermission(models.PermissionAuditRead)).Get("/audit/export", Repo.AdminAuditExport)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(Repo.RequirePermission(models.PermissionUsersWrite))
+			mux.Post("/users/{id}", Repo.AdminUpdateUser)
+			mux.Post("/users/{id}/block", Repo.AdminBlockUser)
+			mux.Post("/users/{id}/unblock", Repo.AdminUnblockUser)
+			mux.Post("/users/{id}/reset-password", Repo.AdminResetPassword)
+			mux.Post("/users/{id}/reset-2fa", Repo.AdminResetTwoFactor)
+			mux.Post("/users/{id}/delete", Repo.AdminDeleteUser)
+		})
+	})
 	mux.Route("/auth", func(mux chi.Router) {
 		mux.Get("/", Repo.ShowAuth)
 
-		mux.Post("/signin", Repo.PostSignIn)
-		mux.Post("/signup", Repo.PostSignUp)
+		mux.With(Repo.RateLimit(SignInLimit)).Post("/signin", Repo.PostSignIn)
+		mux.With(Repo.RateLimit(SignUpLimit), Repo.RateLimit(SignUpEmailLimit)).Post("/signup", Repo.PostSignUp)
 		mux.Get("/signout", Repo.SignOut)
 
-		mux.Get("/activate-accoutn", Repo.ShowActivateUserAccount)
-		mux.Post("/activate-accoutn", Repo.ActivateUserAccount)
+		mux.Get("/two-factor", Repo.ShowTwoFactorChallenge)
+		mux.With(Repo.RateLimit(SignInLimit)).Post("/two-factor", Repo.PostTwoFactorChallenge)
+
+		mux.With(Repo.RateLimit(MagicLinkLimit), Repo.RateLimit(MagicLinkEmailLimit)).Post("/magic-link", Repo.SendMagicLink)
+		mux.Get("/magic-link", Repo.ShowMagicLink)
+		mux.With(Repo.RateLimit(SignInLimit)).Post("/magic-link/signin", Repo.MagicLinkSignIn)
+
+		mux.Get("/oidc/{provider}", Repo.OIDCSignIn)
+		mux.With(Repo.RateLimit(SignInLimit)).Get("/oidc/{provider}/callback", Repo.OIDCCallback)
+
+		mux.Get("/activate-account", Repo.ShowActivateUserAccount)
+		mux.Post("/activate-account", Repo.ActivateUserAccount)
 
 		mux.Get("/forgot-password", Repo.ForgotPassword)
+		mux.With(Repo.RateLimit(ForgotPasswordLimit), Repo.RateLimit(ForgotPasswordEmailLimit)).Post("/forgot-password", Repo.SendPasswordResetEmail)
 		mux.Get("/reset-password", Repo.ShowResetPassword)
 		mux.Post("/reset-password", Repo.ResetPassword)
 
+		mux.Get("/unlock-account", Repo.UnlockAccount)
+		mux.Get("/confirm-email", Repo.ConfirmEmailChange)
+		mux.Get("/delete-account", Repo.ShowDeleteAccount)
+		mux.Post("/delete-account", Repo.DeleteAccount)
+
+	})
+
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Use(Repo.RequireAuth)
+		mux.Get("/", Repo.ShowAccount)
+		mux.Post("/profile", Repo.UpdateProfile)
+		mux.With(Repo.RateLimit(ConfirmPasswordLimit)).Post("/password", Repo.ChangePassword)
+		mux.With(Repo.RateLimit(ConfirmPasswordLimit)).Post("/email", Repo.ChangeEmail)
+		mux.Get("/export", Repo.ExportAccountData)
+		mux.With(Repo.RateLimit(ConfirmPasswordLimit)).Post("/delete", Repo.RequestAccountDeletion)
+
+		mux.Get("/two-factor", Repo.ShowTwoFactor)
+		mux.Post("/two-factor/enable", Repo.EnableTwoFactor)
+		mux.With(Repo.RateLimit(ConfirmPasswordLimit)).Post("/two-factor/disable", Repo.DisableTwoFactor)
+		mux.With(Repo.RateLimit(ConfirmPasswordLimit)).Post("/two-factor/recovery-codes", Repo.RegenerateRecoveryCodes)
+
+		mux.Get("/sessions", Repo.ShowSessions)
+		mux.Post("/sessions/{id}/revoke", Repo.RevokeSession)
+		mux.Post("/sessions/revoke-all", Repo.RevokeAllSessions)
+	})
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.With(Repo.RateLimit(SignInLimit)).Post("/auth/signin", Repo.APISignIn)
+		mux.With(Repo.RateLimit(SignUpLimit), Repo.RateLimit(SignUpEmailLimit)).Post("/auth/signup", Repo.APISignUp)
+		mux.Post("/auth/activate-account", Repo.APIActivateAccount)
+		mux.With(Repo.RateLimit(ForgotPasswordLimit), Repo.RateLimit(ForgotPasswordEmailLimit)).Post("/auth/forgot-password", Repo.APIForgotPassword)
+		mux.Post("/auth/reset-password", Repo.APIResetPassword)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(Repo.APIAuthenticate)
+			mux.Post("/auth/signout", Repo.APISignOut)
+			mux.Get("/users/me", Repo.APICurrentUser)
+		})
 	})
 
 	return mux
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/forms"
+	"github.com/cepa995/go-web-template/internal/helpers"
+	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/ratelimit"
+	"github.com/cepa995/go-web-template/internal/render"
+	"github.com/cepa995/go-web-template/internal/totp"
+)
+
+// twoFactorIssuer is the name authenticator apps show next to codes of this application
+const twoFactorIssuer = "go-web-template"
+
+// twoFactorChallengeTTL is how long a user who entered the right password has for entering the code
+const twoFactorChallengeTTL = 5 * time.Minute
+
+// TwoFactorLimit limits attempts at entering a two-factor code per account, so codes can not be guessed
+// from many IP addresses at once. Key is set to the ID of the account by allowTwoFactorAttempt.
+var TwoFactorLimit = ratelimit.Rule{Name: "two-factor", Limit: 5, Window: 15 * time.Minute}
+
+/*******************************************************************
+                   TWO-FACTOR HANDLERS
+********************************************************************/
+
+// ShowTwoFactorChallenge handler - renders page for entering the code after the password was accepted
+func (m *Repository) ShowTwoFactorChallenge(w http.ResponseWriter, r *http.Request) {
+	if _, ok := m.twoFactorChallenge(r); !ok {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	render.Template(w, r, "auth-two-factor.page.gohtml", &models.TemplateData{Form: forms.New(nil)})
+}
+
+// PostTwoFactorChallenge handler - checks the TOTP or recovery code and signs the user in
+func (m *Repository) PostTwoFactorChallenge(w http.ResponseWriter, r *http.Request) {
+	userID, ok := m.twoFactorChallenge(r)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Sign in first!")
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	if !form.Valid() {
+		render.Template(w, r, "auth-two-factor.page.gohtml", &models.TemplateData{Form: form})
+		return
+	}
+
+	if allowed, wait := m.allowTwoFactorAttempt(r, userID); !allowed {
+		m.rateLimited(w, r, wait)
+		return
+	}
+
+	valid, usedRecoveryCode, err := m.verifyTwoFactorCode(r.Context(), userID, form.Get("code"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if !valid {
+		m.audit(r, models.AuditEvent{
+			Type:         models.AuditSignInFailed,
+			TargetUserID: userID,
+			Metadata:     map[string]string{"reason": "invalid two-factor code"},
+		})
+		form.Errors.Add("code", "Invalid code")
+		render.Template(w, r, "auth-two-factor.page.gohtml", &models.TemplateData{Form: form})
+		return
+	}
+
+	_ = m.App.Session.RenewToken(r.Context())
+	remember := m.App.Session.PopBool(r.Context(), "twofactor_remember")
+	method := m.App.Session.PopString(r.Context(), "twofactor_method")
+	m.App.Session.Remove(r.Context(), "twofactor_user_id")
+	m.App.Session.Remove(r.Context(), "twofactor_expires")
+	err = m.startUserSession(w, r, userID, remember)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "signed_in_at", time.Now().Unix())
+	m.audit(r, models.AuditEvent{
+		Type:         models.AuditSignIn,
+		TargetUserID: userID,
+		Metadata: map[string]string{
+			"method":       method,
+			"remember":     strconv.FormatBool(remember),
+			"recoveryCode": strconv.FormatBool(usedRecoveryCode),
+		},
+	})
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+
+	if usedRecoveryCode {
+		if remaining, err := m.DB.CountRecoveryCodes(r.Context(), userID); err == nil && remaining <= 3 {
+			m.App.Session.Put(r.Context(), "warning", fmt.Sprintf("You have %d recovery codes left, generate new ones on the two-factor authentication page", remaining))
+		}
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// ShowTwoFactor handler - renders two-factor settings of the signed in user. Users who have not enabled
+// it yet are given a new secret to add to their authenticator app.
+func (m *Repository) ShowTwoFactor(w http.ResponseWriter, r *http.Request) {
+	m.renderTwoFactor(w, r, forms.New(nil), nil)
+}
+
+// EnableTwoFactor handler - enables two-factor authentication once the user proves the authenticator app
+// generates the right codes, and shows the recovery codes
+func (m *Repository) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := m.currentUserID(r)
+
+	twoFactor, err := m.DB.GetTwoFactor(r.Context(), userID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if twoFactor.Enabled {
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	if form.Valid() {
+		valid, usedRecoveryCode, err := m.verifyTwoFactorCode(r.Context(), userID, form.Get("code"))
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		if !valid || usedRecoveryCode {
+			form.Errors.Add("code", "Invalid code, make sure the clock of your phone is correct")
+		}
+	}
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, form, nil)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.DB.EnableTwoFactor(r.Context(), userID, hashes)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{Type: models.AuditTwoFactorEnabled, TargetUserID: userID})
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication enabled")
+	m.renderTwoFactor(w, r, forms.New(nil), codes)
+}
+
+// RegenerateRecoveryCodes handler - replaces recovery codes of the signed in user after checking the password
+func (m *Repository) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	form, ok := m.confirmPassword(w, r)
+	if !ok {
+		return
+	}
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, form, nil)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.DB.ReplaceRecoveryCodes(r.Context(), m.currentUserID(r), hashes)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "New recovery codes generated, the old ones no longer work")
+	m.renderTwoFactor(w, r, forms.New(nil), codes)
+}
+
+// DisableTwoFactor handler - turns off two-factor authentication of the signed in user after checking
+// the password
+func (m *Repository) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	form, ok := m.confirmPassword(w, r)
+	if !ok {
+		return
+	}
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, form, nil)
+		return
+	}
+
+	err := m.DB.DisableTwoFactor(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.audit(r, models.AuditEvent{Type: models.AuditTwoFactorDisabled, TargetUserID: m.currentUserID(r)})
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication disabled")
+	http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+}
+
+/*******************************************************************
+                   TWO-FACTOR HELPERS
+********************************************************************/
+
+// startTwoFactorChallenge remembers that the user entered the right password (or used another sign-in
+// method) and has to enter a code, and whether the user asked to be remembered once the code is entered
+func (m *Repository) startTwoFactorChallenge(r *http.Request, userID int64, remember bool, method string) {
+	m.App.Session.Put(r.Context(), "twofactor_user_id", userID)
+	m.App.Session.Put(r.Context(), "twofactor_expires", time.Now().Add(twoFactorChallengeTTL).Unix())
+	m.App.Session.Put(r.Context(), "twofactor_remember", remember)
+	m.App.Session.Put(r.Context(), "twofactor_method", method)
+}
+
+// twoFactorChallenge returns ID of the user whose code is expected, if the challenge has not expired
+func (m *Repository) twoFactorChallenge(r *http.Request) (int64, bool) {
+	userID, ok := m.App.Session.Get(r.Context(), "twofactor_user_id").(int64)
+	if !ok {
+		return 0, false
+	}
+	if time.Now().Unix() > m.App.Session.GetInt64(r.Context(), "twofactor_expires") {
+		m.App.Session.Remove(r.Context(), "twofactor_user_id")
+		m.App.Session.Remove(r.Context(), "twofactor_expires")
+		m.App.Session.Remove(r.Context(), "twofactor_remember")
+		m.App.Session.Remove(r.Context(), "twofactor_method")
+		return 0, false
+	}
+	return userID, true
+}
+
+// allowTwoFactorAttempt counts an attempt at entering the code of the user against TwoFactorLimit. If
+// the limiter fails the attempt is allowed.
+func (m *Repository) allowTwoFactorAttempt(r *http.Request, userID int64) (bool, time.Duration) {
+	rule := TwoFactorLimit
+	rule.Key = func(*http.Request) (string, bool) {
+		return strconv.FormatInt(userID, 10), true
+	}
+
+	allowed, wait, err := rule.Allow(m.App.RateLimiter, r)
+	if err != nil {
+		m.logger(r).Error("rate limit failed", "rule", rule.Name, "err", err)
+		return true, 0
+	}
+	return allowed, wait
+}
+
+// verifyTwoFactorCode checks a TOTP code, or a recovery code if code looks like one. Both can be used
+// only once.
+func (m *Repository) verifyTwoFactorCode(ctx context.Context, userID int64, code string) (valid, usedRecoveryCode bool, err error) {
+	if totp.IsRecoveryCode(code) {
+		valid, err = m.DB.UseRecoveryCode(ctx, userID, totp.RecoveryCodeHash(code))
+		return valid, valid, err
+	}
+
+	twoFactor, err := m.DB.GetTwoFactor(ctx, userID)
+	if err != nil {
+		return false, false, err
+	}
+	if twoFactor.Secret == "" {
+		return false, false, nil
+	}
+	secret, err := m.twoFactorSecret(ctx, twoFactor)
+	if err != nil {
+		return false, false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, false, nil
+	}
+	valid, err = m.DB.UseTwoFactorStep(ctx, userID, step)
+	return valid, false, err
+}
+
+// renderTwoFactor renders two-factor settings page. recoveryCodes are shown only right after they were
+// generated.
+func (m *Repository) renderTwoFactor(w http.ResponseWriter, r *http.Request, form *forms.Form, recoveryCodes []string) {
+	userID := m.currentUserID(r)
+	user, err := m.DB.GetUserByID(r.Context(), userID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	twoFactor, err := m.DB.GetTwoFactor(r.Context(), userID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"enabled":       twoFactor.Enabled,
+		"recoveryCodes": recoveryCodes,
+		"hasPassword":   user.Password != "",
+	}
+
+	if twoFactor.Enabled {
+		remaining, err := m.DB.CountRecoveryCodes(r.Context(), userID)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		data["remaining"] = remaining
+	} else {
+		// Keep the secret of an unfinished enrollment, so reloading the page does not invalidate
+		// what the user already added to the authenticator app
+		secret := ""
+		if twoFactor.Secret != "" {
+			secret, err = m.twoFactorSecret(r.Context(), twoFactor)
+			if err != nil {
+				helpers.ServerError(w, r, err)
+				return
+			}
+		}
+		if secret == "" {
+			secret, err = totp.GenerateSecret()
+			if err != nil {
+				helpers.ServerError(w, r, err)
+				return
+			}
+			encrypted, err := m.App.Encryption.Encrypt(secret)
+			if err != nil {
+				helpers.ServerError(w, r, err)
+				return
+			}
+			err = m.DB.SetTwoFactorSecret(r.Context(), userID, encrypted)
+			if err != nil {
+				helpers.ServerError(w, r, err)
+				return
+			}
+		}
+		data["secret"] = secret
+		data["uri"] = totp.ProvisioningURI(twoFactorIssuer, user.Email, secret)
+	}
+
+	render.Template(w, r, "account-two-factor.page.gohtml", &models.TemplateData{Data: data, Form: form})
+}
+
+// confirmPassword parses a form with the "password" of the signed in user and adds an error to it if
+// the password is wrong, see checkPassword. It returns false if it already responded with an error.
+func (m *Repository) confirmPassword(w http.ResponseWriter, r *http.Request) (*forms.Form, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return nil, false
+	}
+
+	form := forms.New(r.PostForm)
+	user, err := m.DB.GetUserByID(r.Context(), m.currentUserID(r))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return nil, false
+	}
+	err = m.checkPassword(r, form, "password", user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return nil, false
+	}
+	return form, true
+}
+
+// twoFactorSecret decrypts the TOTP secret of the user. Secrets encrypted with a retired key or in the
+// old format are stored encrypted with the current key again.
+func (m *Repository) twoFactorSecret(ctx context.Context, twoFactor models.TwoFactor) (string, error) {
+	secret, err := m.App.Encryption.Decrypt(twoFactor.Secret)
+	if err != nil {
+		return "", err
+	}
+
+	if m.App.Encryption.NeedsReencryption(twoFactor.Secret) {
+		encrypted, err := m.App.Encryption.Encrypt(secret)
+		if err != nil {
+			return "", err
+		}
+		err = m.DB.UpdateTwoFactorSecret(ctx, twoFactor.UserID, encrypted)
+		if err != nil {
+			return "", err
+		}
+	}
+	return secret, nil
+}
+
+// generateRecoveryCodes creates new recovery codes together with the hashes they are stored under
+func generateRecoveryCodes() ([]string, [][]byte, error) {
+	codes, err := totp.GenerateRecoveryCodes(totp.RecoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = totp.RecoveryCodeHash(code)
+	}
+	return codes, hashes, nil
+}
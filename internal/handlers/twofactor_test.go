@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/encryption"
+	"github.com/cepa995/go-web-template/internal/ratelimit"
+	"github.com/cepa995/go-web-template/internal/totp"
+)
+
+// userRequest calls handler as signed in user 1
+func userRequest(handler http.HandlerFunc, method, target string, form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, target, nil)
+	ctx := getCtx(req)
+	session.Put(ctx, "user_id", int64(1))
+	req = req.WithContext(ctx)
+	req.PostForm = form
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// challengeRequest posts code to PostTwoFactorChallenge as user 1 who has just entered the right password
+func challengeRequest(code string) (*httptest.ResponseRecorder, context.Context) {
+	req, _ := http.NewRequest("POST", "/auth/two-factor", nil)
+	ctx := getCtx(req)
+	Repo.startTwoFactorChallenge(req.WithContext(ctx), 1, false, "password")
+	req = req.WithContext(ctx)
+	req.PostForm = url.Values{"code": {code}}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostTwoFactorChallenge).ServeHTTP(rr, req)
+	return rr, ctx
+}
+
+// enrollTwoFactor enables two-factor authentication of user 1 and returns its secret and recovery codes
+func enrollTwoFactor(t *testing.T) (string, []string) {
+	// Attempts made by earlier tests must not count against TwoFactorLimit
+	app.RateLimiter = ratelimit.NewMemoryStore(0)
+
+	rr := userRequest(Repo.ShowTwoFactor, "GET", "/account/two-factor", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	twoFactor, _ := Repo.DB.GetTwoFactor(context.Background(), 1)
+	secret, err := Repo.twoFactorSecret(context.Background(), twoFactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rr.Body.String(), "otpauth://totp/") || !strings.Contains(rr.Body.String(), secret) {
+		t.Fatal("expected page to contain provisioning URI and the secret")
+	}
+
+	// Reloading the page keeps the secret of unfinished enrollment
+	userRequest(Repo.ShowTwoFactor, "GET", "/account/two-factor", nil)
+	if again, _ := Repo.DB.GetTwoFactor(context.Background(), 1); again.Secret != twoFactor.Secret {
+		t.Error("expected secret not to change when the page is reloaded")
+	}
+
+	rr = userRequest(Repo.EnableTwoFactor, "POST", "/account/two-factor/enable", url.Values{"code": {"000000"}})
+	if !strings.Contains(rr.Body.String(), "Invalid code") {
+		t.Error("expected wrong code to be rejected")
+	}
+
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	rr = userRequest(Repo.EnableTwoFactor, "POST", "/account/two-factor/enable", url.Values{"code": {code}})
+	var codes []string
+	for _, match := range regexp.MustCompile(`<li>([a-z2-7]{5}-[a-z2-7]{5})</li>`).FindAllStringSubmatch(rr.Body.String(), -1) {
+		codes = append(codes, match[1])
+	}
+	if len(codes) != totp.RecoveryCodeCount {
+		t.Fatalf("expected %d recovery codes on the page, found %d", totp.RecoveryCodeCount, len(codes))
+	}
+	if twoFactor, _ = Repo.DB.GetTwoFactor(context.Background(), 1); !twoFactor.Enabled {
+		t.Fatal("expected two-factor authentication to be enabled")
+	}
+	return secret, codes
+}
+
+func TestTwoFactor_SignIn(t *testing.T) {
+	Repo.DB.UnlockUser(context.Background(), 1)
+	defer Repo.DB.DisableTwoFactor(context.Background(), 1)
+	_, codes := enrollTwoFactor(t)
+
+	// The password alone does not sign the user in
+	rr, message := signIn("test@gmail.com", "password")
+	if message != "" || rr.Header().Get("Location") != "/auth/two-factor" {
+		t.Fatalf("expected redirect to two-factor challenge, got %q (%s)", rr.Header().Get("Location"), message)
+	}
+
+	rr, ctx := challengeRequest("123456")
+	if rr.Code != http.StatusOK || session.Exists(ctx, "user_id") {
+		t.Error("expected wrong code not to sign the user in")
+	}
+
+	rr, ctx = challengeRequest(strings.ToUpper(codes[0]))
+	if rr.Header().Get("Location") != "/" || session.GetInt64(ctx, "user_id") != 1 {
+		t.Errorf("expected recovery code to sign the user in, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	_, ctx = challengeRequest(codes[0])
+	if session.Exists(ctx, "user_id") {
+		t.Error("expected recovery code to work only once")
+	}
+}
+
+func TestTwoFactor_CodeCanBeUsedOnce(t *testing.T) {
+	defer Repo.DB.DisableTwoFactor(context.Background(), 1)
+	secret, _ := enrollTwoFactor(t)
+
+	// Enrollment used the code of the current period
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	if _, ctx := challengeRequest(code); session.Exists(ctx, "user_id") {
+		t.Error("expected code used during enrollment to be rejected")
+	}
+
+	code, _ = totp.Code(secret, totp.Step(time.Now())+1)
+	if _, ctx := challengeRequest(code); session.GetInt64(ctx, "user_id") != 1 {
+		t.Error("expected code of the next period to be accepted")
+	}
+	if _, ctx := challengeRequest(code); session.Exists(ctx, "user_id") {
+		t.Error("expected code to work only once")
+	}
+}
+
+func TestTwoFactor_AttemptsAreLimited(t *testing.T) {
+	defer Repo.DB.DisableTwoFactor(context.Background(), 1)
+	secret, _ := enrollTwoFactor(t)
+
+	for i := 0; i < TwoFactorLimit.Limit; i++ {
+		challengeRequest("000000")
+	}
+
+	code, _ := totp.Code(secret, totp.Step(time.Now())+1)
+	rr, ctx := challengeRequest(code)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Retry-After") == "" || session.Exists(ctx, "user_id") {
+		t.Errorf("expected attempt over the limit to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestTwoFactor_Challenge(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/auth/two-factor", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowTwoFactorChallenge).ServeHTTP(rr, req)
+	if rr.Header().Get("Location") != "/auth" {
+		t.Errorf("expected redirect to /auth without a pending challenge, got %s", rr.Header().Get("Location"))
+	}
+
+	// Challenge expires
+	Repo.startTwoFactorChallenge(req, 1, false, "password")
+	session.Put(ctx, "twofactor_expires", time.Now().Add(-time.Second).Unix())
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowTwoFactorChallenge).ServeHTTP(rr, req)
+	if rr.Header().Get("Location") != "/auth" {
+		t.Errorf("expected redirect to /auth after the challenge expired, got %s", rr.Header().Get("Location"))
+	}
+}
+
+func TestTwoFactor_API(t *testing.T) {
+	Repo.DB.UnlockUser(context.Background(), 1)
+	defer Repo.DB.DisableTwoFactor(context.Background(), 1)
+	secret, _ := enrollTwoFactor(t)
+
+	status, res := apiRequest(t, "POST", "/api/v1/auth/signin", "", `{"email": "test@gmail.com", "password": "password"}`)
+	if status != http.StatusUnauthorized || len(res.Errors["code"]) == 0 {
+		t.Errorf("expected %d with code error, got %d %v", http.StatusUnauthorized, status, res)
+	}
+
+	status, _ = apiRequest(t, "POST", "/api/v1/auth/signin", "", `{"email": "test@gmail.com", "password": "password", "code": "000000"}`)
+	if status != http.StatusUnauthorized {
+		t.Errorf("expected %d for wrong code, got %d", http.StatusUnauthorized, status)
+	}
+
+	code, _ := totp.Code(secret, totp.Step(time.Now())+1)
+	status, _ = apiRequest(t, "POST", "/api/v1/auth/signin", "", `{"email": "test@gmail.com", "password": "password", "code": "`+code+`"}`)
+	if status != http.StatusCreated {
+		t.Errorf("expected %d, got %d", http.StatusCreated, status)
+	}
+}
+
+func TestTwoFactor_Disable(t *testing.T) {
+	Repo.DB.UnlockUser(context.Background(), 1)
+	defer Repo.DB.DisableTwoFactor(context.Background(), 1)
+	enrollTwoFactor(t)
+
+	rr := userRequest(Repo.DisableTwoFactor, "POST", "/account/two-factor/disable", url.Values{"password": {"wrong"}})
+	if !strings.Contains(rr.Body.String(), "Incorrect password") {
+		t.Error("expected wrong password to be rejected")
+	}
+
+	rr = userRequest(Repo.DisableTwoFactor, "POST", "/account/two-factor/disable", url.Values{"password": {"password"}})
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+	if twoFactor, _ := Repo.DB.GetTwoFactor(context.Background(), 1); twoFactor.Enabled || twoFactor.Secret != "" {
+		t.Error("expected two-factor authentication to be disabled")
+	}
+}
+
+func TestAdminResetTwoFactor(t *testing.T) {
+	defer Repo.DB.DisableTwoFactor(context.Background(), 1)
+	enrollTwoFactor(t)
+
+	rr := adminRequest(Repo.AdminResetTwoFactor, "POST", "/admin/users/1/reset-2fa", "1", nil)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+	if twoFactor, _ := Repo.DB.GetTwoFactor(context.Background(), 1); twoFactor.Enabled {
+		t.Error("expected two-factor authentication to be reset")
+	}
+	if count, _ := Repo.DB.CountRecoveryCodes(context.Background(), 1); count != 0 {
+		t.Errorf("expected recovery codes to be deleted, %d left", count)
+	}
+}
+
+func TestTwoFactor_ReencryptsSecret(t *testing.T) {
+	defer func(ring *encryption.KeyRing) { app.Encryption = ring }(app.Encryption)
+	defer Repo.DB.DisableTwoFactor(context.Background(), 1)
+	secret, _ := enrollTwoFactor(t)
+
+	// Rotate the key; the secret is still readable and gets encrypted with the new key when it is used
+	retired, _ := Repo.DB.GetTwoFactor(context.Background(), 1)
+	ring, err := encryption.NewKeyRing([]encryption.Key{
+		{ID: "new", Secret: bytes.Repeat([]byte{7}, 32)},
+		{ID: "test", Secret: testEncryptionKey},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Encryption = ring
+
+	code, _ := totp.Code(secret, totp.Step(time.Now())+1)
+	if _, ctx := challengeRequest(code); session.GetInt64(ctx, "user_id") != 1 {
+		t.Fatal("expected code to be accepted after key rotation")
+	}
+
+	rotated, _ := Repo.DB.GetTwoFactor(context.Background(), 1)
+	if !strings.HasPrefix(rotated.Secret, "v1:new:") || rotated.Secret == retired.Secret || !rotated.Enabled {
+		t.Errorf("expected secret to be encrypted with the new key, got %s", rotated.Secret)
+	}
+}
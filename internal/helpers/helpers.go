@@ -1,14 +1,15 @@
 package helpers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
 	"runtime/debug"
 
 	"github.com/cepa995/go-web-template/internal/config"
+	"github.com/cepa995/go-web-template/internal/logging"
 )
 
 var app *config.AppConfig
@@ -18,28 +19,48 @@ func NewHelpers(a *config.AppConfig) {
 	app = a
 }
 
-// ClientError logs status code of an erorr which occurred on the cliend side, and reeturns http.Error with associated status text.
-func ClientError(w http.ResponseWriter, status int) {
-	app.InfoLog.Println("Client error with status of ", status)
+// ClientError logs status code of an error which occurred on the client side, and responds with the status and
+// its text.
+func ClientError(w http.ResponseWriter, r *http.Request, status int) {
+	app.Logger.FromContext(r.Context()).Info("client error", "status", status, "method", r.Method, "path", r.URL.Path)
 	http.Error(w, http.StatusText(status), status)
 }
 
-// ServerError logs stack trace of an erorr which occurred on the server side, and reeturns http.StatusInternalServerError status code
-// as well as its associated status text.
-func ServerError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	app.ErrorLog.Println(trace)
+// ServerError logs an error which occurred on the server side, and responds with http.StatusInternalServerError
+// and its text. The stack trace is logged only at debug level.
+func ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	logger := app.Logger.FromContext(r.Context())
+	if logger.Enabled(logging.LevelDebug) {
+		logger = logger.With("stack", string(debug.Stack()))
+	}
+	logger.Error("server error", "err", err, "method", r.Method, "path", r.URL.Path)
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
-// CheckAuthorization checks whether logged in user is authorized to access specific page.
-func CheckAuthorization(r *http.Request, accessLevel int64) bool {
-	if !app.Session.Exists(r.Context(), "access_level") {
-		return false
-	}
+// contextKey is the type of keys under which helpers store values in request context
+type contextKey string
+
+const permissionsContextKey = contextKey("permissions")
+
+// WithPermissions returns a copy of ctx which carries permissions of the signed in user.
+func WithPermissions(ctx context.Context, permissions []string) context.Context {
+	return context.WithValue(ctx, permissionsContextKey, permissions)
+}
 
-	userAccessLevel := app.Session.Get(r.Context(), "access_level")
-	return userAccessLevel == accessLevel
+// Permissions returns permissions stored in ctx by WithPermissions.
+func Permissions(ctx context.Context) []string {
+	permissions, _ := ctx.Value(permissionsContextKey).([]string)
+	return permissions
+}
+
+// HasPermission checks whether signed in user has been granted permission through any of its roles.
+func HasPermission(r *http.Request, permission string) bool {
+	for _, p := range Permissions(r.Context()) {
+		if p == permission {
+			return true
+		}
+	}
+	return false
 }
 
 // ReadJSON reads a single JSON value from a request body.
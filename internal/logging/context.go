@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// contextKey is the type of keys under which logging stores values in context
+type contextKey string
+
+const requestIDContextKey = contextKey("request_id")
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID returns a copy of ctx which carries the ID of the request it belongs to
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// RequestID returns request ID stored in ctx by WithRequestID, or an empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// FromContext returns logger which adds request ID stored in ctx to every entry
+func (l *Logger) FromContext(ctx context.Context) *Logger {
+	if id := RequestID(ctx); id != "" {
+		return l.With("request_id", id)
+	}
+	return l
+}
@@ -0,0 +1,246 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Levels in the order of severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Formats entries can be written in
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// Redacted replaces values of redacted fields
+const Redacted = "[REDACTED]"
+
+// redactedKeys are names of fields whose values are never written. A field is redacted if its name is one
+// of them, or ends with one of them after "_" or ".", e.g. "new_password" or "user.email".
+var redactedKeys = []string{"password", "email", "token", "secret", "authorization", "cookie"}
+
+// String returns name of the level as written in log entries
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// ParseLevel returns the level with name s (debug, info, warn or error)
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unsupported log level %s", s)
+}
+
+// Logger writes leveled entries made of a message and key/value fields, as logfmt or JSON lines.
+// Loggers returned by With share the writer of the logger they were created from.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	format string
+	level  Level
+	fields []interface{}
+	now    func() time.Time
+}
+
+// New creates a Logger writing entries of level and above to out in format (logfmt or json).
+func New(out io.Writer, format string, level Level) (*Logger, error) {
+	if format != FormatLogfmt && format != FormatJSON {
+		return nil, fmt.Errorf("unsupported log format %s", format)
+	}
+	return &Logger{mu: &sync.Mutex{}, out: out, format: format, level: level, now: time.Now}, nil
+}
+
+// Discard returns a Logger which writes nothing; handy in tests.
+func Discard() *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: io.Discard, format: FormatLogfmt, level: LevelError + 1, now: time.Now}
+}
+
+// With returns a Logger which adds the key/value pairs to every entry
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), keyvals...)
+	return &child
+}
+
+// Enabled returns true if entries of level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug writes entry with msg and key/value pairs at debug level
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.write(LevelDebug, msg, keyvals)
+}
+
+// Info writes entry with msg and key/value pairs at info level
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.write(LevelInfo, msg, keyvals)
+}
+
+// Warn writes entry with msg and key/value pairs at warn level
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.write(LevelWarn, msg, keyvals)
+}
+
+// Error writes entry with msg and key/value pairs at error level
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.write(LevelError, msg, keyvals)
+}
+
+// StdLogger returns a standard library logger which writes every line as an entry at level, for packages
+// which only accept *log.Logger (e.g. http.Server.ErrorLog).
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(writerFunc(func(p []byte) (int, error) {
+		l.write(level, strings.TrimSpace(string(p)), nil)
+		return len(p), nil
+	}), "", 0)
+}
+
+// write formats and writes a single entry
+func (l *Logger) write(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := append([]interface{}{"time", l.now(), "level", level.String(), "msg", msg}, l.fields...)
+	fields = append(fields, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	var buf bytes.Buffer
+	if l.format == FormatJSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(buf.Bytes())
+}
+
+// writeJSON writes fields as a JSON object; later fields do not replace earlier ones with the same key
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(keyString(fields[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value := fieldValue(keyString(fields[i]), fields[i+1])
+		out, err := json.Marshal(value)
+		if err != nil {
+			out, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(out)
+	}
+	buf.WriteByte('}')
+}
+
+// writeLogfmt writes fields as key=value pairs separated by spaces
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(strings.Map(func(r rune) rune {
+			if r <= ' ' || r == '=' || r == '"' {
+				return '_'
+			}
+			return r
+		}, keyString(fields[i])))
+		buf.WriteByte('=')
+
+		value := fmt.Sprint(fieldValue(keyString(fields[i]), fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+// fieldValue returns value as written for the field key: redacted, or converted to a type both formats
+// write in a readable way
+func fieldValue(key string, value interface{}) interface{} {
+	if isRedacted(key) {
+		return Redacted
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case string, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// isRedacted returns true if values of the field key must not be written
+func isRedacted(key string) bool {
+	key = strings.ToLower(key)
+	for _, redacted := range redactedKeys {
+		if key == redacted || strings.HasSuffix(key, "_"+redacted) || strings.HasSuffix(key, "."+redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyString returns key of a field as string
+func keyString(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// writerFunc turns a function into io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
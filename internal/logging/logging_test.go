@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(t *testing.T, format string, level Level) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l, err := New(&buf, format, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	return l, &buf
+}
+
+var formatTests = []struct {
+	format   string
+	expected string
+}{
+	{FormatLogfmt, `time=2024-05-01T12:00:00Z level=info msg="user signed in" request_id=abc user_id=7 took=1.5s err="connection refused" new_password=[REDACTED] email=[REDACTED]` + "\n"},
+	{FormatJSON, `{"time":"2024-05-01T12:00:00Z","level":"info","msg":"user signed in","request_id":"abc","user_id":7,"took":"1.5s","err":"connection refused","new_password":"[REDACTED]","email":"[REDACTED]"}` + "\n"},
+}
+
+func TestLogger_Formats(t *testing.T) {
+	for _, e := range formatTests {
+		l, buf := newTestLogger(t, e.format, LevelInfo)
+		l.With("request_id", "abc").Info("user signed in",
+			"user_id", 7,
+			"took", 1500*time.Millisecond,
+			"err", errors.New("connection refused"),
+			"new_password", "hunter2",
+			"email", "jon@example.com",
+		)
+		if buf.String() != e.expected {
+			t.Errorf("for %s expected\n%s, but got\n%s", e.format, e.expected, buf.String())
+		}
+	}
+}
+
+func TestLogger_Levels(t *testing.T) {
+	l, buf := newTestLogger(t, FormatJSON, LevelWarn)
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error", "odd")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected only warn and error entries, got %v", lines)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "error" || entry["odd"] != "(MISSING)" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+
+	if _, err := ParseLevel("WARN"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected unknown level to be refused")
+	}
+	if _, err := New(buf, "xml", LevelInfo); err == nil {
+		t.Error("expected unknown format to be refused")
+	}
+}
+
+func TestLogger_FromContext(t *testing.T) {
+	l, buf := newTestLogger(t, FormatLogfmt, LevelInfo)
+
+	l.FromContext(context.Background()).Info("no request")
+	l.FromContext(WithRequestID(context.Background(), "r-1")).Info("in request")
+	l.StdLogger(LevelError).Println("from standard logger")
+
+	expected := `time=2024-05-01T12:00:00Z level=info msg="no request"
+time=2024-05-01T12:00:00Z level=info msg="in request" request_id=r-1
+time=2024-05-01T12:00:00Z level=error msg="from standard logger"
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s, but got\n%s", expected, buf.String())
+	}
+	if id := NewRequestID(); len(id) != 16 || id == NewRequestID() {
+		t.Errorf("expected random request IDs, got %s", id)
+	}
+}
@@ -0,0 +1,52 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/models"
+)
+
+// File writes every message as an .eml file into Dir instead of sending it. It is meant for local
+// development, where the files can be opened with any email client.
+type File struct {
+	Dir string
+}
+
+// NewFile creates File mailer and makes sure dir exists.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &File{Dir: dir}, nil
+}
+
+// Send renders the message and writes it to a new .eml file.
+func (f *File) Send(m models.MailData) error {
+	msg, err := Render(m)
+	if err != nil {
+		return err
+	}
+
+	email, err := newEmail(msg)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(f.Dir, name), []byte(email.GetMessage()), 0644)
+}
+
+// Close does nothing, File does not hold any resources.
+func (f *File) Close() error {
+	return nil
+}
@@ -0,0 +1,90 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+
+	"github.com/cepa995/go-web-template/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+//go:embed templates
+var emailTemplateFS embed.FS
+
+// Mailer is implemented by every backend which is able to deliver an email message.
+type Mailer interface {
+	// Send renders message templates and delivers the message.
+	Send(m models.MailData) error
+	// Close releases resources held by the backend, e.g. an open SMTP connection.
+	Close() error
+}
+
+// Message is a rendered email message with both HTML and plain text versions of the body.
+type Message struct {
+	To      string
+	From    string
+	Subject string
+	HTML    string
+	Text    string
+	// RequestID is the ID of the request which sent the message, written to the X-Request-ID header
+	RequestID string
+}
+
+// Render renders HTML and plain text templates of the message specified by models.MailData.TemplateName.
+// Both templates are parsed together with the matching layout, which defines shared "header" and "footer".
+func Render(m models.MailData) (Message, error) {
+	msg := Message{
+		To:        m.To,
+		From:      m.From,
+		Subject:   m.Subject,
+		RequestID: m.RequestID,
+	}
+
+	// Step 1. Render HTML part using html/template, so data is escaped
+	h, err := htmltemplate.New("email-html").ParseFS(emailTemplateFS,
+		"templates/layout.html.gohtml",
+		fmt.Sprintf("templates/%s.html.gohtml", m.TemplateName),
+	)
+	if err != nil {
+		return msg, err
+	}
+
+	var tpl bytes.Buffer
+	if err = h.ExecuteTemplate(&tpl, "body", m.Data); err != nil {
+		return msg, err
+	}
+	msg.HTML = tpl.String()
+
+	// Step 2. Render plain text part using text/template, so links are not HTML escaped
+	t, err := texttemplate.New("email-plain").ParseFS(emailTemplateFS,
+		"templates/layout.plain.gohtml",
+		fmt.Sprintf("templates/%s.plain.gohtml", m.TemplateName),
+	)
+	if err != nil {
+		return msg, err
+	}
+
+	tpl.Reset()
+	if err = t.ExecuteTemplate(&tpl, "body", m.Data); err != nil {
+		return msg, err
+	}
+	msg.Text = tpl.String()
+
+	return msg, nil
+}
+
+// newEmail constructs go-simple-mail multipart/alternative email from a rendered message.
+func newEmail(msg Message) (*mail.Email, error) {
+	email := mail.NewMSG()
+	email.SetFrom(msg.From).AddTo(msg.To).SetSubject(msg.Subject)
+	email.SetBody(mail.TextPlain, msg.Text)
+	email.AddAlternative(mail.TextHTML, msg.HTML)
+	if msg.RequestID != "" {
+		email.AddHeader("X-Request-ID", msg.RequestID)
+	}
+
+	return email, email.GetError()
+}
@@ -0,0 +1,102 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cepa995/go-web-template/internal/models"
+)
+
+var testMessage = models.MailData{
+	To:           "test@gmail.com",
+	From:         "admin@example.com",
+	Subject:      "Password Reset Request",
+	TemplateName: "password-reset",
+	RequestID:    "3f2a9c1d",
+	Data: map[string]interface{}{
+		"Link": "http://localhost:8080/reset-password?token=abc",
+	},
+}
+
+func TestRender(t *testing.T) {
+	msg, err := Render(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(msg.HTML, "http://localhost:8080/reset-password?token=abc") {
+		t.Error("rendered message does not contain the link")
+	}
+	if !strings.Contains(msg.Text, "http://localhost:8080/reset-password?token=abc") {
+		t.Error("plain text version does not contain the link")
+	}
+	if !strings.Contains(msg.HTML, "<!DOCTYPE html>") || !strings.Contains(msg.Text, "Muscle Factory est. 2019") {
+		t.Error("layout header and footer were not rendered")
+	}
+
+	if _, err = Render(models.MailData{TemplateName: "non-existent"}); err == nil {
+		t.Error("rendered template that does not exist")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	if err := m.Send(testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := m.Messages()
+	if len(messages) != 1 || messages[0].To != "test@gmail.com" || messages[0].Subject != "Password Reset Request" {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+
+	m.Reset()
+	if len(m.Messages()) != 0 {
+		t.Error("messages were not removed")
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	f, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Send(testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one .eml file, but got %v (%v)", files, err)
+	}
+
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "Subject: Password Reset Request") {
+		t.Error(".eml file does not contain subject header")
+	}
+	if !strings.Contains(string(content), "multipart/alternative") || !strings.Contains(string(content), "text/plain") {
+		t.Error(".eml file is not a multipart/alternative message with a plain text part")
+	}
+	if !strings.Contains(string(content), "X-Request-Id: 3f2a9c1d") {
+		t.Error(".eml file does not contain request ID header")
+	}
+}
+
+func TestNewSMTP(t *testing.T) {
+	for _, encryption := range []string{EncryptionSTARTTLS, EncryptionSSL, EncryptionNone, ""} {
+		if _, err := NewSMTP("localhost", 25, "", "", encryption); err != nil {
+			t.Errorf("unexpected error for encryption %q: %v", encryption, err)
+		}
+	}
+
+	if _, err := NewSMTP("localhost", 25, "", "", "tls1.0"); err == nil {
+		t.Error("expected an error for unsupported encryption")
+	}
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"sync"
+
+	"github.com/cepa995/go-web-template/internal/models"
+)
+
+// Memory keeps rendered messages in memory instead of sending them, so tests can assert against them.
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewMemory creates an empty Memory mailer.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Send renders the message and stores it.
+func (m *Memory) Send(data models.MailData) error {
+	msg, err := Render(data)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+
+	return nil
+}
+
+// Messages returns a copy of all messages sent so far.
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := make([]Message, len(m.messages))
+	copy(messages, m.messages)
+	return messages
+}
+
+// Reset removes all stored messages.
+func (m *Memory) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
+
+// Close does nothing, Memory does not hold any resources.
+func (m *Memory) Close() error {
+	return nil
+}
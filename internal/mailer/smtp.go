@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Supported SMTP encryption settings
+const (
+	EncryptionSTARTTLS = "starttls"
+	EncryptionSSL      = "ssl"
+	EncryptionNone     = "none"
+)
+
+// SMTP sends messages through an SMTP server. The connection is kept alive and reused by
+// subsequent messages until it fails or Close is called.
+type SMTP struct {
+	server *mail.SMTPServer
+
+	mu     sync.Mutex
+	client *mail.SMTPClient
+}
+
+// NewSMTP creates SMTP mailer. Encryption is one of EncryptionSTARTTLS, EncryptionSSL or EncryptionNone.
+func NewSMTP(host string, port int, username, password, encryption string) (*SMTP, error) {
+	server := mail.NewSMTPClient()
+	server.Host = host
+	server.Port = port
+	server.Username = username
+	server.Password = password
+	server.KeepAlive = true
+	server.ConnectTimeout = 10 * time.Second
+	server.SendTimeout = 10 * time.Second
+
+	switch encryption {
+	case EncryptionSTARTTLS, "":
+		server.Encryption = mail.EncryptionSTARTTLS
+	case EncryptionSSL:
+		server.Encryption = mail.EncryptionSSLTLS
+	case EncryptionNone:
+		server.Encryption = mail.EncryptionNone
+	default:
+		return nil, fmt.Errorf("unsupported smtp encryption %s", encryption)
+	}
+
+	return &SMTP{server: server}, nil
+}
+
+// Send renders the message and sends it, reconnecting first if the kept alive connection was closed.
+func (s *SMTP) Send(m models.MailData) error {
+	msg, err := Render(m)
+	if err != nil {
+		return err
+	}
+
+	email, err := newEmail(msg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Step 1. Make sure there is a working connection to the SMTP server
+	if s.client != nil && s.client.Noop() != nil {
+		_ = s.client.Close()
+		s.client = nil
+	}
+	if s.client == nil {
+		client, err := s.server.Connect()
+		if err != nil {
+			return err
+		}
+		s.client = client
+	}
+
+	// Step 2. Send an email; a failed connection is dropped so the next message starts with a new one
+	if err = email.Send(s.client); err != nil {
+		_ = s.client.Close()
+		s.client = nil
+		return err
+	}
+
+	return nil
+}
+
+// Close closes connection to the SMTP server.
+func (s *SMTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+
+	err := s.client.Quit()
+	s.client = nil
+	return err
+}
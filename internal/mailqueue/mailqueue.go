@@ -0,0 +1,166 @@
+package mailqueue
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/logging"
+	"github.com/cepa995/go-web-template/internal/models"
+)
+
+// Store is the part of repository.DatabaseRepo which the queue needs for claiming and updating jobs.
+type Store interface {
+	ClaimMailJobs(ctx context.Context, limit int, lease time.Duration) ([]models.MailJob, error)
+	MarkMailJobSent(ctx context.Context, id int64) error
+	RetryMailJob(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error
+	DeadLetterMailJob(ctx context.Context, id int64, lastError string) error
+}
+
+// SendFunc delivers a single email message.
+type SendFunc func(m models.MailData) error
+
+// Queue is a pool of workers which send messages stored in the mail_queue table. Failed messages are
+// retried with exponential backoff until MaxAttempts is reached, after which they are dead-lettered.
+type Queue struct {
+	Store        Store
+	Send         SendFunc
+	Workers      int
+	MaxAttempts  int
+	PollInterval time.Duration
+	Lease        time.Duration
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Logger       *logging.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a Queue with default retry settings.
+func New(store Store, send SendFunc, workers, maxAttempts int, logger *logging.Logger) *Queue {
+	return &Queue{
+		Store:        store,
+		Send:         send,
+		Workers:      workers,
+		MaxAttempts:  maxAttempts,
+		PollInterval: 5 * time.Second,
+		Lease:        5 * time.Minute,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     time.Hour,
+		Logger:       logger,
+	}
+}
+
+// Start starts the workers in background.
+func (q *Queue) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+
+	for i := 0; i < q.Workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.work(ctx)
+		}()
+	}
+}
+
+// Stop stops claiming new jobs and waits until messages which are being sent right now are finished,
+// or until ctx is done.
+func (q *Queue) Stop(ctx context.Context) error {
+	if q.cancel != nil {
+		q.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work claims and processes jobs one at a time until ctx is cancelled, sleeping for PollInterval
+// whenever the queue is empty.
+func (q *Queue) work(ctx context.Context) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		processed, err := q.ProcessNext(ctx)
+		if err != nil {
+			q.Logger.Error("mail queue failed", "err", err)
+		}
+
+		if processed && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
+
+// ProcessNext claims a single due job and tries to send it. It returns false if there was nothing to send.
+// Only claiming is cancelled with ctx; once a job is claimed, the outcome of sending it is always stored,
+// so a message which was already sent is not sent again because the queue is being stopped.
+func (q *Queue) ProcessNext(ctx context.Context) (bool, error) {
+	jobs, err := q.Store.ClaimMailJobs(ctx, 1, q.Lease)
+	if err != nil {
+		return false, err
+	}
+	if len(jobs) == 0 {
+		return false, nil
+	}
+
+	job := jobs[0]
+	logger := q.Logger.With("job_id", job.ID, "request_id", job.Mail.RequestID, "email", job.Mail.To, "attempt", job.Attempts)
+	if err := q.Send(job.Mail); err != nil {
+		if job.Attempts >= q.MaxAttempts {
+			logger.Error("giving up on mail", "err", err)
+			return true, q.Store.DeadLetterMailJob(context.Background(), job.ID, err.Error())
+		}
+
+		delay := Backoff(job.Attempts, q.BaseDelay, q.MaxDelay)
+		logger.Warn("could not send mail, retrying", "retry_in", delay, "err", err)
+		return true, q.Store.RetryMailJob(context.Background(), job.ID, err.Error(), time.Now().Add(jitter(delay)))
+	}
+
+	logger.Info("sent mail")
+	return true, q.Store.MarkMailJobSent(context.Background(), job.ID)
+}
+
+// Backoff returns delay before the next attempt after attempt failed attempts: base, 2*base, 4*base... capped at max.
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// jitter adds up to 10% random delay, so messages which failed together are not all retried together.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
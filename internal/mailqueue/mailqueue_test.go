@@ -0,0 +1,202 @@
+package mailqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/logging"
+	"github.com/cepa995/go-web-template/internal/models"
+)
+
+// memoryStore is an in-memory Store which keeps jobs in a map
+type memoryStore struct {
+	mu   sync.Mutex
+	jobs map[int64]*models.MailJob
+}
+
+func newMemoryStore(jobs ...models.MailJob) *memoryStore {
+	s := &memoryStore{jobs: map[int64]*models.MailJob{}}
+	for i := range jobs {
+		job := jobs[i]
+		s.jobs[job.ID] = &job
+	}
+	return s
+}
+
+func (s *memoryStore) ClaimMailJobs(ctx context.Context, limit int, lease time.Duration) ([]models.MailJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed []models.MailJob
+	for _, job := range s.jobs {
+		if len(claimed) == limit {
+			break
+		}
+		if job.Status == models.MailStatusPending && !job.NextAttemptAt.After(time.Now()) {
+			job.Status = models.MailStatusProcessing
+			job.Attempts++
+			job.NextAttemptAt = time.Now().Add(lease)
+			claimed = append(claimed, *job)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *memoryStore) MarkMailJobSent(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id].Status = models.MailStatusSent
+	return nil
+}
+
+func (s *memoryStore) RetryMailJob(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id].Status = models.MailStatusPending
+	s.jobs[id].LastError = lastError
+	s.jobs[id].NextAttemptAt = nextAttempt
+	return nil
+}
+
+func (s *memoryStore) DeadLetterMailJob(ctx context.Context, id int64, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id].Status = models.MailStatusDead
+	s.jobs[id].LastError = lastError
+	return nil
+}
+
+func (s *memoryStore) status(id int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id].Status
+}
+
+func newTestQueue(store Store, send SendFunc) *Queue {
+	q := New(store, send, 1, 3, logging.Discard())
+	q.PollInterval = 10 * time.Millisecond
+	q.BaseDelay = 0
+	return q
+}
+
+func TestQueue_ProcessNext(t *testing.T) {
+	store := newMemoryStore(models.MailJob{ID: 1, Status: models.MailStatusPending, Mail: models.MailData{To: "test@gmail.com"}})
+
+	var sent []models.MailData
+	q := newTestQueue(store, func(m models.MailData) error {
+		sent = append(sent, m)
+		return nil
+	})
+
+	processed, err := q.ProcessNext(context.Background())
+	if err != nil || !processed {
+		t.Fatalf("expected job to be processed, got %v, %v", processed, err)
+	}
+	if len(sent) != 1 || sent[0].To != "test@gmail.com" {
+		t.Errorf("unexpected messages sent %v", sent)
+	}
+	if store.status(1) != models.MailStatusSent {
+		t.Errorf("expected status %s, but got %s", models.MailStatusSent, store.status(1))
+	}
+
+	processed, err = q.ProcessNext(context.Background())
+	if err != nil || processed {
+		t.Errorf("expected empty queue, got %v, %v", processed, err)
+	}
+}
+
+func TestQueue_ProcessNextCancelled(t *testing.T) {
+	store := newMemoryStore(models.MailJob{ID: 1, Status: models.MailStatusPending})
+	ctx, cancel := context.WithCancel(context.Background())
+	q := newTestQueue(store, func(m models.MailData) error {
+		// The queue is stopped while the message is being sent
+		cancel()
+		return nil
+	})
+
+	processed, err := q.ProcessNext(ctx)
+	if err != nil || !processed || store.status(1) != models.MailStatusSent {
+		t.Errorf("expected claimed job to be marked sent, got %v, %v, %s", processed, err, store.status(1))
+	}
+
+	store = newMemoryStore(models.MailJob{ID: 2, Status: models.MailStatusPending})
+	q.Store = store
+	processed, err = q.ProcessNext(ctx)
+	if !errors.Is(err, context.Canceled) || processed || store.status(2) != models.MailStatusPending {
+		t.Errorf("expected nothing to be claimed with cancelled context, got %v, %v, %s", processed, err, store.status(2))
+	}
+}
+
+func TestQueue_DeadLetter(t *testing.T) {
+	store := newMemoryStore(models.MailJob{ID: 1, Status: models.MailStatusPending})
+	q := newTestQueue(store, func(m models.MailData) error {
+		return errors.New("smtp relay is down")
+	})
+
+	for attempt := 1; attempt <= q.MaxAttempts; attempt++ {
+		if _, err := q.ProcessNext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		expected := models.MailStatusPending
+		if attempt == q.MaxAttempts {
+			expected = models.MailStatusDead
+		}
+		if store.status(1) != expected {
+			t.Errorf("after attempt %d expected status %s, but got %s", attempt, expected, store.status(1))
+		}
+	}
+
+	if store.jobs[1].LastError != "smtp relay is down" {
+		t.Errorf("last error was not recorded, got %q", store.jobs[1].LastError)
+	}
+}
+
+func TestQueue_StartStop(t *testing.T) {
+	store := newMemoryStore(
+		models.MailJob{ID: 1, Status: models.MailStatusPending},
+		models.MailJob{ID: 2, Status: models.MailStatusPending},
+	)
+	q := newTestQueue(store, func(m models.MailData) error {
+		return nil
+	})
+	q.Workers = 2
+	q.Start()
+
+	deadline := time.Now().Add(time.Second)
+	for store.status(1) != models.MailStatusSent || store.status(2) != models.MailStatusSent {
+		if time.Now().After(deadline) {
+			t.Fatal("workers did not send queued messages")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := q.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+var backoffTests = []struct {
+	attempt  int
+	expected time.Duration
+}{
+	{1, 30 * time.Second},
+	{2, time.Minute},
+	{3, 2 * time.Minute},
+	{10, time.Hour},
+}
+
+func TestBackoff(t *testing.T) {
+	for _, e := range backoffTests {
+		if d := Backoff(e.attempt, 30*time.Second, time.Hour); d != e.expected {
+			t.Errorf("attempt %d: expected %s, but got %s", e.attempt, e.expected, d)
+		}
+	}
+}
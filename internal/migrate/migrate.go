@@ -0,0 +1,331 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migrationFile matches names such as 000001_create_users_table.up.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// lockID is an arbitrary key used with pg_advisory_xact_lock so that two instances
+// of the application never apply migrations at the same time.
+const lockID = 7402219865
+
+// ErrNoChange is returned when there is nothing to apply or roll back.
+var ErrNoChange = errors.New("no change")
+
+// Migration holds a single versioned schema change with both of its directions.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes whether a specific migration has been applied to the database.
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies embedded migrations to the database and keeps track of them
+// in the schema_migrations table.
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// New creates a Migrator which uses migrations embedded into the binary.
+func New(db *sql.DB) (*Migrator, error) {
+	sub, err := fs.Sub(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := Load(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		DB:         db,
+		Migrations: migrations,
+	}, nil
+}
+
+// Load reads every *.up.sql / *.down.sql pair from the root of fsys and returns them
+// sorted by version. Each version must have both an up and a down file.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		parts := migrationFile.FindStringSubmatch(entry.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+
+		version, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if version < 1 {
+			return nil, fmt.Errorf("invalid migration version in %s", entry.Name())
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		} else if m.Name != parts[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %s and %s", version, m.Name, parts[2])
+		}
+
+		if parts[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Up applies every migration that has not been applied yet.
+func (m *Migrator) Up() error {
+	if len(m.Migrations) == 0 {
+		return ErrNoChange
+	}
+	return m.Goto(m.Migrations[len(m.Migrations)-1].Version)
+}
+
+// Down rolls back the most recently applied migration.
+func (m *Migrator) Down() error {
+	current, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return ErrNoChange
+	}
+
+	target := 0
+	for _, migration := range m.Migrations {
+		if migration.Version < current {
+			target = migration.Version
+		}
+	}
+
+	return m.Goto(target)
+}
+
+// Goto migrates the database up or down until the version equals target. Target 0
+// rolls back every migration.
+func (m *Migrator) Goto(target int) error {
+	if target != 0 && m.find(target) == nil {
+		return fmt.Errorf("migration %d does not exist", target)
+	}
+
+	if err := m.ensureTable(); err != nil {
+		return err
+	}
+
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	// Step 1. Roll back applied migrations newer than target, newest first
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		migration := m.Migrations[i]
+		if _, ok := applied[migration.Version]; ok && migration.Version > target {
+			if err := m.run(migration, false); err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+
+	// Step 2. Apply pending migrations up to and including target, oldest first
+	for _, migration := range m.Migrations {
+		if _, ok := applied[migration.Version]; !ok && migration.Version <= target {
+			if err := m.run(migration, true); err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+
+	if !changed {
+		return ErrNoChange
+	}
+	return nil
+}
+
+// Version returns the highest applied migration version, or 0 if none has been applied.
+func (m *Migrator) Version() (int, error) {
+	if err := m.ensureTable(); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var version int
+	err := m.DB.QueryRowContext(ctx, `select coalesce(max(version), 0) from schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Status lists every known migration together with the time it was applied.
+func (m *Migrator) Status() ([]Status, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, migration := range m.Migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, Status{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// find returns migration with specified version or nil if it does not exist.
+func (m *Migrator) find(version int) *Migration {
+	for i := range m.Migrations {
+		if m.Migrations[i].Version == version {
+			return &m.Migrations[i]
+		}
+	}
+	return nil
+}
+
+// ensureTable creates the schema_migrations tracking table if it does not exist yet.
+func (m *Migrator) ensureTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	stmt := `
+		create table if not exists schema_migrations (
+			version bigint primary key,
+			name varchar(255) not null,
+			applied_at timestamptz not null default now()
+		)
+	`
+	_, err := m.DB.ExecContext(ctx, stmt)
+	return err
+}
+
+// applied returns a map of applied migration versions to the time they were applied.
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// run executes a single migration in one direction inside a transaction, so that a
+// failing statement leaves both the schema and schema_migrations untouched.
+func (m *Migrator) run(migration Migration, up bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock($1)`, lockID); err != nil {
+		return err
+	}
+
+	script := migration.Down
+	if up {
+		script = migration.Up
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)`,
+			migration.Version, migration.Name, time.Now())
+	} else {
+		_, err = tx.ExecContext(ctx, `delete from schema_migrations where version = $1`, migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000002_second.up.sql":   {Data: []byte("create table b (id int);")},
+		"000002_second.down.sql": {Data: []byte("drop table b;")},
+		"000001_first.up.sql":    {Data: []byte("create table a (id int);")},
+		"000001_first.down.sql":  {Data: []byte("drop table a;")},
+		"README.md":              {Data: []byte("not a migration")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, but got %d", len(migrations))
+	}
+
+	if migrations[0].Version != 1 || migrations[1].Version != 2 {
+		t.Errorf("migrations are not sorted by version: %d, %d", migrations[0].Version, migrations[1].Version)
+	}
+
+	if migrations[0].Name != "first" || migrations[0].Down != "drop table a;" {
+		t.Errorf("unexpected migration %+v", migrations[0])
+	}
+}
+
+var invalidMigrationTests = []struct {
+	name string
+	fsys fstest.MapFS
+}{
+	{
+		"missing-down",
+		fstest.MapFS{
+			"000001_first.up.sql": {Data: []byte("create table a (id int);")},
+		},
+	},
+	{
+		"invalid-name",
+		fstest.MapFS{
+			"first.up.sql":   {Data: []byte("create table a (id int);")},
+			"first.down.sql": {Data: []byte("drop table a;")},
+		},
+	},
+	{
+		"conflicting-names",
+		fstest.MapFS{
+			"000001_first.up.sql":   {Data: []byte("create table a (id int);")},
+			"000001_other.down.sql": {Data: []byte("drop table a;")},
+		},
+	},
+	{
+		"zero-version",
+		fstest.MapFS{
+			"000000_first.up.sql":   {Data: []byte("create table a (id int);")},
+			"000000_first.down.sql": {Data: []byte("drop table a;")},
+		},
+	},
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	for _, e := range invalidMigrationTests {
+		if _, err := Load(e.fsys); err == nil {
+			t.Errorf("failed %s: expected an error but got none", e.name)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	m, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Migrations) == 0 {
+		t.Error("no embedded migrations found")
+	}
+
+	for i, migration := range m.Migrations {
+		if migration.Version != i+1 {
+			t.Errorf("expected migration version %d, but got %d", i+1, migration.Version)
+		}
+	}
+}
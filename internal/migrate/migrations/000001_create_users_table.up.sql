@@ -0,0 +1,13 @@
+create table if not exists users (
+    id bigserial primary key,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email varchar(255) not null,
+    password varchar(255) not null,
+    access_level integer not null default 1,
+    blocked boolean not null default false,
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now()
+);
+
+create unique index if not exists users_email_idx on users (email);
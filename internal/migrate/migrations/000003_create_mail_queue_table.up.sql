@@ -0,0 +1,16 @@
+create table if not exists mail_queue (
+    id bigserial primary key,
+    to_address varchar(255) not null,
+    from_address varchar(255) not null,
+    subject varchar(255) not null,
+    template_name varchar(255) not null,
+    data jsonb not null default '{}',
+    status varchar(20) not null default 'pending',
+    attempts integer not null default 0,
+    next_attempt_at timestamptz not null default now(),
+    last_error text not null default '',
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now()
+);
+
+create index if not exists mail_queue_status_next_attempt_at_idx on mail_queue (status, next_attempt_at);
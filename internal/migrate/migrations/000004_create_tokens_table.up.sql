@@ -0,0 +1,14 @@
+create table if not exists tokens (
+    id bigserial primary key,
+    hash bytea not null,
+    user_id bigint references users (id) on delete cascade,
+    email varchar(255) not null,
+    scope varchar(50) not null,
+    data jsonb not null default '{}',
+    expiry timestamptz not null,
+    consumed_at timestamptz,
+    created_at timestamptz not null default now()
+);
+
+create unique index if not exists tokens_hash_idx on tokens (hash);
+create index if not exists tokens_email_scope_idx on tokens (email, scope);
@@ -0,0 +1,9 @@
+alter table users add column if not exists access_level integer not null default 1;
+
+update users set access_level = 3
+    where id in (select user_id from user_roles join roles on roles.id = user_roles.role_id where roles.name = 'admin');
+
+drop table if exists user_roles;
+drop table if exists role_permissions;
+drop table if exists permissions;
+drop table if exists roles;
@@ -0,0 +1,43 @@
+create table if not exists roles (
+    id bigserial primary key,
+    name varchar(64) not null unique,
+    description varchar(255) not null default ''
+);
+
+create table if not exists permissions (
+    id bigserial primary key,
+    name varchar(64) not null unique,
+    description varchar(255) not null default ''
+);
+
+create table if not exists role_permissions (
+    role_id bigint not null references roles (id) on delete cascade,
+    permission_id bigint not null references permissions (id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists user_roles (
+    user_id bigint not null references users (id) on delete cascade,
+    role_id bigint not null references roles (id) on delete cascade,
+    primary key (user_id, role_id)
+);
+
+insert into roles (name, description) values
+    ('user', 'Regular user'),
+    ('admin', 'Administrator with access to every part of the application');
+
+insert into permissions (name, description) values
+    ('admin:access', 'Open the admin area'),
+    ('users:read', 'List and view user accounts'),
+    ('users:write', 'Edit and block user accounts'),
+    ('roles:write', 'Assign roles to users');
+
+insert into role_permissions (role_id, permission_id)
+    select roles.id, permissions.id from roles, permissions where roles.name = 'admin';
+
+-- access_level 3 used to mean administrator, everybody else is a regular user
+insert into user_roles (user_id, role_id)
+    select users.id, roles.id from users, roles
+    where roles.name = case when users.access_level >= 3 then 'admin' else 'user' end;
+
+alter table users drop column if exists access_level;
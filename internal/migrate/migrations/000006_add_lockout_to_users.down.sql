@@ -0,0 +1,2 @@
+alter table users drop column if exists locked_until;
+alter table users drop column if exists failed_logins;
@@ -0,0 +1,2 @@
+alter table users add column if not exists failed_logins integer not null default 0;
+alter table users add column if not exists locked_until timestamptz;
@@ -0,0 +1,9 @@
+create unlogged table if not exists rate_limits (
+    key varchar(512) primary key,
+    tokens double precision not null,
+    allowed boolean not null,
+    updated_at timestamptz not null default now(),
+    full_at timestamptz not null
+);
+
+create index if not exists rate_limits_full_at_idx on rate_limits (full_at);
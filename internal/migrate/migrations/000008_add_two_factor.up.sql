@@ -0,0 +1,13 @@
+alter table users add column if not exists totp_secret text;
+alter table users add column if not exists totp_enabled boolean not null default false;
+alter table users add column if not exists totp_last_step bigint not null default 0;
+
+create table if not exists recovery_codes (
+    id bigserial primary key,
+    user_id bigint not null references users (id) on delete cascade,
+    code_hash bytea not null,
+    used_at timestamptz,
+    created_at timestamptz not null default now()
+);
+
+create index if not exists recovery_codes_user_id_idx on recovery_codes (user_id);
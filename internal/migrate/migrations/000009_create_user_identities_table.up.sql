@@ -0,0 +1,10 @@
+create table if not exists user_identities (
+    id bigserial primary key,
+    user_id bigint not null references users (id) on delete cascade,
+    provider varchar(50) not null,
+    subject varchar(255) not null,
+    email varchar(255) not null default '',
+    created_at timestamptz not null default now(),
+    unique (provider, subject),
+    unique (user_id, provider)
+);
@@ -0,0 +1,16 @@
+-- Browser sessions of signed in users, so they can be listed and revoked. token is the token of the
+-- session in the sessions table; remember_* columns hold the remember me cookie of the session.
+create table if not exists user_sessions (
+    id bigserial primary key,
+    user_id bigint not null references users (id) on delete cascade,
+    token text not null unique,
+    user_agent varchar(512) not null default '',
+    ip varchar(64) not null default '',
+    remember_selector varchar(64) unique,
+    remember_hash bytea,
+    remember_expiry timestamptz,
+    created_at timestamptz not null default now(),
+    last_seen_at timestamptz not null default now()
+);
+
+create index if not exists user_sessions_user_id_idx on user_sessions (user_id);
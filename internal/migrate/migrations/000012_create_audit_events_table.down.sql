@@ -0,0 +1,3 @@
+delete from permissions where name = 'audit:read';
+
+drop table if exists audit_events;
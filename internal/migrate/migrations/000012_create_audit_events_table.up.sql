@@ -0,0 +1,24 @@
+-- Security-relevant events, such as sign-ins and changes made by admins. actor_id is the user who
+-- did it and target_user_id the account it concerns; both are kept empty once the user is removed.
+create table if not exists audit_events (
+    id bigserial primary key,
+    actor_id bigint references users (id) on delete set null,
+    target_user_id bigint references users (id) on delete set null,
+    type varchar(64) not null,
+    ip varchar(64) not null default '',
+    user_agent varchar(512) not null default '',
+    metadata jsonb not null default '{}',
+    created_at timestamptz not null default now()
+);
+
+create index if not exists audit_events_created_at_idx on audit_events (created_at);
+create index if not exists audit_events_type_idx on audit_events (type);
+create index if not exists audit_events_target_user_id_idx on audit_events (target_user_id);
+
+insert into permissions (name, description) values ('audit:read', 'View and export the audit log')
+    on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select roles.id, permissions.id from roles, permissions
+    where roles.name = 'admin' and permissions.name = 'audit:read'
+    on conflict do nothing;
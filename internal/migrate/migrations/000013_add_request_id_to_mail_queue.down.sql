@@ -0,0 +1 @@
+alter table mail_queue drop column if exists request_id;
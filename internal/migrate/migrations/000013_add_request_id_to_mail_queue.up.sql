@@ -0,0 +1 @@
+alter table mail_queue add column if not exists request_id varchar(64) not null default '';
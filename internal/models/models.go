@@ -1,25 +1,153 @@
 package models
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
 	"time"
 
 	"github.com/cepa995/go-web-template/internal/forms"
 )
 
+// Token scopes; a token issued for one scope can never be used for another
 const (
-	ScopeAuthentication = "authentication"
+	ScopeAuthentication  = "authentication"
+	ScopeActivation      = "activation"
+	ScopePasswordReset   = "password-reset"
+	ScopeUnlock          = "unlock"
+	ScopeMagicLink       = "magic-link"
+	ScopeEmailChange     = "email-change"
+	ScopeAccountDeletion = "account-deletion"
 )
 
+// Mail queue job statuses
+const (
+	MailStatusPending    = "pending"
+	MailStatusProcessing = "processing"
+	MailStatusSent       = "sent"
+	MailStatusDead       = "dead"
+)
+
+// Roles which exist out of the box; new users are given RoleUser
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Permissions which can be granted to roles
+const (
+	PermissionAdminAccess = "admin:access"
+	PermissionUsersRead   = "users:read"
+	PermissionUsersWrite  = "users:write"
+	PermissionRolesWrite  = "roles:write"
+	PermissionAuditRead   = "audit:read"
+)
+
+// Types of audit events
+const (
+	AuditSignIn               = "auth.signin"
+	AuditSignInFailed         = "auth.signin_failed"
+	AuditSignOut              = "auth.signout"
+	AuditAccountActivated     = "account.activated"
+	AuditAccountUnlocked      = "account.unlocked"
+	AuditAccountExported      = "account.exported"
+	AuditAccountDeleted       = "account.deleted"
+	AuditPasswordResetRequest = "password.reset_requested"
+	AuditPasswordReset        = "password.reset"
+	AuditPasswordChanged      = "password.changed"
+	AuditEmailChanged         = "email.changed"
+	AuditTwoFactorEnabled     = "twofactor.enabled"
+	AuditTwoFactorDisabled    = "twofactor.disabled"
+	AuditSessionRevoked       = "session.revoked"
+	AuditUserUpdated          = "admin.user_updated"
+	AuditRolesChanged         = "admin.roles_changed"
+	AuditUserBlocked          = "admin.user_blocked"
+	AuditUserUnblocked        = "admin.user_unblocked"
+	AuditPasswordResetForced  = "admin.password_reset"
+	AuditTwoFactorReset       = "admin.twofactor_reset"
+	AuditUserDeleted          = "admin.user_deleted"
+)
+
+// AuditEventTypes lists every type of audit event, in the order they are offered in the admin filter
+var AuditEventTypes = []string{
+	AuditSignIn,
+	AuditSignInFailed,
+	AuditSignOut,
+	AuditAccountActivated,
+	AuditAccountUnlocked,
+	AuditAccountExported,
+	AuditAccountDeleted,
+	AuditPasswordResetRequest,
+	AuditPasswordReset,
+	AuditPasswordChanged,
+	AuditEmailChanged,
+	AuditTwoFactorEnabled,
+	AuditTwoFactorDisabled,
+	AuditSessionRevoked,
+	AuditUserUpdated,
+	AuditRolesChanged,
+	AuditUserBlocked,
+	AuditUserUnblocked,
+	AuditPasswordResetForced,
+	AuditTwoFactorReset,
+	AuditUserDeleted,
+}
+
 // Users corresponds to users model
 type User struct {
-	ID          int64
-	FirstName   string
-	LastName    string
-	Email       string
-	Password    string
-	AccessLevel int64
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID        int64     `json:"id"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	Email     string    `json:"email"`
+	Password  string    `json:"-"`
+	Blocked   bool      `json:"blocked"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// TwoFactor holds TOTP settings of a user. Secret is encrypted; it is set as soon as the user starts
+// enrolling, but codes are required at sign-in only once Enabled is true. LastStep is the last TOTP
+// period a code was accepted for, so a code can not be used twice.
+type TwoFactor struct {
+	UserID   int64
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// Identity links a user to an account at an external OpenID Connect provider. Subject is the
+// provider's stable ID of the account; Email is the address the provider reported when it was linked.
+type Identity struct {
+	ID        int64
+	UserID    int64
+	Provider  string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+// UserSession is a browser session of a signed in user. Token is the token of the session in the session
+// store, which is deleted when the session is revoked. Sessions started with "remember me" also hold the
+// selector and the SHA-256 hash of the validator of the cookie which restores them.
+type UserSession struct {
+	ID               int64
+	UserID           int64
+	Token            string
+	UserAgent        string
+	IP               string
+	RememberSelector string
+	RememberHash     []byte
+	RememberExpiry   time.Time
+	CreatedAt        time.Time
+	LastSeenAt       time.Time
+}
+
+// Role is a named set of permissions assigned to users
+type Role struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
 }
 
 // TemplateData contains data sent from handlers to templates
@@ -35,14 +163,91 @@ type TemplateData struct {
 	Form            *forms.Form
 	IsAuthenticated int
 	API             string
-	AccessLevel     int64
+	Permissions     []string
 }
 
-// MailData holds an email message
+// MailData holds an email message. RequestID is ID of the request which sent it, for tracing it in logs.
 type MailData struct {
 	To           string
 	From         string
 	Subject      string
 	Data         interface{}
 	TemplateName string
+	RequestID    string
+}
+
+// MailJob holds an email message stored in the mail queue together with its delivery state
+type MailJob struct {
+	ID            int64
+	Mail          MailData
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// AuditEvent records a security-relevant event. ActorID is the user who caused it and TargetUserID the
+// account it concerns; either is 0 when unknown, e.g. for a failed sign-in with an unknown email.
+type AuditEvent struct {
+	ID           int64             `json:"id"`
+	ActorID      int64             `json:"actorId"`
+	TargetUserID int64             `json:"targetUserId"`
+	Type         string            `json:"type"`
+	IP           string            `json:"ip"`
+	UserAgent    string            `json:"userAgent"`
+	Metadata     map[string]string `json:"metadata"`
+	CreatedAt    time.Time         `json:"createdAt"`
+}
+
+// AuditFilter selects audit events. Zero fields do not filter; UserID matches both actor and target.
+type AuditFilter struct {
+	UserID int64
+	Type   string
+	Since  time.Time
+	Until  time.Time
+}
+
+// Token is a single-use, expiring token sent to the user (e.g. in an activation link). Only the SHA-256
+// hash of the token is stored in the database, the plain text version is known only to the user.
+type Token struct {
+	ID         int64
+	PlainText  string
+	Hash       []byte
+	UserID     int64
+	Email      string
+	Scope      string
+	Data       map[string]string
+	Expiry     time.Time
+	ConsumedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// GenerateToken creates a new random token for the specified user/email which expires after ttl.
+func GenerateToken(userID int64, email string, ttl time.Duration, scope string) (*Token, error) {
+	token := &Token{
+		UserID:    userID,
+		Email:     email,
+		Scope:     scope,
+		Data:      map[string]string{},
+		Expiry:    time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+	}
+
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, err
+	}
+
+	token.PlainText = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	token.Hash = TokenHash(token.PlainText)
+
+	return token, nil
+}
+
+// TokenHash returns the SHA-256 hash under which a plain text token is stored.
+func TokenHash(plainText string) []byte {
+	hash := sha256.Sum256([]byte(plainText))
+	return hash[:]
 }
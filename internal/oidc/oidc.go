@@ -0,0 +1,402 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidIDToken is wrapped by every error caused by an ID token which must not be trusted
+var ErrInvalidIDToken = errors.New("oidc: invalid ID token")
+
+// clockSkew is how far the clock of the identity provider may be off when checking token times
+const clockSkew = time.Minute
+
+// Config holds settings of one identity provider
+type Config struct {
+	// Name identifies the provider in URLs and in the user_identities table, e.g. "google"
+	Name string
+	// Label is shown on the sign in button, e.g. "Google"
+	Label        string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback URL registered with the provider. If empty it is derived from the
+	// request by the caller.
+	RedirectURL string
+	// Scopes requested in addition to "openid"; defaults to "email" and "profile"
+	Scopes []string
+}
+
+// Claims are the claims of a verified ID token
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	GivenName     string   `json:"given_name"`
+	FamilyName    string   `json:"family_name"`
+}
+
+// audience is the "aud" claim, which is either a single string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// discovery is the part of the provider's /.well-known/openid-configuration document we use
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Provider is an OpenID Connect client of one identity provider. Discovery document and signing keys
+// are fetched on first use and cached.
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// NewProvider creates Provider which talks to the identity provider using client.
+func NewProvider(cfg Config, client *http.Client) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"email", "profile"}
+	}
+	return &Provider{Config: cfg, client: client}
+}
+
+// AuthCodeURL returns URL of the provider's sign in page. state and nonce must be random values stored
+// in the session of the user; verifier is the PKCE code verifier which is sent again in Exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, redirectURL, state, nonce, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Exchange exchanges the authorization code for tokens and returns claims of the verified ID token.
+func (p *Provider) Exchange(ctx context.Context, redirectURL, code, verifier, nonce string) (Claims, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+	// client_secret_basic is the default method when the provider does not list any
+	basic := len(d.TokenAuthMethods) == 0
+	for _, method := range d.TokenAuthMethods {
+		if method == "client_secret_basic" {
+			basic = true
+		}
+	}
+	if !basic {
+		form.Set("client_id", p.ClientID)
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.doJSON(req, &tokens)
+	if err != nil {
+		return Claims{}, err
+	}
+	if status != http.StatusOK || tokens.Error != "" {
+		return Claims{}, fmt.Errorf("oidc: token request failed with %d: %s %s", status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return Claims{}, fmt.Errorf("%w: token response has no id_token", ErrInvalidIDToken)
+	}
+
+	return p.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// VerifyIDToken checks signature, issuer, audience, expiry and nonce of an RS256 signed ID token.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (Claims, error) {
+	var claims Claims
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: malformed token", ErrInvalidIDToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, err
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidIDToken, header.Alg)
+	}
+
+	key, err := p.getKey(ctx, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("%w: malformed signature", ErrInvalidIDToken)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return claims, fmt.Errorf("%w: bad signature", ErrInvalidIDToken)
+	}
+
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return claims, err
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != p.Issuer:
+		return claims, fmt.Errorf("%w: issued by %q", ErrInvalidIDToken, claims.Issuer)
+	case !claims.Audience.contains(p.ClientID):
+		return claims, fmt.Errorf("%w: issued for another client", ErrInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.ClientID:
+		return claims, fmt.Errorf("%w: authorized party is not this client", ErrInvalidIDToken)
+	case now.After(time.Unix(claims.Expiry, 0).Add(clockSkew)):
+		return claims, fmt.Errorf("%w: token has expired", ErrInvalidIDToken)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return claims, fmt.Errorf("%w: token issued in the future", ErrInvalidIDToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return claims, fmt.Errorf("%w: nonce does not match", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return claims, fmt.Errorf("%w: token has no subject", ErrInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// RandomString returns a random URL safe string suitable for state, nonce and PKCE verifier.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge of verifier.
+func CodeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// getDiscovery fetches the discovery document of the provider once.
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var d discovery
+	status, err := p.doJSON(req, &d)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery of %s failed with %d", p.Issuer, status)
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: discovery document of %s is for issuer %s", p.Issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: discovery document of %s is incomplete", p.Issuer)
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// getKey returns the signing key with the specified ID. Keys are fetched again when the ID is unknown,
+// so keys rotated by the provider are picked up.
+func (p *Provider) getKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := p.fetchKeys(ctx, d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidIDToken, kid)
+	}
+	return key, nil
+}
+
+// fetchKeys fetches RSA signing keys from the provider's JWKS document.
+func (p *Provider) fetchKeys(ctx context.Context, jwksURI string) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	status, err := p.doJSON(req, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: fetching keys of %s failed with %d", p.Issuer, status)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// doJSON sends req and decodes JSON response into v, returning the status code.
+func (p *Provider) doJSON(req *http.Request, v interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err = json.Unmarshal(body, v); err != nil && resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("oidc: invalid response from %s: %w", req.URL.Host, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrInvalidIDToken)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrInvalidIDToken)
+	}
+	return nil
+}
+
+// contains returns true if clientID is one of the audiences
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
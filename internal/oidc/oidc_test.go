@@ -0,0 +1,154 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/oidc"
+	"github.com/cepa995/go-web-template/internal/oidc/oidctest"
+)
+
+const redirectURL = "http://localhost/auth/oidc/test/callback"
+
+// authorize signs in at the stub provider and returns the authorization code
+func authorize(t *testing.T, p *oidc.Provider, state, nonce, verifier string) string {
+	authURL, err := p.AuthCodeURL(context.Background(), redirectURL, state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), redirectURL) {
+		t.Fatalf("unexpected redirect %q (%v)", resp.Header.Get("Location"), err)
+	}
+	if location.Query().Get("state") != state {
+		t.Fatalf("expected state %q, got %q", state, location.Query().Get("state"))
+	}
+	return location.Query().Get("code")
+}
+
+func TestProvider_Exchange(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+	idp.Identity = oidctest.Identity{Subject: "123", Email: "jon@example.com", EmailVerified: true, GivenName: "Jon"}
+
+	p := oidc.NewProvider(idp.Config("test"), nil)
+	code := authorize(t, p, "state", "nonce", "verifier")
+
+	claims, err := p.Exchange(context.Background(), redirectURL, code, "verifier", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "123" || claims.Email != "jon@example.com" || !claims.EmailVerified || claims.GivenName != "Jon" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if _, err = p.Exchange(context.Background(), redirectURL, code, "verifier", "nonce"); err == nil {
+		t.Error("expected reused authorization code to fail")
+	}
+
+	code = authorize(t, p, "state", "nonce", "verifier")
+	if _, err = p.Exchange(context.Background(), redirectURL, code, "other verifier", "nonce"); err == nil {
+		t.Error("expected wrong PKCE verifier to fail")
+	}
+}
+
+func TestProvider_VerifyIDToken(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+	p := oidc.NewProvider(idp.Config("test"), nil)
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   idp.URL,
+			"sub":   "123",
+			"aud":   oidctest.ClientID,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": "nonce",
+		}
+	}
+	with := func(key string, value interface{}) string {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return idp.Sign(claims)
+	}
+
+	token := idp.Sign(valid())
+	parts := strings.Split(token, ".")
+	// Change a character in the middle of the payload
+	i := len(parts[1]) / 2
+	flipped := "A"
+	if parts[1][i] == 'A' {
+		flipped = "B"
+	}
+	tampered := parts[0] + "." + parts[1][:i] + flipped + parts[1][i+1:] + "." + parts[2]
+
+	if _, err := p.VerifyIDToken(context.Background(), token, "nonce"); err != nil {
+		t.Fatalf("expected valid token, got %v", err)
+	}
+	if _, err := p.VerifyIDToken(context.Background(), with("aud", []string{"other", oidctest.ClientID}), "nonce"); err == nil {
+		t.Error("expected token with several audiences and no azp to fail")
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+	}{
+		{"wrong nonce", token, "other"},
+		{"wrong issuer", with("iss", "https://evil.example.com"), "nonce"},
+		{"wrong audience", with("aud", "other-client"), "nonce"},
+		{"expired", with("exp", time.Now().Add(-time.Hour).Unix()), "nonce"},
+		{"issued in the future", with("iat", time.Now().Add(time.Hour).Unix()), "nonce"},
+		{"no subject", with("sub", nil), "nonce"},
+		{"tampered payload", tampered, "nonce"},
+		{"unsigned", parts[0] + "." + parts[1] + ".", "nonce"},
+		{"malformed", "abc", "nonce"},
+	}
+
+	for _, e := range tests {
+		if _, err := p.VerifyIDToken(context.Background(), e.token, e.nonce); !errors.Is(err, oidc.ErrInvalidIDToken) {
+			t.Errorf("for %s expected ErrInvalidIDToken, got %v", e.name, err)
+		}
+	}
+}
+
+func TestProvider_Discovery(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	cfg := idp.Config("test")
+	cfg.Issuer = idp.URL + "/"
+	p := oidc.NewProvider(cfg, nil)
+	if _, err := p.AuthCodeURL(context.Background(), redirectURL, "s", "n", "v"); err == nil {
+		t.Error("expected discovery document of another issuer to be rejected")
+	}
+
+	p = oidc.NewProvider(idp.Config("test"), nil)
+	authURL, err := p.AuthCodeURL(context.Background(), redirectURL, "s", "n", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	if q.Get("scope") != "openid email profile" || q.Get("code_challenge") != oidc.CodeChallenge("v") || q.Get("redirect_uri") != redirectURL {
+		t.Errorf("unexpected authorization URL %s", authURL)
+	}
+}
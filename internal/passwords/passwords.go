@@ -0,0 +1,172 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Errors returned by Verify
+var (
+	ErrMismatchedPassword = errors.New("passwords: password does not match the hash")
+	ErrUnsupportedHash    = errors.New("passwords: unsupported hash format")
+)
+
+// Hasher hashes new passwords. Hashes carry their algorithm and parameters, so Verify checks passwords
+// against hashes of any Hasher.
+type Hasher interface {
+	// Hash returns encoded hash of password
+	Hash(password string) (string, error)
+	// NeedsRehash returns true if encoded was not produced by this hasher with its current parameters
+	NeedsRehash(encoded string) bool
+}
+
+// Verify checks password against a hash produced by Bcrypt or Argon2id. It returns ErrMismatchedPassword
+// when the password is wrong and ErrUnsupportedHash when encoded is not a hash it recognizes.
+func Verify(password, encoded string) error {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrMismatchedPassword
+		}
+		return nil
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatchedPassword
+		}
+		if err != nil {
+			return ErrUnsupportedHash
+		}
+		return nil
+	default:
+		return ErrUnsupportedHash
+	}
+}
+
+/*******************************************************************
+                   BCRYPT
+********************************************************************/
+
+// Bcrypt hashes passwords with bcrypt. Only the first 72 bytes of a password are used.
+type Bcrypt struct {
+	Cost int
+}
+
+// Hash returns bcrypt hash of password
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// NeedsRehash returns true unless encoded is a bcrypt hash with the same cost
+func (b Bcrypt) NeedsRehash(encoded string) bool {
+	if !isBcrypt(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
+
+// isBcrypt returns true if encoded looks like a bcrypt hash
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+/*******************************************************************
+                   ARGON2ID
+********************************************************************/
+
+// Argon2id hashes passwords with Argon2id. Hashes are encoded with their parameters, e.g.
+// $argon2id$v=19$m=65536,t=3,p=2$<base64 salt>$<base64 key>.
+type Argon2id struct {
+	// Memory is the amount of memory used in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2id returns parameters recommended by RFC 9106 for memory constrained environments
+func DefaultArgon2id() Argon2id {
+	return Argon2id{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+var encoding = base64.RawStdEncoding
+
+// Hash returns encoded Argon2id hash of password with a random salt
+func (a Argon2id) Hash(password string) (string, error) {
+	if a.Iterations < 1 || a.Parallelism < 1 || a.Memory < 8*uint32(a.Parallelism) || a.SaltLength < 8 || a.KeyLength < 16 {
+		return "", fmt.Errorf("passwords: invalid Argon2id parameters %+v", a)
+	}
+
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism, encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+// NeedsRehash returns true unless encoded is an Argon2id hash with the same parameters
+func (a Argon2id) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params != a
+}
+
+// decodeArgon2id parses encoded Argon2id hash
+func decodeArgon2id(encoded string) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil || params.Iterations < 1 || params.Parallelism < 1 {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+
+	salt, err := encoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+	key, err := encoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+	return params, salt, key, nil
+}
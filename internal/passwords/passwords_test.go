@@ -0,0 +1,98 @@
+package passwords
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id uses little memory, so the tests run fast
+var testArgon2id = Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashAndVerify(t *testing.T) {
+	hashers := []struct {
+		name   string
+		hasher Hasher
+		prefix string
+	}{
+		{"bcrypt", Bcrypt{Cost: bcrypt.MinCost}, "$2a$04$"},
+		{"argon2id", testArgon2id, "$argon2id$v=19$m=1024,t=1,p=1$"},
+	}
+
+	for _, e := range hashers {
+		hash, err := e.hasher.Hash("correct horse battery")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(hash, e.prefix) {
+			t.Errorf("for %s expected hash to start with %s, but got %s", e.name, e.prefix, hash)
+		}
+		if err = Verify("correct horse battery", hash); err != nil {
+			t.Errorf("for %s expected correct password to match, but got %v", e.name, err)
+		}
+		if err = Verify("correct horse battery!", hash); !errors.Is(err, ErrMismatchedPassword) {
+			t.Errorf("for %s expected %v for wrong password, but got %v", e.name, ErrMismatchedPassword, err)
+		}
+		if e.hasher.NeedsRehash(hash) {
+			t.Errorf("for %s expected hash with the current parameters not to need rehashing", e.name)
+		}
+
+		// Salt is random, so hashes of the same password differ
+		if other, _ := e.hasher.Hash("correct horse battery"); other == hash {
+			t.Errorf("for %s expected different hashes of the same password", e.name)
+		}
+	}
+}
+
+func TestVerify_Unsupported(t *testing.T) {
+	tests := []string{
+		"",
+		"password",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ",
+		"$2a$04$short",
+	}
+	for _, encoded := range tests {
+		if err := Verify("password", encoded); !errors.Is(err, ErrUnsupportedHash) {
+			t.Errorf("for %q expected %v, but got %v", encoded, ErrUnsupportedHash, err)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcrypt4, _ := Bcrypt{Cost: 4}.Hash("password")
+	argon, _ := testArgon2id.Hash("password")
+
+	stronger := testArgon2id
+	stronger.Iterations = 2
+
+	tests := []struct {
+		name     string
+		hasher   Hasher
+		encoded  string
+		expected bool
+	}{
+		{"same-bcrypt-cost", Bcrypt{Cost: 4}, bcrypt4, false},
+		{"higher-bcrypt-cost", Bcrypt{Cost: 5}, bcrypt4, true},
+		{"argon2id-to-bcrypt", Bcrypt{Cost: 4}, argon, true},
+		{"bcrypt-to-argon2id", testArgon2id, bcrypt4, true},
+		{"same-argon2id-parameters", testArgon2id, argon, false},
+		{"more-argon2id-iterations", stronger, argon, true},
+		{"invalid-hash", testArgon2id, "!", true},
+	}
+	for _, e := range tests {
+		if got := e.hasher.NeedsRehash(e.encoded); got != e.expected {
+			t.Errorf("for %s expected %v, but got %v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestArgon2id_InvalidParameters(t *testing.T) {
+	if _, err := (Argon2id{Memory: 1024, Iterations: 0, Parallelism: 1, SaltLength: 16, KeyLength: 32}).Hash("password"); err == nil {
+		t.Error("expected an error for zero iterations")
+	}
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps buckets in memory. Limits are per process, so use PostgresStore when running
+// several instances.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	stop    chan struct{}
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will be full again, after which it can be forgotten
+	full time.Time
+}
+
+// NewMemoryStore creates a MemoryStore which removes full buckets every cleanupInterval. Pass 0 to
+// disable the cleanup.
+func NewMemoryStore(cleanupInterval time.Duration) *MemoryStore {
+	s := &MemoryStore{
+		buckets: map[string]*bucket{},
+		stop:    make(chan struct{}),
+	}
+	if cleanupInterval > 0 {
+		go s.startCleanup(cleanupInterval)
+	}
+	return s
+}
+
+// Take takes a token from the bucket of key.
+func (s *MemoryStore) Take(key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit), updated: now}
+		s.buckets[key] = b
+	}
+
+	tokens, rate := refill(b.tokens, now.Sub(b.updated), limit, window)
+	b.updated = now
+	b.full = now.Add(window)
+
+	if tokens < 1 {
+		b.tokens = tokens
+		return false, time.Duration((1 - tokens) / rate * float64(time.Second)), nil
+	}
+	b.tokens = tokens - 1
+	return true, 0, nil
+}
+
+// StopCleanup stops the background goroutine which removes full buckets.
+func (s *MemoryStore) StopCleanup() {
+	close(s.stop)
+}
+
+func (s *MemoryStore) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			now := time.Now()
+			for key, b := range s.buckets {
+				if now.After(b.full) {
+					delete(s.buckets, key)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
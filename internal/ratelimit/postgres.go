@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cepa995/go-web-template/internal/logging"
+)
+
+// PostgresStore keeps buckets in the rate_limits table, so every instance of the application shares
+// the same limits.
+type PostgresStore struct {
+	db     *sql.DB
+	logger *logging.Logger
+	stop   chan struct{}
+}
+
+// NewPostgresStore creates a PostgresStore which deletes full buckets every cleanupInterval. Pass 0
+// to disable the cleanup. Failed cleanups are logged to logger.
+func NewPostgresStore(db *sql.DB, cleanupInterval time.Duration, logger *logging.Logger) *PostgresStore {
+	s := &PostgresStore{
+		db:     db,
+		logger: logger,
+		stop:   make(chan struct{}),
+	}
+	if cleanupInterval > 0 {
+		go s.startCleanup(cleanupInterval)
+	}
+	return s
+}
+
+// Take takes a token from the bucket of key. The bucket is refilled and updated in a single statement,
+// so concurrent requests can never take the same token.
+func (s *PostgresStore) Take(key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	rate := float64(limit) / window.Seconds()
+	query := `
+		insert into rate_limits (key, tokens, allowed, updated_at, full_at)
+		values ($1, $2::double precision - 1, true, now(), now() + make_interval(secs => $4::double precision))
+		on conflict (key) do update set
+			(tokens, allowed) = (
+				select case when refilled >= 1 then refilled - 1 else refilled end, refilled >= 1
+				from (
+					select least($2::double precision, rate_limits.tokens +
+						extract(epoch from now() - rate_limits.updated_at)::double precision * $3::double precision) as refilled
+				) bucket
+			),
+			updated_at = now(),
+			full_at = now() + make_interval(secs => $4::double precision)
+		returning allowed, tokens
+	`
+
+	var allowed bool
+	var tokens float64
+	err := s.db.QueryRowContext(ctx, query, key, float64(limit), rate, window.Seconds()).Scan(&allowed, &tokens)
+	if err != nil {
+		return false, 0, err
+	}
+	if !allowed {
+		return false, time.Duration((1 - tokens) / rate * float64(time.Second)), nil
+	}
+	return true, 0, nil
+}
+
+// StopCleanup stops the background goroutine which deletes full buckets.
+func (s *PostgresStore) StopCleanup() {
+	close(s.stop)
+}
+
+func (s *PostgresStore) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.db.Exec("delete from rate_limits where full_at < now()"); err != nil {
+				s.logger.Error("could not delete full rate limit buckets", "err", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store keeps a token bucket for every key. Each bucket holds up to limit tokens and is refilled at
+// limit tokens per window; every allowed request takes one token.
+type Store interface {
+	// Take takes a token from the bucket of key. If the bucket is empty it returns false and how long
+	// the caller has to wait for the next token.
+	Take(key string, limit int, window time.Duration) (bool, time.Duration, error)
+}
+
+// KeyFunc returns the key a request is counted under. Requests for which it returns false are not limited.
+type KeyFunc func(r *http.Request) (string, bool)
+
+// Rule limits requests with the same key to Limit requests per Window. Name keeps buckets of different
+// rules apart.
+type Rule struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Key    KeyFunc
+}
+
+// Allow counts r against the rule. If the request is over the limit it returns false and how long the
+// client has to wait before retrying.
+func (rule Rule) Allow(store Store, r *http.Request) (bool, time.Duration, error) {
+	key, ok := rule.Key(r)
+	if !ok {
+		return true, 0, nil
+	}
+	return store.Take(rule.Name+":"+key, rule.Limit, rule.Window)
+}
+
+// ByIP keys requests by client IP address.
+func ByIP(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host, host != ""
+}
+
+// ByEmail keys requests by the "email" field of a submitted form or JSON body. The body is restored, so
+// handlers can still read it.
+func ByEmail(r *http.Request) (string, bool) {
+	var email string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if r.Body == nil {
+			return "", false
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err != nil {
+			return "", false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var input struct {
+			Email string `json:"email"`
+		}
+		_ = json.Unmarshal(body, &input)
+		email = input.Email
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return "", false
+		}
+		email = r.PostForm.Get("email")
+	}
+
+	email = strings.ToLower(strings.TrimSpace(email))
+	return email, email != ""
+}
+
+// Combine keys requests by all of the specified keys together, e.g. Combine(ByIP, ByEmail) limits
+// every IP address and email pair separately.
+func Combine(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			part, ok := key(r)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, "|"), true
+	}
+}
+
+// RetryAfter formats wait as the value of Retry-After header, in whole seconds rounded up.
+func RetryAfter(wait time.Duration) string {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// refill returns the number of tokens in a bucket which had tokens elapsed ago, and the refill rate
+// in tokens per second.
+func refill(tokens float64, elapsed time.Duration, limit int, window time.Duration) (float64, float64) {
+	rate := float64(limit) / window.Seconds()
+	tokens += elapsed.Seconds() * rate
+	if tokens > float64(limit) {
+		tokens = float64(limit)
+	}
+	return tokens, rate
+}
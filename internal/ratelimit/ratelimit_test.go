@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore_Take(t *testing.T) {
+	store := NewMemoryStore(0)
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := store.Take("key", 3, time.Hour)
+		if err != nil || !allowed {
+			t.Fatalf("request %d: expected to be allowed, got %t (%v)", i+1, allowed, err)
+		}
+	}
+
+	allowed, wait, err := store.Take("key", 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed {
+		t.Error("expected request over the limit to be denied")
+	}
+	// One token is refilled every 20 minutes
+	if wait <= 19*time.Minute || wait > 20*time.Minute {
+		t.Errorf("expected to wait about 20 minutes, got %s", wait)
+	}
+
+	// Other keys have their own buckets
+	allowed, _, _ = store.Take("other", 3, time.Hour)
+	if !allowed {
+		t.Error("expected request with another key to be allowed")
+	}
+}
+
+func TestMemoryStore_Refill(t *testing.T) {
+	store := NewMemoryStore(0)
+
+	store.Take("key", 1, 50*time.Millisecond)
+	if allowed, _, _ := store.Take("key", 1, 50*time.Millisecond); allowed {
+		t.Fatal("expected second request to be denied")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if allowed, _, _ := store.Take("key", 1, 50*time.Millisecond); !allowed {
+		t.Error("expected request to be allowed after the bucket was refilled")
+	}
+}
+
+func TestRule_Allow(t *testing.T) {
+	store := NewMemoryStore(0)
+	signIn := Rule{Name: "signin", Limit: 1, Window: time.Hour, Key: ByIP}
+	signUp := Rule{Name: "signup", Limit: 1, Window: time.Hour, Key: ByIP}
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	if allowed, _, _ := signIn.Allow(store, r); !allowed {
+		t.Error("expected first sign in to be allowed")
+	}
+	if allowed, _, _ := signIn.Allow(store, r); allowed {
+		t.Error("expected second sign in to be denied")
+	}
+	if allowed, _, _ := signUp.Allow(store, r); !allowed {
+		t.Error("expected rules not to share buckets")
+	}
+
+	// Requests without a key are not limited
+	r.RemoteAddr = ""
+	for i := 0; i < 3; i++ {
+		if allowed, _, _ := signIn.Allow(store, r); !allowed {
+			t.Error("expected request without a key to be allowed")
+		}
+	}
+}
+
+var keyTests = []struct {
+	name        string
+	contentType string
+	body        string
+	key         KeyFunc
+	expected    string
+	ok          bool
+}{
+	{"ip", "", "", ByIP, "10.0.0.1", true},
+	{"form email", "application/x-www-form-urlencoded", "email=Jon@Example.com", ByEmail, "jon@example.com", true},
+	{"json email", "application/json", `{"email":" jon@example.com "}`, ByEmail, "jon@example.com", true},
+	{"missing email", "application/x-www-form-urlencoded", "name=jon", ByEmail, "", false},
+	{"invalid json", "application/json", `{"email":`, ByEmail, "", false},
+	{"combined", "application/x-www-form-urlencoded", "email=jon@example.com", Combine(ByIP, ByEmail), "10.0.0.1|jon@example.com", true},
+	{"combined missing email", "application/x-www-form-urlencoded", "", Combine(ByIP, ByEmail), "", false},
+}
+
+func TestKeyFuncs(t *testing.T) {
+	for _, e := range keyTests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(e.body))
+		r.RemoteAddr = "10.0.0.1:1234"
+		if e.contentType != "" {
+			r.Header.Set("Content-Type", e.contentType)
+		}
+
+		key, ok := e.key(r)
+		if key != e.expected || ok != e.ok {
+			t.Errorf("for %s expected %q, %t but got %q, %t", e.name, e.expected, e.ok, key, ok)
+		}
+	}
+}
+
+func TestByEmail_RestoresJSONBody(t *testing.T) {
+	body := `{"email":"jon@example.com","password":"secret"}`
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+
+	ByEmail(r)
+
+	restored, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(restored) != body {
+		t.Errorf("expected body %s, got %s", body, restored)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                       "1",
+		300 * time.Millisecond:  "1",
+		1500 * time.Millisecond: "2",
+		time.Minute:             "60",
+	}
+	for wait, expected := range tests {
+		if got := RetryAfter(wait); got != expected {
+			t.Errorf("for %s expected %s, got %s", wait, expected, got)
+		}
+	}
+}
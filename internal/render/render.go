@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/cepa995/go-web-template/internal/config"
+	"github.com/cepa995/go-web-template/internal/helpers"
 	"github.com/cepa995/go-web-template/internal/models"
 	"github.com/justinas/nosurf"
 )
@@ -21,6 +22,7 @@ var functions = template.FuncMap{
 	"isString":    IsString,
 	"isInt":       IsInt,
 	"isAvailable": IsAvailable,
+	"can":         Can,
 }
 var app *config.AppConfig
 var pathToTemplates = "./templates"
@@ -59,6 +61,19 @@ func IsAvailable(name string, data interface{}) bool {
 	return v.FieldByName(name).IsValid()
 }
 
+// Can returns true if signed in user has been granted permission, e.g. {{if can $ "users:write"}}
+func Can(td *models.TemplateData, permission string) bool {
+	if td == nil {
+		return false
+	}
+	for _, p := range td.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
 // AddDefaultData creates default models.TemplateData which should be accessable to each template when rendered.
 func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateData {
 	td.Flash = app.Session.PopString(r.Context(), "flash")
@@ -70,10 +85,7 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticated = 1
 	}
-	if app.Session.Exists(r.Context(), "access_level") {
-		access_level := app.Session.Get(r.Context(), "access_level").(int64)
-		td.AccessLevel = access_level
-	}
+	td.Permissions = helpers.Permissions(r.Context())
 	return td
 }
 
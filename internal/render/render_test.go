@@ -23,6 +23,26 @@ func TestAddDefaultData(t *testing.T) {
 	}
 }
 
+var canTests = []struct {
+	name        string
+	permissions []string
+	permission  string
+	expected    bool
+}{
+	{"granted", []string{"users:read", "users:write"}, "users:write", true},
+	{"not-granted", []string{"users:read"}, "users:write", false},
+	{"signed-out", nil, "users:read", false},
+}
+
+func TestCan(t *testing.T) {
+	for _, e := range canTests {
+		td := &models.TemplateData{Permissions: e.permissions}
+		if Can(td, e.permission) != e.expected {
+			t.Errorf("%s: expected %v for %s", e.name, e.expected, e.permission)
+		}
+	}
+}
+
 func TestTemplate(t *testing.T) {
 	pathToTemplates = "./../../templates"
 	tc, err := CreateTemplateCache()
@@ -2,8 +2,11 @@ package dbrepo
 
 import (
 	"database/sql"
+	"sync"
+	"time"
 
 	"github.com/cepa995/go-web-template/internal/config"
+	"github.com/cepa995/go-web-template/internal/models"
 	"github.com/cepa995/go-web-template/internal/repository"
 )
 
@@ -14,10 +17,32 @@ type postgresDBRepo struct {
 }
 
 // testDBRepo is struct used for unit testing and it holds information about application
-// config and DB connection
+// config and DB connection. Users, tokens and role assignments are kept in memory, so single-use
+// flows, permission checks and changes made by handlers can be tested. Like queries, every method
+// fails with ctx.Err() once its context is done.
 type testDBRepo struct {
 	App *config.AppConfig
 	DB  *sql.DB
+
+	mu        sync.Mutex
+	users     map[int64]models.User
+	tokens    map[string]models.Token
+	userRoles map[int64][]string
+
+	failedLogins map[int64]int
+	lockedUntil  map[int64]time.Time
+
+	twoFactor     map[int64]models.TwoFactor
+	recoveryCodes map[int64]map[string]bool
+
+	identities []models.Identity
+
+	userSessions      map[int64]models.UserSession
+	lastUserSessionID int64
+
+	deletedAt map[int64]time.Time
+
+	auditEvents []models.AuditEvent
 }
 
 // NewPostgresRepo instantiates new postgresDBRepo object based on specified DB connection
@@ -34,5 +59,21 @@ func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo
 func NewTestingRepo(a *config.AppConfig) repository.DatabaseRepo {
 	return &testDBRepo{
 		App: a,
+		users: map[int64]models.User{
+			1: {ID: 1, FirstName: "Jon", LastName: "Doe", Email: "test@gmail.com", Password: "password"},
+			2: {ID: 2, FirstName: "Mary", LastName: "Major", Email: "mary@gmail.com", Password: "password"},
+		},
+		tokens:    map[string]models.Token{},
+		userRoles: map[int64][]string{1: {models.RoleUser}, 2: {models.RoleUser}},
+
+		failedLogins: map[int64]int{},
+		lockedUntil:  map[int64]time.Time{},
+
+		twoFactor:     map[int64]models.TwoFactor{},
+		recoveryCodes: map[int64]map[string]bool{},
+
+		userSessions: map[int64]models.UserSession{},
+
+		deletedAt: map[int64]time.Time{},
 	}
 }
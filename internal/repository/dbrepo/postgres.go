@@ -2,16 +2,21 @@ package dbrepo
 
 import (
 	"context"
-	"errors"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/cepa995/go-web-template/internal/logging"
 	"github.com/cepa995/go-web-template/internal/models"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/cepa995/go-web-template/internal/passwords"
+	"github.com/cepa995/go-web-template/internal/repository"
 )
 
 // UpdatePasswordForUser updates specified user's hashed password
-func (m *postgresDBRepo) UpdatePasswordForUser(user models.User, hash string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+func (m *postgresDBRepo) UpdatePasswordForUser(ctx context.Context, user models.User, hash string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
 
 	stmt := `update users set password = $1 where id = $2`
@@ -22,45 +27,153 @@ func (m *postgresDBRepo) UpdatePasswordForUser(user models.User, hash string) er
 	return nil
 }
 
-// Authenticate authenticates the user.
-func (m *postgresDBRepo) Authenticate(email string, testPassword string) (int64, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+// Authenticate authenticates the user. Blocked and locked accounts are rejected before the password is
+// checked. Every failed attempt is counted and App.LockoutAttempts failures in a row lock the account
+// for App.LockoutDuration; a successful sign-in resets the counter. Hashes created with another algorithm
+// or cost than App.PasswordHasher uses are replaced with a new hash of the password.
+func (m *postgresDBRepo) Authenticate(ctx context.Context, email string, testPassword string) (int64, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
 
 	var userID int64
 	var hashedPassword string
+	var blocked bool
+	var lockedUntil sql.NullTime
 
-	row := m.DB.QueryRowContext(ctx, "select id, password from users where email = $1", email)
-	err := row.Scan(&userID, &hashedPassword)
+	row := m.DB.QueryRowContext(ctx, "select id, password, blocked, locked_until from users where email = $1", email)
+	err := row.Scan(&userID, &hashedPassword, &blocked, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return 0, "", repository.ErrInvalidCredentials
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	if blocked {
+		return 0, "", repository.ErrAccountBlocked
+	}
+	if lockedUntil.Valid && lockedUntil.Time.After(time.Now()) {
+		return 0, "", repository.ErrAccountLocked
+	}
+
+	// Compare hashed password pulled from DB and password that user typed into the form.
+	// Any error counts as a failed attempt, including a hash invalidated by forced password reset.
+	err = passwords.Verify(testPassword, hashedPassword)
 	if err != nil {
-		return userID, "", err
+		locked, err := m.recordFailedLogin(ctx, userID)
+		if err != nil {
+			return 0, "", err
+		}
+		if locked {
+			return 0, "", repository.ErrTooManyAttempts
+		}
+		return 0, "", repository.ErrInvalidCredentials
 	}
 
-	// Built-in package fro comparing hashed password pulled from DB and password that user typed into the form.
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, "", errors.New("incorrect password")
-	} else if err != nil {
+	_, err = m.DB.ExecContext(ctx, `
+		update users set failed_logins = 0, locked_until = null
+		where id = $1 and (failed_logins > 0 or locked_until is not null)`, userID)
+	if err != nil {
 		return 0, "", err
 	}
 
+	hashedPassword = m.rehashPassword(ctx, userID, testPassword, hashedPassword)
+
 	return userID, hashedPassword, nil
 }
 
-// AllUsers retrieves list of all users from the database.
-func (m *postgresDBRepo) AllUsers() ([]models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+// rehashPassword upgrades outdated hash of the password the user has just signed in with and returns the
+// hash now stored. Failing to upgrade does not fail the sign-in, the hash is upgraded next time.
+func (m *postgresDBRepo) rehashPassword(ctx context.Context, userID int64, password, hashedPassword string) string {
+	if m.App.PasswordHasher == nil || !m.App.PasswordHasher.NeedsRehash(hashedPassword) {
+		return hashedPassword
+	}
+
+	newHash, err := m.App.PasswordHasher.Hash(password)
+	if err != nil {
+		m.App.Logger.FromContext(ctx).Error("could not rehash password", "user_id", userID, "err", err)
+		return hashedPassword
+	}
+
+	// The hash is replaced only if the password has not been changed in the meantime
+	_, err = m.DB.ExecContext(ctx, "update users set password = $1 where id = $2 and password = $3",
+		newHash, userID, hashedPassword)
+	if err != nil {
+		m.App.Logger.FromContext(ctx).Error("could not rehash password", "user_id", userID, "err", err)
+		return hashedPassword
+	}
+	return newHash
+}
+
+// CheckPassword confirms testPassword is the password of the user, e.g. before a change of account
+// settings. Unlike Authenticate it only compares the hash: failed attempts are not counted and blocking
+// and lockout are ignored. ErrInvalidCredentials is returned also for users without a password.
+func (m *postgresDBRepo) CheckPassword(ctx context.Context, userID int64, testPassword string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	var hashedPassword string
+	err := m.DB.QueryRowContext(ctx, "select password from users where id = $1 and deleted_at is null", userID).Scan(&hashedPassword)
+	if err == sql.ErrNoRows {
+		return repository.ErrInvalidCredentials
+	} else if err != nil {
+		return err
+	}
+
+	if passwords.Verify(testPassword, hashedPassword) != nil {
+		return repository.ErrInvalidCredentials
+	}
+	return nil
+}
+
+// recordFailedLogin counts a failed sign-in. When the count reaches App.LockoutAttempts the account is locked
+// and the counter starts over. It returns true if this attempt locked the account.
+func (m *postgresDBRepo) recordFailedLogin(ctx context.Context, userID int64) (bool, error) {
+	if m.App.LockoutAttempts <= 0 {
+		_, err := m.DB.ExecContext(ctx, "update users set failed_logins = failed_logins + 1 where id = $1", userID)
+		return false, err
+	}
+
+	query := `
+		update users set
+			failed_logins = case when failed_logins + 1 >= $2 then 0 else failed_logins + 1 end,
+			locked_until = case when failed_logins + 1 >= $2 then now() + make_interval(secs => $3) else locked_until end
+		where id = $1
+		returning failed_logins = 0
+	`
+	var locked bool
+	err := m.DB.QueryRowContext(ctx, query, userID, m.App.LockoutAttempts, m.App.LockoutDuration.Seconds()).Scan(&locked)
+	return locked, err
+}
+
+// UnlockUser lifts a temporary lock caused by too many failed sign-ins.
+func (m *postgresDBRepo) UnlockUser(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "update users set failed_logins = 0, locked_until = null where id = $1", userID)
+	return err
+}
+
+// AllUsers retrieves one page of users whose name or email contains search, ordered by ID, together
+// with the number of all matching users.
+func (m *postgresDBRepo) AllUsers(ctx context.Context, search string, limit, offset int) ([]models.User, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
 
 	var users []models.User
+	var total int
 	query := `
 		select
-			*
+			id, first_name, last_name, email, password, blocked, created_at, updated_at, count(*) over ()
 		from users
+		where deleted_at is null
+			and ($1 = '' or email ilike '%' || $1 || '%' or (first_name || ' ' || last_name) ilike '%' || $1 || '%')
+		order by id
+		limit $2 offset $3
 	`
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, search, limit, offset)
 	if err != nil {
-		return users, err
+		return users, 0, err
 	}
 	defer rows.Close()
 
@@ -72,35 +185,44 @@ func (m *postgresDBRepo) AllUsers() ([]models.User, error) {
 			&user.LastName,
 			&user.Email,
 			&user.Password,
-			&user.AccessLevel,
+			&user.Blocked,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&total,
 		); err != nil {
-			return users, err
+			return users, 0, err
 		}
 		users = append(users, user)
 	}
 
-	return users, nil
+	return users, total, rows.Err()
 }
 
-//InsertUser inserts user into the database
-func (m *postgresDBRepo) InsertUser(user models.User) (int64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+//InsertUser inserts user into the database and gives it the default role
+func (m *postgresDBRepo) InsertUser(ctx context.Context, user models.User) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
 
 	var newID int64
-	query := `insert into users (first_name, last_name, email, password, access_level, blocked, created_at, updated_at)
-			values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+	query := `
+		with new_user as (
+			insert into users (first_name, last_name, email, password, blocked, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id
+		), default_role as (
+			insert into user_roles (user_id, role_id)
+			select new_user.id, roles.id from new_user, roles where roles.name = $8
+		)
+		select id from new_user
+	`
 	err := m.DB.QueryRowContext(ctx, query,
 		user.FirstName,
 		user.LastName,
 		user.Email,
 		user.Password,
-		user.AccessLevel,
 		false,
 		time.Now(),
 		time.Now(),
+		models.RoleUser,
 	).Scan(&newID)
 	if err != nil {
 		return 0, err
@@ -110,19 +232,20 @@ func (m *postgresDBRepo) InsertUser(user models.User) (int64, error) {
 }
 
 // UpdateUser updates user in the database
-func (m *postgresDBRepo) UpdateUser(user models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+func (m *postgresDBRepo) UpdateUser(ctx context.Context, user models.User) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
 
 	query := `
-		update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5
+		update users set first_name = $1, last_name = $2, email = $3, blocked = $4, updated_at = $5 where id = $6
 	`
 	_, err := m.DB.ExecContext(ctx, query,
 		user.FirstName,
 		user.LastName,
 		user.Email,
-		user.AccessLevel,
+		user.Blocked,
 		time.Now(),
+		user.ID,
 	)
 	if err != nil {
 		return err
@@ -131,16 +254,93 @@ func (m *postgresDBRepo) UpdateUser(user models.User) error {
 	return nil
 }
 
+// DeleteUser deletes user from the database together with its tokens and role assignments
+func (m *postgresDBRepo) DeleteUser(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	// Sessions of the user are signed out; their rows in user_sessions are removed with the user
+	_, err := m.DB.ExecContext(ctx, "delete from sessions where token in (select token from user_sessions where user_id = $1)", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, "delete from users where id = $1", userID)
+	return err
+}
+
+// SoftDeleteUser marks user as deleted and anonymizes it right away. Name, email and password are
+// replaced, and sessions, tokens, external identities, two-factor settings and queued email of the user are
+// removed. Audit events of the user keep only the user ID; IP address, user agent and email addresses
+// are cleared. The row itself is removed by PurgeDeletedUsers once the grace period is over.
+func (m *postgresDBRepo) SoftDeleteUser(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(ctx, "select id from users where id = $1 and deleted_at is null for update", userID).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	// The email address is replaced last, so the statements before can still find tokens and queued email
+	// sent to it
+	stmts := []string{
+		"delete from sessions where token in (select token from user_sessions where user_id = $1)",
+		"delete from user_sessions where user_id = $1",
+		"delete from tokens where user_id = $1 or email = (select email from users where id = $1)",
+		"delete from user_identities where user_id = $1",
+		"delete from recovery_codes where user_id = $1",
+		"delete from user_roles where user_id = $1",
+		"delete from mail_queue where to_address = (select email from users where id = $1) and status <> 'processing'",
+		`update audit_events set ip = '', user_agent = '', metadata = metadata - 'email' - 'from' - 'to'
+		where actor_id = $1 or target_user_id = $1`,
+		`update users set
+			first_name = 'Deleted', last_name = 'User', email = 'deleted-' || id || '@deleted.invalid', password = '',
+			blocked = true, failed_logins = 0, locked_until = null,
+			totp_secret = null, totp_enabled = false, totp_last_step = 0,
+			deleted_at = now(), updated_at = now()
+		where id = $1`,
+	}
+	for _, stmt := range stmts {
+		_, err = tx.ExecContext(ctx, stmt, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PurgeDeletedUsers removes users which were soft deleted before deletedBefore, together with everything
+// that references them. It returns the number of removed users.
+func (m *postgresDBRepo) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "delete from users where deleted_at < $1", deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // GetUser retrieves user from the database by ID
-func (m *postgresDBRepo) GetUserByID(userID int64) (models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+func (m *postgresDBRepo) GetUserByID(ctx context.Context, userID int64) (models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
 
 	var user models.User
 
 	query := `
 			select 
-				*
+				id, first_name, last_name, email, password, blocked, created_at, updated_at
 			from 
 				users u
 			where u.id = $1;
@@ -152,7 +352,7 @@ func (m *postgresDBRepo) GetUserByID(userID int64) (models.User, error) {
 		&user.LastName,
 		&user.Email,
 		&user.Password,
-		&user.AccessLevel,
+		&user.Blocked,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -164,14 +364,14 @@ func (m *postgresDBRepo) GetUserByID(userID int64) (models.User, error) {
 }
 
 // GetUserByEmail retrieves user from the database by email
-func (m *postgresDBRepo) GetUserByEmail(email string) (models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+func (m *postgresDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
 
 	var user models.User
 	query := `
 			select 
-				*
+				id, first_name, last_name, email, password, blocked, created_at, updated_at
 			from 
 				users u
 			where u.email= $1;
@@ -183,7 +383,7 @@ func (m *postgresDBRepo) GetUserByEmail(email string) (models.User, error) {
 		&user.LastName,
 		&user.Email,
 		&user.Password,
-		&user.AccessLevel,
+		&user.Blocked,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -193,3 +393,867 @@ func (m *postgresDBRepo) GetUserByEmail(email string) (models.User, error) {
 
 	return user, nil
 }
+
+// EnqueueMail stores an email message in the mail queue, so it is sent by one of the mail workers. Unless
+// set, the message is tagged with the ID of the request in ctx.
+func (m *postgresDBRepo) EnqueueMail(ctx context.Context, msg models.MailData) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		return 0, err
+	}
+	if msg.RequestID == "" {
+		msg.RequestID = logging.RequestID(ctx)
+	}
+
+	var newID int64
+	query := `insert into mail_queue (to_address, from_address, subject, template_name, data, request_id, status, next_attempt_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`
+	err = m.DB.QueryRowContext(ctx, query,
+		msg.To,
+		msg.From,
+		msg.Subject,
+		msg.TemplateName,
+		data,
+		msg.RequestID,
+		models.MailStatusPending,
+		time.Now(),
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// ClaimMailJobs marks up to limit due jobs as processing and returns them. Rows locked by other workers are
+// skipped, and a claimed job becomes due again after lease in case the worker which claimed it dies.
+func (m *postgresDBRepo) ClaimMailJobs(ctx context.Context, limit int, lease time.Duration) ([]models.MailJob, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	var jobs []models.MailJob
+	query := `
+		update mail_queue set status = $1, attempts = attempts + 1, next_attempt_at = $2, updated_at = $3
+		where id in (
+			select id from mail_queue
+			where status in ($4, $1) and next_attempt_at <= $3
+			order by next_attempt_at
+			limit $5
+			for update skip locked
+		)
+		returning id, to_address, from_address, subject, template_name, data, request_id, status, attempts,
+			next_attempt_at, last_error, created_at, updated_at
+	`
+	now := time.Now()
+	rows, err := m.DB.QueryContext(ctx, query,
+		models.MailStatusProcessing,
+		now.Add(lease),
+		now,
+		models.MailStatusPending,
+		limit,
+	)
+	if err != nil {
+		return jobs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var job models.MailJob
+		var data []byte
+		if err := rows.Scan(
+			&job.ID,
+			&job.Mail.To,
+			&job.Mail.From,
+			&job.Mail.Subject,
+			&job.Mail.TemplateName,
+			&data,
+			&job.Mail.RequestID,
+			&job.Status,
+			&job.Attempts,
+			&job.NextAttemptAt,
+			&job.LastError,
+			&job.CreatedAt,
+			&job.UpdatedAt,
+		); err != nil {
+			return jobs, err
+		}
+
+		var payload map[string]interface{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return jobs, err
+		}
+		job.Mail.Data = payload
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// MarkMailJobSent marks mail queue job as successfully sent.
+func (m *postgresDBRepo) MarkMailJobSent(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `update mail_queue set status = $1, last_error = '', updated_at = $2 where id = $3`
+	_, err := m.DB.ExecContext(ctx, stmt, models.MailStatusSent, time.Now(), id)
+	return err
+}
+
+// RetryMailJob puts a failed mail queue job back in the queue to be retried at nextAttempt.
+func (m *postgresDBRepo) RetryMailJob(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `update mail_queue set status = $1, last_error = $2, next_attempt_at = $3, updated_at = $4 where id = $5`
+	_, err := m.DB.ExecContext(ctx, stmt, models.MailStatusPending, lastError, nextAttempt, time.Now(), id)
+	return err
+}
+
+// DeadLetterMailJob marks mail queue job which ran out of attempts as dead, so it is never retried again.
+func (m *postgresDBRepo) DeadLetterMailJob(ctx context.Context, id int64, lastError string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `update mail_queue set status = $1, last_error = $2, updated_at = $3 where id = $4`
+	_, err := m.DB.ExecContext(ctx, stmt, models.MailStatusDead, lastError, time.Now(), id)
+	return err
+}
+
+// InsertToken stores the hash of a token together with its owner, scope and expiry.
+func (m *postgresDBRepo) InsertToken(ctx context.Context, token models.Token) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	data, err := json.Marshal(token.Data)
+	if err != nil {
+		return err
+	}
+
+	userID := sql.NullInt64{Int64: token.UserID, Valid: token.UserID != 0}
+	stmt := `insert into tokens (hash, user_id, email, scope, data, expiry, created_at)
+			values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = m.DB.ExecContext(ctx, stmt,
+		token.Hash,
+		userID,
+		token.Email,
+		token.Scope,
+		data,
+		token.Expiry,
+		time.Now(),
+	)
+	return err
+}
+
+// GetToken retrieves a token which has the specified scope, has not expired and has not been used yet.
+func (m *postgresDBRepo) GetToken(ctx context.Context, plainText, scope string) (models.Token, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `
+		select id, hash, user_id, email, scope, data, expiry, consumed_at, created_at
+		from tokens
+		where hash = $1 and scope = $2 and consumed_at is null and expiry > $3
+	`
+	row := m.DB.QueryRowContext(ctx, query, models.TokenHash(plainText), scope, time.Now())
+	token, err := scanToken(row)
+	token.PlainText = plainText
+	return token, err
+}
+
+// ConsumeToken marks a valid token as used and returns it. Because the check and the update happen in
+// one statement, two concurrent requests can never both consume the same token.
+func (m *postgresDBRepo) ConsumeToken(ctx context.Context, plainText, scope string) (models.Token, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `
+		update tokens set consumed_at = $3
+		where hash = $1 and scope = $2 and consumed_at is null and expiry > $3
+		returning id, hash, user_id, email, scope, data, expiry, consumed_at, created_at
+	`
+	row := m.DB.QueryRowContext(ctx, query, models.TokenHash(plainText), scope, time.Now())
+	token, err := scanToken(row)
+	token.PlainText = plainText
+	return token, err
+}
+
+// RevokeTokens deletes all tokens with the specified scope that were issued for email.
+func (m *postgresDBRepo) RevokeTokens(ctx context.Context, email, scope string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `delete from tokens where email = $1 and scope = $2`
+	_, err := m.DB.ExecContext(ctx, stmt, email, scope)
+	return err
+}
+
+// RevokeTokensForUser deletes all tokens with the specified scope that were issued for the user, whichever
+// email address they were issued for.
+func (m *postgresDBRepo) RevokeTokensForUser(ctx context.Context, userID int64, scope string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `delete from tokens where user_id = $1 and scope = $2`
+	_, err := m.DB.ExecContext(ctx, stmt, userID, scope)
+	return err
+}
+
+// GetTokensForUser retrieves every token issued for the user, including used and expired ones, newest first
+func (m *postgresDBRepo) GetTokensForUser(ctx context.Context, userID int64) ([]models.Token, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `
+		select id, hash, user_id, email, scope, data, expiry, consumed_at, created_at
+		from tokens
+		where user_id = $1
+		order by created_at desc
+	`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []models.Token
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// scanToken scans a single row of the tokens table.
+func scanToken(row interface{ Scan(...interface{}) error }) (models.Token, error) {
+	var token models.Token
+	var userID sql.NullInt64
+	var consumedAt sql.NullTime
+	var data []byte
+
+	err := row.Scan(
+		&token.ID,
+		&token.Hash,
+		&userID,
+		&token.Email,
+		&token.Scope,
+		&data,
+		&token.Expiry,
+		&consumedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return token, err
+	}
+
+	token.UserID = userID.Int64
+	if consumedAt.Valid {
+		token.ConsumedAt = &consumedAt.Time
+	}
+	if err = json.Unmarshal(data, &token.Data); err != nil {
+		return token, err
+	}
+
+	return token, nil
+}
+
+// AllRoles retrieves every role together with the permissions granted to it.
+func (m *postgresDBRepo) AllRoles(ctx context.Context) ([]models.Role, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `
+		select r.id, r.name, r.description, coalesce(string_agg(p.name, ',' order by p.name), '')
+		from roles r
+			left join role_permissions rp on rp.role_id = r.id
+			left join permissions p on p.id = rp.permission_id
+		group by r.id
+		order by r.id
+	`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRoles(rows)
+}
+
+// GetRolesForUser retrieves roles assigned to the user together with the permissions granted to them.
+func (m *postgresDBRepo) GetRolesForUser(ctx context.Context, userID int64) ([]models.Role, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `
+		select r.id, r.name, r.description, coalesce(string_agg(p.name, ',' order by p.name), '')
+		from user_roles ur
+			join roles r on r.id = ur.role_id
+			left join role_permissions rp on rp.role_id = r.id
+			left join permissions p on p.id = rp.permission_id
+		where ur.user_id = $1
+		group by r.id
+		order by r.id
+	`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRoles(rows)
+}
+
+// GetPermissionsForUser retrieves names of all permissions granted to the user through any of its roles.
+func (m *postgresDBRepo) GetPermissionsForUser(ctx context.Context, userID int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `
+		select distinct p.name
+		from user_roles ur
+			join role_permissions rp on rp.role_id = ur.role_id
+			join permissions p on p.id = rp.permission_id
+		where ur.user_id = $1
+		order by p.name
+	`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, name)
+	}
+	return permissions, rows.Err()
+}
+
+// AssignRole gives the role with the specified name to the user. Assigning a role twice is not an error.
+func (m *postgresDBRepo) AssignRole(ctx context.Context, userID int64, role string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	var roleID int64
+	err := m.DB.QueryRowContext(ctx, "select id from roles where name = $1", role).Scan(&roleID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("role %s does not exist", role)
+	} else if err != nil {
+		return err
+	}
+
+	stmt := `insert into user_roles (user_id, role_id) values ($1, $2) on conflict do nothing`
+	_, err = m.DB.ExecContext(ctx, stmt, userID, roleID)
+	return err
+}
+
+// RemoveRole takes the role with the specified name away from the user.
+func (m *postgresDBRepo) RemoveRole(ctx context.Context, userID int64, role string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `delete from user_roles where user_id = $1 and role_id = (select id from roles where name = $2)`
+	_, err := m.DB.ExecContext(ctx, stmt, userID, role)
+	return err
+}
+
+// scanRoles scans rows of roles with aggregated permission names.
+func scanRoles(rows *sql.Rows) ([]models.Role, error) {
+	var roles []models.Role
+	for rows.Next() {
+		var role models.Role
+		var permissions string
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &permissions); err != nil {
+			return nil, err
+		}
+		role.Permissions = []string{}
+		if permissions != "" {
+			role.Permissions = strings.Split(permissions, ",")
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// GetUserByIdentity retrieves user linked to the subject of an OpenID Connect provider. It returns
+// sql.ErrNoRows if the subject is not linked to any user.
+func (m *postgresDBRepo) GetUserByIdentity(ctx context.Context, provider, subject string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	var user models.User
+	query := `
+			select 
+				u.id, u.first_name, u.last_name, u.email, u.password, u.blocked, u.created_at, u.updated_at
+			from 
+				users u
+				join user_identities i on i.user_id = u.id
+			where i.provider = $1 and i.subject = $2;
+	`
+
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(
+		&user.ID,
+		&user.FirstName,
+		&user.LastName,
+		&user.Email,
+		&user.Password,
+		&user.Blocked,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	return user, err
+}
+
+// GetIdentitiesForUser retrieves external identities linked to the user, ordered by provider
+func (m *postgresDBRepo) GetIdentitiesForUser(ctx context.Context, userID int64) ([]models.Identity, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `
+			select id, user_id, provider, subject, email, created_at
+			from user_identities
+			where user_id = $1
+			order by provider
+	`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []models.Identity
+	for rows.Next() {
+		var identity models.Identity
+		err = rows.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// InsertIdentity links the user to the subject of an OpenID Connect provider. A subject can be linked to
+// one user only and a user can have one identity per provider.
+func (m *postgresDBRepo) InsertIdentity(ctx context.Context, identity models.Identity) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `insert into user_identities (user_id, provider, subject, email, created_at) values ($1, $2, $3, $4, $5)`
+	_, err := m.DB.ExecContext(ctx, stmt, identity.UserID, identity.Provider, identity.Subject, identity.Email, time.Now())
+	return err
+}
+
+// userSessionColumns are the columns scanned by scanUserSession
+const userSessionColumns = `id, user_id, token, user_agent, ip, remember_selector, remember_hash, remember_expiry, created_at, last_seen_at`
+
+// scanUserSession scans a row of userSessionColumns
+func scanUserSession(row interface{ Scan(...interface{}) error }) (models.UserSession, error) {
+	var s models.UserSession
+	var selector sql.NullString
+	var expiry sql.NullTime
+	err := row.Scan(&s.ID, &s.UserID, &s.Token, &s.UserAgent, &s.IP, &selector, &s.RememberHash, &expiry, &s.CreatedAt, &s.LastSeenAt)
+	s.RememberSelector = selector.String
+	s.RememberExpiry = expiry.Time
+	return s, err
+}
+
+// InsertUserSession records a new session of a signed in user and returns its ID. Sessions of the user
+// which have expired are removed at the same time.
+func (m *postgresDBRepo) InsertUserSession(ctx context.Context, s models.UserSession) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		delete from user_sessions us
+		where us.user_id = $1
+			and (us.remember_expiry is null or us.remember_expiry < now())
+			and not exists (select 1 from sessions where token = us.token and expiry > now())`, s.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `
+		insert into user_sessions
+			(user_id, token, user_agent, ip, remember_selector, remember_hash, remember_expiry, created_at, last_seen_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		returning id
+	`
+	var id int64
+	err = m.DB.QueryRowContext(ctx, stmt, s.UserID, s.Token, s.UserAgent, s.IP, nullString(s.RememberSelector), s.RememberHash,
+		nullTime(s.RememberExpiry), time.Now()).Scan(&id)
+	return id, err
+}
+
+// GetUserSession retrieves session of a signed in user by ID
+func (m *postgresDBRepo) GetUserSession(ctx context.Context, id int64) (models.UserSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `select ` + userSessionColumns + ` from user_sessions where id = $1`
+	return scanUserSession(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// GetUserSessionBySelector retrieves session with the remember me cookie selector. It returns
+// sql.ErrNoRows if there is no such session.
+func (m *postgresDBRepo) GetUserSessionBySelector(ctx context.Context, selector string) (models.UserSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `select ` + userSessionColumns + ` from user_sessions where remember_selector = $1`
+	return scanUserSession(m.DB.QueryRowContext(ctx, query, selector))
+}
+
+// GetUserSessionsForUser retrieves sessions of the user which have not expired and sessions which can
+// still be restored with a remember me cookie, most recently used first
+func (m *postgresDBRepo) GetUserSessionsForUser(ctx context.Context, userID int64) ([]models.UserSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	query := `
+		select ` + userSessionColumns + `
+		from user_sessions us
+		where us.user_id = $1
+			and (us.remember_expiry > now() or exists (select 1 from sessions where token = us.token and expiry > now()))
+		order by us.last_seen_at desc
+	`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.UserSession
+	for rows.Next() {
+		s, err := scanUserSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// UpdateUserSession updates token, device, last seen time and remember me cookie of a session
+func (m *postgresDBRepo) UpdateUserSession(ctx context.Context, s models.UserSession) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `
+		update user_sessions set
+			token = $1, user_agent = $2, ip = $3, remember_selector = $4, remember_hash = $5, remember_expiry = $6,
+			last_seen_at = $7
+		where id = $8
+	`
+	_, err := m.DB.ExecContext(ctx, stmt, s.Token, s.UserAgent, s.IP, nullString(s.RememberSelector), s.RememberHash,
+		nullTime(s.RememberExpiry), s.LastSeenAt, s.ID)
+	return err
+}
+
+// DeleteUserSession revokes a session; its row in the sessions table is deleted as well, which signs out
+// the browser using it
+func (m *postgresDBRepo) DeleteUserSession(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "delete from sessions where token = (select token from user_sessions where id = $1)", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "delete from user_sessions where id = $1", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteUserSessionsForUser revokes every session of the user, signing the user out everywhere
+func (m *postgresDBRepo) DeleteUserSessionsForUser(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "delete from sessions where token in (select token from user_sessions where user_id = $1)", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "delete from user_sessions where user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// nullString maps empty string to NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullTime maps zero time to NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// GetTwoFactor retrieves TOTP settings of the user. Users who never enrolled have an empty Secret.
+func (m *postgresDBRepo) GetTwoFactor(ctx context.Context, userID int64) (models.TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	twoFactor := models.TwoFactor{UserID: userID}
+	var secret sql.NullString
+	query := `select totp_secret, totp_enabled, totp_last_step from users where id = $1`
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&secret, &twoFactor.Enabled, &twoFactor.LastStep)
+	twoFactor.Secret = secret.String
+	return twoFactor, err
+}
+
+// SetTwoFactorSecret stores the (encrypted) secret of an enrollment which has not been confirmed yet.
+func (m *postgresDBRepo) SetTwoFactorSecret(ctx context.Context, userID int64, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `update users set totp_secret = $1, totp_enabled = false, totp_last_step = 0 where id = $2`
+	_, err := m.DB.ExecContext(ctx, stmt, secret, userID)
+	return err
+}
+
+// UpdateTwoFactorSecret replaces the encrypted secret, e.g. after it was encrypted with a new key,
+// without changing whether two-factor authentication is enabled.
+func (m *postgresDBRepo) UpdateTwoFactorSecret(ctx context.Context, userID int64, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "update users set totp_secret = $1 where id = $2", secret, userID)
+	return err
+}
+
+// EnableTwoFactor turns on two-factor authentication with the stored secret and replaces the user's
+// recovery codes.
+func (m *postgresDBRepo) EnableTwoFactor(ctx context.Context, userID int64, recoveryCodeHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "update users set totp_enabled = true where id = $1 and totp_secret is not null", userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("user %d has no two-factor secret", userID)
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTwoFactor turns off two-factor authentication and deletes the secret and recovery codes.
+func (m *postgresDBRepo) DisableTwoFactor(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update users set totp_secret = null, totp_enabled = false, totp_last_step = 0 where id = $1`
+	if _, err = tx.ExecContext(ctx, stmt, userID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "delete from recovery_codes where user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTwoFactorStep records that a code of TOTP period step was accepted. It returns false if a code of
+// the same or a later period has already been used, so the check and the update can not race.
+func (m *postgresDBRepo) UseTwoFactorStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `update users set totp_last_step = $1 where id = $2 and totp_last_step < $1`
+	res, err := m.DB.ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ReplaceRecoveryCodes deletes all recovery codes of the user and stores new ones.
+func (m *postgresDBRepo) ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryCodeHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused recovery code of the user as used. It returns false if there is no
+// such code.
+func (m *postgresDBRepo) UseRecoveryCode(ctx context.Context, userID int64, hash []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	stmt := `update recovery_codes set used_at = $1 where user_id = $2 and code_hash = $3 and used_at is null`
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CountRecoveryCodes returns the number of recovery codes the user has not used yet.
+func (m *postgresDBRepo) CountRecoveryCodes(ctx context.Context, userID int64) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	var count int
+	query := `select count(*) from recovery_codes where user_id = $1 and used_at is null`
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// replaceRecoveryCodes replaces recovery codes of the user within transaction tx.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64, hashes [][]byte) error {
+	if _, err := tx.ExecContext(ctx, "delete from recovery_codes where user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		stmt := `insert into recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`
+		if _, err := tx.ExecContext(ctx, stmt, userID, hash, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertAuditEvent records an event in the audit log
+func (m *postgresDBRepo) InsertAuditEvent(ctx context.Context, event models.AuditEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+
+	metadata := event.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into audit_events (actor_id, target_user_id, type, ip, user_agent, metadata, created_at)
+			values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = m.DB.ExecContext(ctx, stmt,
+		sql.NullInt64{Int64: event.ActorID, Valid: event.ActorID != 0},
+		sql.NullInt64{Int64: event.TargetUserID, Valid: event.TargetUserID != 0},
+		event.Type,
+		event.IP,
+		event.UserAgent,
+		data,
+		time.Now(),
+	)
+	return err
+}
+
+// AuditEvents retrieves audit events matching filter, newest first, together with the number of all
+// matching events. With limit of 0 every matching event is returned.
+func (m *postgresDBRepo) AuditEvents(ctx context.Context, filter models.AuditFilter, limit, offset int) ([]models.AuditEvent, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	query := `
+		select id, actor_id, target_user_id, type, ip, user_agent, metadata, created_at, count(*) over ()
+		from audit_events
+		where ($1 = 0 or actor_id = $1 or target_user_id = $1)
+			and ($2 = '' or type = $2)
+			and ($3::timestamptz is null or created_at >= $3)
+			and ($4::timestamptz is null or created_at < $4)
+		order by created_at desc, id desc
+		limit $5 offset $6
+	`
+	rows, err := m.DB.QueryContext(ctx, query,
+		filter.UserID,
+		filter.Type,
+		nullTime(filter.Since),
+		nullTime(filter.Until),
+		sql.NullInt64{Int64: int64(limit), Valid: limit > 0},
+		offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var events []models.AuditEvent
+	var total int
+	for rows.Next() {
+		var event models.AuditEvent
+		var actorID, targetUserID sql.NullInt64
+		var data []byte
+		if err := rows.Scan(
+			&event.ID,
+			&actorID,
+			&targetUserID,
+			&event.Type,
+			&event.IP,
+			&event.UserAgent,
+			&data,
+			&event.CreatedAt,
+			&total,
+		); err != nil {
+			return nil, 0, err
+		}
+		event.ActorID = actorID.Int64
+		event.TargetUserID = targetUserID.Int64
+		if err := json.Unmarshal(data, &event.Metadata); err != nil {
+			return nil, 0, err
+		}
+		events = append(events, event)
+	}
+
+	return events, total, rows.Err()
+}
@@ -1,66 +1,1028 @@
 package dbrepo
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/cepa995/go-web-template/internal/logging"
 	"github.com/cepa995/go-web-template/internal/models"
+	"github.com/cepa995/go-web-template/internal/passwords"
+	"github.com/cepa995/go-web-template/internal/repository"
 )
 
-// Authenticate authenticates the user.
-func (m *testDBRepo) Authenticate(email string, testPassword string) (int64, string, error) {
-	// Here we are mocking what is happening on DB level
-	if email == "test@gmail.com" && testPassword == "password" {
-		return 1, "", nil
+// Authenticate authenticates the user. Seeded test users keep their password in plain text, hashes of
+// other users are upgraded like in the database.
+func (m *testDBRepo) Authenticate(ctx context.Context, email string, testPassword string) (int64, string, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, "", err
 	}
-	return 0, "", errors.New("invalid email credentials")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var user models.User
+	for _, u := range m.users {
+		if u.Email == email {
+			user = u
+		}
+	}
+	if user.ID == 0 {
+		return 0, "", repository.ErrInvalidCredentials
+	}
+
+	if user.Blocked {
+		return 0, "", repository.ErrAccountBlocked
+	}
+	if m.lockedUntil[user.ID].After(time.Now()) {
+		return 0, "", repository.ErrAccountLocked
+	}
+
+	// Seeded users have plain text passwords, others are hashed like in the database
+	err := passwords.Verify(testPassword, user.Password)
+	plainText := errors.Is(err, passwords.ErrUnsupportedHash)
+	if plainText && user.Password != "" && user.Password == testPassword {
+		err = nil
+	}
+	if err != nil {
+		m.failedLogins[user.ID]++
+		if m.App.LockoutAttempts > 0 && m.failedLogins[user.ID] >= m.App.LockoutAttempts {
+			m.failedLogins[user.ID] = 0
+			m.lockedUntil[user.ID] = time.Now().Add(m.App.LockoutDuration)
+			return 0, "", repository.ErrTooManyAttempts
+		}
+		return 0, "", repository.ErrInvalidCredentials
+	}
+
+	delete(m.failedLogins, user.ID)
+	delete(m.lockedUntil, user.ID)
+
+	if !plainText && m.App.PasswordHasher != nil && m.App.PasswordHasher.NeedsRehash(user.Password) {
+		if newHash, err := m.App.PasswordHasher.Hash(testPassword); err == nil {
+			user.Password = newHash
+			m.users[user.ID] = user
+		}
+	}
+	return user.ID, user.Password, nil
 }
 
-// AllUsers retrieves list of all users from the database.
-func (m *testDBRepo) AllUsers() ([]models.User, error) {
-	var users []models.User
-	return users, nil
+// CheckPassword confirms testPassword is the password of the user without counting failed attempts.
+func (m *testDBRepo) CheckPassword(ctx context.Context, userID int64, testPassword string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if _, deleted := m.deletedAt[userID]; !ok || deleted {
+		return repository.ErrInvalidCredentials
+	}
+
+	// Seeded users have plain text passwords, others are hashed like in the database
+	err := passwords.Verify(testPassword, user.Password)
+	if errors.Is(err, passwords.ErrUnsupportedHash) && user.Password != "" && user.Password == testPassword {
+		err = nil
+	}
+	if err != nil {
+		return repository.ErrInvalidCredentials
+	}
+	return nil
+}
+
+// UnlockUser lifts a temporary lock caused by too many failed sign-ins.
+func (m *testDBRepo) UnlockUser(ctx context.Context, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.failedLogins, userID)
+	delete(m.lockedUntil, userID)
+	return nil
+}
+
+// AllUsers retrieves one page of users whose name or email contains search, ordered by ID, together
+// with the number of all matching users.
+func (m *testDBRepo) AllUsers(ctx context.Context, search string, limit, offset int) ([]models.User, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matching []models.User
+	for _, user := range m.users {
+		if _, deleted := m.deletedAt[user.ID]; deleted {
+			continue
+		}
+		name := strings.ToLower(user.FirstName + " " + user.LastName + " " + user.Email)
+		if strings.Contains(name, strings.ToLower(search)) {
+			matching = append(matching, user)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ID < matching[j].ID })
+
+	if offset > len(matching) {
+		offset = len(matching)
+	}
+	end := offset + limit
+	if end > len(matching) {
+		end = len(matching)
+	}
+	return matching[offset:end], len(matching), nil
 }
 
 //InsertUser inserts user into the database
-func (m *testDBRepo) InsertUser(user models.User) (int64, error) {
-	return 1, nil
+func (m *testDBRepo) InsertUser(ctx context.Context, user models.User) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == user.Email {
+			return 0, fmt.Errorf("user with email %s already exists", user.Email)
+		}
+		if u.ID >= user.ID {
+			user.ID = u.ID + 1
+		}
+	}
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	m.users[user.ID] = user
+	m.userRoles[user.ID] = []string{models.RoleUser}
+	return user.ID, nil
 }
 
 // UpdateUser updates user in the database
-func (m *testDBRepo) UpdateUser(user models.User) error {
+func (m *testDBRepo) UpdateUser(ctx context.Context, user models.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.users[user.ID]
+	if !ok {
+		return fmt.Errorf("user with ID %d does not exist", user.ID)
+	}
+	existing.FirstName = user.FirstName
+	existing.LastName = user.LastName
+	existing.Email = user.Email
+	existing.Blocked = user.Blocked
+	m.users[user.ID] = existing
 	return nil
 }
 
+// DeleteUser deletes user from the database together with its tokens and role assignments
+func (m *testDBRepo) DeleteUser(ctx context.Context, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteUser(userID)
+	return nil
+}
+
+// deleteUser removes user and everything that references it; m.mu must be held
+func (m *testDBRepo) deleteUser(userID int64) {
+	delete(m.users, userID)
+	delete(m.deletedAt, userID)
+	delete(m.userRoles, userID)
+	delete(m.failedLogins, userID)
+	delete(m.lockedUntil, userID)
+	delete(m.twoFactor, userID)
+	delete(m.recoveryCodes, userID)
+
+	var identities []models.Identity
+	for _, identity := range m.identities {
+		if identity.UserID != userID {
+			identities = append(identities, identity)
+		}
+	}
+	m.identities = identities
+
+	for id, s := range m.userSessions {
+		if s.UserID == userID {
+			m.deleteUserSession(id)
+		}
+	}
+	for hash, token := range m.tokens {
+		if token.UserID == userID {
+			delete(m.tokens, hash)
+		}
+	}
+	for i, event := range m.auditEvents {
+		if event.ActorID == userID {
+			m.auditEvents[i].ActorID = 0
+		}
+		if event.TargetUserID == userID {
+			m.auditEvents[i].TargetUserID = 0
+		}
+	}
+}
+
+// SoftDeleteUser marks user as deleted and anonymizes it, removing its sessions, tokens, identities and
+// two-factor settings and clearing IP addresses, user agents and email addresses of its audit events.
+func (m *testDBRepo) SoftDeleteUser(ctx context.Context, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if _, deleted := m.deletedAt[userID]; !ok || deleted {
+		return sql.ErrNoRows
+	}
+
+	for id, s := range m.userSessions {
+		if s.UserID == userID {
+			m.deleteUserSession(id)
+		}
+	}
+	for hash, token := range m.tokens {
+		if token.UserID == userID || token.Email == user.Email {
+			delete(m.tokens, hash)
+		}
+	}
+	var identities []models.Identity
+	for _, identity := range m.identities {
+		if identity.UserID != userID {
+			identities = append(identities, identity)
+		}
+	}
+	m.identities = identities
+	delete(m.userRoles, userID)
+	delete(m.failedLogins, userID)
+	delete(m.lockedUntil, userID)
+	delete(m.twoFactor, userID)
+	delete(m.recoveryCodes, userID)
+	for i, event := range m.auditEvents {
+		if event.ActorID != userID && event.TargetUserID != userID {
+			continue
+		}
+		metadata := map[string]string{}
+		for k, v := range event.Metadata {
+			if k != "email" && k != "from" && k != "to" {
+				metadata[k] = v
+			}
+		}
+		m.auditEvents[i].IP = ""
+		m.auditEvents[i].UserAgent = ""
+		m.auditEvents[i].Metadata = metadata
+	}
+
+	user.FirstName = "Deleted"
+	user.LastName = "User"
+	user.Email = fmt.Sprintf("deleted-%d@deleted.invalid", userID)
+	user.Password = ""
+	user.Blocked = true
+	m.users[userID] = user
+	m.deletedAt[userID] = time.Now()
+	return nil
+}
+
+// PurgeDeletedUsers removes users which were soft deleted before deletedBefore.
+func (m *testDBRepo) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged int64
+	for userID, deletedAt := range m.deletedAt {
+		if deletedAt.Before(deletedBefore) {
+			m.deleteUser(userID)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
 // GetUserByID retrieves user from the database by ID
-func (m *testDBRepo) GetUserByID(userID int64) (models.User, error) {
-	if userID == 1 {
-		return models.User{
-			ID:        1,
-			FirstName: "Jon",
-			LastName:  "Doe",
-			Email:     "test@gmail.com",
-			Password:  "password",
-		}, nil
+func (m *testDBRepo) GetUserByID(ctx context.Context, userID int64) (models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return models.User{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userID]; ok {
+		return user, nil
 	}
 	return models.User{}, fmt.Errorf("user with ID %d does not exist", userID)
 }
 
 // GetUserByEmail retrieves user from the database by email
-func (m *testDBRepo) GetUserByEmail(email string) (models.User, error) {
-	if email == "test@gmail.com" {
-		return models.User{
-			ID:        1,
-			FirstName: "Jon",
-			LastName:  "Doe",
-			Email:     "test@gmail.com",
-			Password:  "password",
-		}, nil
+func (m *testDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return models.User{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if user.Email == email {
+			return user, nil
+		}
 	}
 	return models.User{}, fmt.Errorf("user with email %s does not exist", email)
 }
 
 // UpdatePasswordForUser updates specified user's hashed password
-func (m *testDBRepo) UpdatePasswordForUser(user models.User, hash string) error {
+func (m *testDBRepo) UpdatePasswordForUser(ctx context.Context, user models.User, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EnqueueMail sends an email message right away through App.Mailer (if set), so tests can assert against it.
+func (m *testDBRepo) EnqueueMail(ctx context.Context, msg models.MailData) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if msg.RequestID == "" {
+		msg.RequestID = logging.RequestID(ctx)
+	}
+	if m.App.Mailer != nil {
+		if err := m.App.Mailer.Send(msg); err != nil {
+			return 0, err
+		}
+	}
+	return 1, nil
+}
+
+// ClaimMailJobs marks up to limit due jobs as processing and returns them.
+func (m *testDBRepo) ClaimMailJobs(ctx context.Context, limit int, lease time.Duration) ([]models.MailJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var jobs []models.MailJob
+	return jobs, nil
+}
+
+// MarkMailJobSent marks mail queue job as successfully sent.
+func (m *testDBRepo) MarkMailJobSent(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RetryMailJob puts a failed mail queue job back in the queue to be retried at nextAttempt.
+func (m *testDBRepo) RetryMailJob(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeadLetterMailJob marks mail queue job which ran out of attempts as dead.
+func (m *testDBRepo) DeadLetterMailJob(ctx context.Context, id int64, lastError string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertToken stores the token in memory.
+func (m *testDBRepo) InsertToken(ctx context.Context, token models.Token) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokens[string(token.Hash)] = token
+	return nil
+}
+
+// GetToken retrieves a token which has the specified scope, has not expired and has not been used yet.
+func (m *testDBRepo) GetToken(ctx context.Context, plainText, scope string) (models.Token, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Token{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[string(models.TokenHash(plainText))]
+	if !ok || token.Scope != scope || token.ConsumedAt != nil || token.Expiry.Before(time.Now()) {
+		return models.Token{}, errors.New("invalid or expired token")
+	}
+	return token, nil
+}
+
+// ConsumeToken marks a valid token as used and returns it.
+func (m *testDBRepo) ConsumeToken(ctx context.Context, plainText, scope string) (models.Token, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Token{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[string(models.TokenHash(plainText))]
+	if !ok || token.Scope != scope || token.ConsumedAt != nil || token.Expiry.Before(time.Now()) {
+		return models.Token{}, errors.New("invalid or expired token")
+	}
+
+	now := time.Now()
+	token.ConsumedAt = &now
+	m.tokens[string(token.Hash)] = token
+	return token, nil
+}
+
+// RevokeTokens deletes all tokens with the specified scope that were issued for email.
+func (m *testDBRepo) RevokeTokens(ctx context.Context, email, scope string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, token := range m.tokens {
+		if token.Email == email && token.Scope == scope {
+			delete(m.tokens, hash)
+		}
+	}
 	return nil
 }
+
+// RevokeTokensForUser deletes all tokens with the specified scope that were issued for the user.
+func (m *testDBRepo) RevokeTokensForUser(ctx context.Context, userID int64, scope string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, token := range m.tokens {
+		if token.UserID == userID && token.Scope == scope {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+// GetTokensForUser retrieves every token issued for the user, newest first.
+func (m *testDBRepo) GetTokensForUser(ctx context.Context, userID int64) ([]models.Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tokens []models.Token
+	for _, token := range m.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+// testRoles mirrors roles and permissions created by migrations
+var testRoles = []models.Role{
+	{ID: 1, Name: models.RoleUser, Description: "Regular user", Permissions: []string{}},
+	{ID: 2, Name: models.RoleAdmin, Description: "Administrator", Permissions: []string{
+		models.PermissionAdminAccess,
+		models.PermissionAuditRead,
+		models.PermissionRolesWrite,
+		models.PermissionUsersRead,
+		models.PermissionUsersWrite,
+	}},
+}
+
+// AllRoles retrieves every role together with the permissions granted to it.
+func (m *testDBRepo) AllRoles(ctx context.Context) ([]models.Role, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return testRoles, nil
+}
+
+// GetRolesForUser retrieves roles assigned to the user together with the permissions granted to them.
+func (m *testDBRepo) GetRolesForUser(ctx context.Context, userID int64) ([]models.Role, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var roles []models.Role
+	for _, role := range testRoles {
+		for _, name := range m.userRoles[userID] {
+			if role.Name == name {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles, nil
+}
+
+// GetPermissionsForUser retrieves names of all permissions granted to the user through any of its roles.
+func (m *testDBRepo) GetPermissionsForUser(ctx context.Context, userID int64) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	roles, err := m.GetRolesForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []string
+	for _, role := range roles {
+		permissions = append(permissions, role.Permissions...)
+	}
+	return permissions, nil
+}
+
+// AssignRole gives the role with the specified name to the user.
+func (m *testDBRepo) AssignRole(ctx context.Context, userID int64, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	exists := false
+	for _, r := range testRoles {
+		exists = exists || r.Name == role
+	}
+	if !exists {
+		return fmt.Errorf("role %s does not exist", role)
+	}
+
+	for _, name := range m.userRoles[userID] {
+		if name == role {
+			return nil
+		}
+	}
+	m.userRoles[userID] = append(m.userRoles[userID], role)
+	return nil
+}
+
+// RemoveRole takes the role with the specified name away from the user.
+func (m *testDBRepo) RemoveRole(ctx context.Context, userID int64, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var roles []string
+	for _, name := range m.userRoles[userID] {
+		if name != role {
+			roles = append(roles, name)
+		}
+	}
+	m.userRoles[userID] = roles
+	return nil
+}
+
+// GetUserByIdentity retrieves user linked to the subject of an OpenID Connect provider. It returns
+// sql.ErrNoRows if the subject is not linked to any user.
+func (m *testDBRepo) GetUserByIdentity(ctx context.Context, provider, subject string) (models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return models.User{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, identity := range m.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			if user, ok := m.users[identity.UserID]; ok {
+				return user, nil
+			}
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+// GetIdentitiesForUser retrieves external identities linked to the user, ordered by provider
+func (m *testDBRepo) GetIdentitiesForUser(ctx context.Context, userID int64) ([]models.Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var identities []models.Identity
+	for _, identity := range m.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].Provider < identities[j].Provider })
+	return identities, nil
+}
+
+// InsertIdentity links the user to the subject of an OpenID Connect provider. A subject can be linked to
+// one user only and a user can have one identity per provider.
+func (m *testDBRepo) InsertIdentity(ctx context.Context, identity models.Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.identities {
+		if existing.Provider == identity.Provider && (existing.Subject == identity.Subject || existing.UserID == identity.UserID) {
+			return fmt.Errorf("identity %s/%s is already linked", identity.Provider, identity.Subject)
+		}
+	}
+	identity.ID = int64(len(m.identities) + 1)
+	identity.CreatedAt = time.Now()
+	m.identities = append(m.identities, identity)
+	return nil
+}
+
+// InsertUserSession records a new session of a signed in user and returns its ID.
+func (m *testDBRepo) InsertUserSession(ctx context.Context, s models.UserSession) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.userSessions {
+		if existing.Token == s.Token {
+			return 0, fmt.Errorf("session %s is already recorded", s.Token)
+		}
+	}
+
+	m.lastUserSessionID++
+	s.ID = m.lastUserSessionID
+	s.CreatedAt = time.Now()
+	s.LastSeenAt = s.CreatedAt
+	m.userSessions[s.ID] = s
+	return s.ID, nil
+}
+
+// GetUserSession retrieves session of a signed in user by ID
+func (m *testDBRepo) GetUserSession(ctx context.Context, id int64) (models.UserSession, error) {
+	if err := ctx.Err(); err != nil {
+		return models.UserSession{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.userSessions[id]; ok {
+		return s, nil
+	}
+	return models.UserSession{}, sql.ErrNoRows
+}
+
+// GetUserSessionBySelector retrieves session with the remember me cookie selector. It returns
+// sql.ErrNoRows if there is no such session.
+func (m *testDBRepo) GetUserSessionBySelector(ctx context.Context, selector string) (models.UserSession, error) {
+	if err := ctx.Err(); err != nil {
+		return models.UserSession{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.userSessions {
+		if selector != "" && s.RememberSelector == selector {
+			return s, nil
+		}
+	}
+	return models.UserSession{}, sql.ErrNoRows
+}
+
+// GetUserSessionsForUser retrieves sessions of the user which are still in the session store and sessions
+// which can still be restored with a remember me cookie, most recently used first
+func (m *testDBRepo) GetUserSessionsForUser(ctx context.Context, userID int64) ([]models.UserSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []models.UserSession
+	for _, s := range m.userSessions {
+		if s.UserID != userID {
+			continue
+		}
+		_, found, _ := m.App.Session.Store.Find(s.Token)
+		if found || s.RememberExpiry.After(time.Now()) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+// UpdateUserSession updates token, device, last seen time and remember me cookie of a session
+func (m *testDBRepo) UpdateUserSession(ctx context.Context, s models.UserSession) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.userSessions[s.ID]
+	if !ok {
+		return nil
+	}
+	s.UserID = existing.UserID
+	s.CreatedAt = existing.CreatedAt
+	m.userSessions[s.ID] = s
+	return nil
+}
+
+// DeleteUserSession revokes a session; it is deleted from the session store as well
+func (m *testDBRepo) DeleteUserSession(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.deleteUserSession(id)
+}
+
+// DeleteUserSessionsForUser revokes every session of the user
+func (m *testDBRepo) DeleteUserSessionsForUser(ctx context.Context, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.userSessions {
+		if s.UserID == userID {
+			if err := m.deleteUserSession(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteUserSession deletes session and its data in the session store. m.mu must be held.
+func (m *testDBRepo) deleteUserSession(id int64) error {
+	s, ok := m.userSessions[id]
+	if !ok {
+		return nil
+	}
+	delete(m.userSessions, id)
+	return m.App.Session.Store.Delete(s.Token)
+}
+
+// GetTwoFactor retrieves TOTP settings of the user. Users who never enrolled have an empty Secret.
+func (m *testDBRepo) GetTwoFactor(ctx context.Context, userID int64) (models.TwoFactor, error) {
+	if err := ctx.Err(); err != nil {
+		return models.TwoFactor{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return models.TwoFactor{}, fmt.Errorf("user with ID %d does not exist", userID)
+	}
+	twoFactor := m.twoFactor[userID]
+	twoFactor.UserID = userID
+	return twoFactor, nil
+}
+
+// SetTwoFactorSecret stores the (encrypted) secret of an enrollment which has not been confirmed yet.
+func (m *testDBRepo) SetTwoFactorSecret(ctx context.Context, userID int64, secret string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.twoFactor[userID] = models.TwoFactor{UserID: userID, Secret: secret}
+	return nil
+}
+
+// UpdateTwoFactorSecret replaces the encrypted secret without changing whether two-factor authentication
+// is enabled.
+func (m *testDBRepo) UpdateTwoFactorSecret(ctx context.Context, userID int64, secret string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	twoFactor := m.twoFactor[userID]
+	twoFactor.Secret = secret
+	m.twoFactor[userID] = twoFactor
+	return nil
+}
+
+// EnableTwoFactor turns on two-factor authentication with the stored secret and replaces the user's
+// recovery codes.
+func (m *testDBRepo) EnableTwoFactor(ctx context.Context, userID int64, recoveryCodeHashes [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	twoFactor, ok := m.twoFactor[userID]
+	if !ok || twoFactor.Secret == "" {
+		return fmt.Errorf("user %d has no two-factor secret", userID)
+	}
+	twoFactor.Enabled = true
+	m.twoFactor[userID] = twoFactor
+	m.replaceRecoveryCodes(userID, recoveryCodeHashes)
+	return nil
+}
+
+// DisableTwoFactor turns off two-factor authentication and deletes the secret and recovery codes.
+func (m *testDBRepo) DisableTwoFactor(ctx context.Context, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.twoFactor, userID)
+	delete(m.recoveryCodes, userID)
+	return nil
+}
+
+// UseTwoFactorStep records that a code of TOTP period step was accepted. It returns false if a code of
+// the same or a later period has already been used.
+func (m *testDBRepo) UseTwoFactorStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	twoFactor := m.twoFactor[userID]
+	if twoFactor.LastStep >= step {
+		return false, nil
+	}
+	twoFactor.LastStep = step
+	m.twoFactor[userID] = twoFactor
+	return true, nil
+}
+
+// ReplaceRecoveryCodes deletes all recovery codes of the user and stores new ones.
+func (m *testDBRepo) ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryCodeHashes [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.replaceRecoveryCodes(userID, recoveryCodeHashes)
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code of the user as used. It returns false if there is no
+// such code.
+func (m *testDBRepo) UseRecoveryCode(ctx context.Context, userID int64, hash []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.recoveryCodes[userID][string(hash)] {
+		return false, nil
+	}
+	m.recoveryCodes[userID][string(hash)] = false
+	return true, nil
+}
+
+// CountRecoveryCodes returns the number of recovery codes the user has not used yet.
+func (m *testDBRepo) CountRecoveryCodes(ctx context.Context, userID int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, unused := range m.recoveryCodes[userID] {
+		if unused {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// replaceRecoveryCodes replaces recovery codes of the user; the caller must hold m.mu. Codes map to
+// true until they are used.
+func (m *testDBRepo) replaceRecoveryCodes(userID int64, hashes [][]byte) {
+	codes := map[string]bool{}
+	for _, hash := range hashes {
+		codes[string(hash)] = true
+	}
+	m.recoveryCodes[userID] = codes
+}
+
+// InsertAuditEvent records an event in the audit log
+func (m *testDBRepo) InsertAuditEvent(ctx context.Context, event models.AuditEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event.ID = int64(len(m.auditEvents) + 1)
+	event.CreatedAt = time.Now()
+	if event.Metadata == nil {
+		event.Metadata = map[string]string{}
+	}
+	m.auditEvents = append(m.auditEvents, event)
+	return nil
+}
+
+// AuditEvents retrieves audit events matching filter, newest first, together with the number of all
+// matching events. With limit of 0 every matching event is returned.
+func (m *testDBRepo) AuditEvents(ctx context.Context, filter models.AuditFilter, limit, offset int) ([]models.AuditEvent, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matching []models.AuditEvent
+	for i := len(m.auditEvents) - 1; i >= 0; i-- {
+		event := m.auditEvents[i]
+		switch {
+		case filter.UserID != 0 && event.ActorID != filter.UserID && event.TargetUserID != filter.UserID:
+		case filter.Type != "" && event.Type != filter.Type:
+		case !filter.Since.IsZero() && event.CreatedAt.Before(filter.Since):
+		case !filter.Until.IsZero() && !event.CreatedAt.Before(filter.Until):
+		default:
+			matching = append(matching, event)
+		}
+	}
+
+	if offset > len(matching) {
+		offset = len(matching)
+	}
+	end := len(matching)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return matching[offset:end], len(matching), nil
+}
@@ -1,15 +1,93 @@
 package repository
 
-import "github.com/cepa995/go-web-template/internal/models"
+import (
+	"context"
+	"errors"
+	"time"
 
-// DatabaseRepo interface which specifies set of operations for communicating with the database.
+	"github.com/cepa995/go-web-template/internal/models"
+)
+
+// Errors returned by DatabaseRepo.Authenticate
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrAccountBlocked     = errors.New("account is blocked")
+	ErrAccountLocked      = errors.New("account is temporarily locked")
+	// ErrTooManyAttempts is returned only by the failed attempt which locked the account
+	ErrTooManyAttempts = errors.New("too many failed sign-in attempts, account has been locked")
+)
+
+// AuditRepo specifies operations for recording and reading the audit log.
+type AuditRepo interface {
+	InsertAuditEvent(ctx context.Context, event models.AuditEvent) error
+	AuditEvents(ctx context.Context, filter models.AuditFilter, limit, offset int) ([]models.AuditEvent, int, error)
+}
+
+// DatabaseRepo interface which specifies set of operations for communicating with the database. Every
+// operation takes the context of the request (or background job) it is made for, so it is cancelled
+// together with it.
 type DatabaseRepo interface {
 	// User model functions
-	AllUsers() ([]models.User, error)
-	GetUserByID(userID int64) (models.User, error)
-	GetUserByEmail(email string) (models.User, error)
-	InsertUser(user models.User) (int64, error)
-	UpdateUser(user models.User) error
-	UpdatePasswordForUser(user models.User, newHash string) error
-	Authenticate(email string, testPassword string) (int64, string, error)
+	AllUsers(ctx context.Context, search string, limit, offset int) ([]models.User, int, error)
+	GetUserByID(ctx context.Context, userID int64) (models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (models.User, error)
+	InsertUser(ctx context.Context, user models.User) (int64, error)
+	UpdateUser(ctx context.Context, user models.User) error
+	DeleteUser(ctx context.Context, userID int64) error
+	SoftDeleteUser(ctx context.Context, userID int64) error
+	PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int64, error)
+	UpdatePasswordForUser(ctx context.Context, user models.User, newHash string) error
+	Authenticate(ctx context.Context, email string, testPassword string) (int64, string, error)
+	CheckPassword(ctx context.Context, userID int64, testPassword string) error
+	UnlockUser(ctx context.Context, userID int64) error
+
+	// Two-factor authentication functions
+	GetTwoFactor(ctx context.Context, userID int64) (models.TwoFactor, error)
+	SetTwoFactorSecret(ctx context.Context, userID int64, secret string) error
+	UpdateTwoFactorSecret(ctx context.Context, userID int64, secret string) error
+	EnableTwoFactor(ctx context.Context, userID int64, recoveryCodeHashes [][]byte) error
+	DisableTwoFactor(ctx context.Context, userID int64) error
+	UseTwoFactorStep(ctx context.Context, userID int64, step int64) (bool, error)
+	ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryCodeHashes [][]byte) error
+	UseRecoveryCode(ctx context.Context, userID int64, hash []byte) (bool, error)
+	CountRecoveryCodes(ctx context.Context, userID int64) (int, error)
+
+	// External identity functions
+	GetUserByIdentity(ctx context.Context, provider, subject string) (models.User, error)
+	GetIdentitiesForUser(ctx context.Context, userID int64) ([]models.Identity, error)
+	InsertIdentity(ctx context.Context, identity models.Identity) error
+
+	// User session functions
+	InsertUserSession(ctx context.Context, s models.UserSession) (int64, error)
+	GetUserSession(ctx context.Context, id int64) (models.UserSession, error)
+	GetUserSessionBySelector(ctx context.Context, selector string) (models.UserSession, error)
+	GetUserSessionsForUser(ctx context.Context, userID int64) ([]models.UserSession, error)
+	UpdateUserSession(ctx context.Context, s models.UserSession) error
+	DeleteUserSession(ctx context.Context, id int64) error
+	DeleteUserSessionsForUser(ctx context.Context, userID int64) error
+
+	// Role and permission functions
+	AllRoles(ctx context.Context) ([]models.Role, error)
+	GetRolesForUser(ctx context.Context, userID int64) ([]models.Role, error)
+	GetPermissionsForUser(ctx context.Context, userID int64) ([]string, error)
+	AssignRole(ctx context.Context, userID int64, role string) error
+	RemoveRole(ctx context.Context, userID int64, role string) error
+
+	// Token functions
+	InsertToken(ctx context.Context, token models.Token) error
+	GetToken(ctx context.Context, plainText, scope string) (models.Token, error)
+	ConsumeToken(ctx context.Context, plainText, scope string) (models.Token, error)
+	RevokeTokens(ctx context.Context, email, scope string) error
+	RevokeTokensForUser(ctx context.Context, userID int64, scope string) error
+	GetTokensForUser(ctx context.Context, userID int64) ([]models.Token, error)
+
+	// Mail queue functions
+	EnqueueMail(ctx context.Context, msg models.MailData) (int64, error)
+	ClaimMailJobs(ctx context.Context, limit int, lease time.Duration) ([]models.MailJob, error)
+	MarkMailJobSent(ctx context.Context, id int64) error
+	RetryMailJob(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error
+	DeadLetterMailJob(ctx context.Context, id int64, lastError string) error
+
+	// Audit log functions
+	AuditRepo
 }
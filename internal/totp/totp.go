@@ -0,0 +1,129 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Parameters of generated codes. They are the defaults of RFC 6238 and the only ones every
+// authenticator app supports.
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// Skew is the number of periods before and after the current one whose codes are still accepted,
+	// so codes keep working when the clock of the phone is a little off.
+	Skew = 1
+)
+
+// RecoveryCodeCount is the number of recovery codes issued when two-factor authentication is enabled
+const RecoveryCodeCount = 10
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret creates a new random 160-bit secret encoded as base32, the way authenticator apps
+// expect it.
+func GenerateSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// Step returns number of the period t falls into.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for the specified period.
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1000000), nil
+}
+
+// Validate checks code against the periods around t. It returns the period the code belongs to, so the
+// caller can refuse codes from periods which have already been used.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	code = strings.Join(strings.Fields(code), "")
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Step(t)
+	for step := current - Skew; step <= current+Skew; step++ {
+		expected, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningURI returns the otpauth:// URI which authenticator apps read from a QR code.
+func ProvisioningURI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// GenerateRecoveryCodes creates n random single-use recovery codes formatted as xxxxx-xxxxx.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(random))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// RecoveryCodeHash returns the SHA-256 hash under which a recovery code is stored. Codes are compared
+// without dashes, spaces and case, so they can be typed in any way.
+func RecoveryCodeHash(code string) []byte {
+	code = strings.ToLower(strings.Join(strings.FieldsFunc(code, func(r rune) bool {
+		return r == '-' || r == ' '
+	}), ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// IsRecoveryCode returns true if code has the format of a recovery code rather than of a TOTP code.
+func IsRecoveryCode(code string) bool {
+	return len(strings.Join(strings.Fields(code), "")) > Digits
+}
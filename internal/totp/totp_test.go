@@ -0,0 +1,131 @@
+package totp
+
+import (
+	"bytes"
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key used by test vectors in RFC 6238 appendix B
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+// Test vectors of RFC 6238 truncated to 6 digits
+var codeTests = []struct {
+	unix     int64
+	expected string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, e := range codeTests {
+		code, err := Code(rfcSecret, Step(time.Unix(e.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != e.expected {
+			t.Errorf("at %d expected %s, got %s", e.unix, e.expected, code)
+		}
+	}
+
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("expected error for invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	tests := []struct {
+		name  string
+		at    time.Time
+		code  string
+		valid bool
+	}{
+		{"current", now, "050471", true},
+		{"with spaces", now, "050 471", true},
+		{"previous period", now.Add(Period), "050471", true},
+		{"next period", now.Add(-Period), "050471", true},
+		{"too old", now.Add(2 * Period), "050471", false},
+		{"wrong code", now, "123456", false},
+		{"too short", now, "05047", false},
+	}
+
+	for _, e := range tests {
+		step, ok := Validate(rfcSecret, e.code, e.at)
+		if ok != e.valid {
+			t.Errorf("for %s expected %t, got %t", e.name, e.valid, ok)
+		}
+		if ok && step != Step(now) {
+			t.Errorf("for %s expected step %d, got %d", e.name, Step(now), step)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("expected 32 characters, got %d", len(secret))
+	}
+
+	code, _ := Code(secret, Step(time.Now()))
+	if _, ok := Validate(secret, code, time.Now()); !ok {
+		t.Error("expected code of generated secret to be valid")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("My App", "jon@example.com", "SECRET")
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/My App:jon@example.com" {
+		t.Errorf("unexpected URI %s", uri)
+	}
+	if u.Query().Get("secret") != "SECRET" || u.Query().Get("issuer") != "My App" || u.Query().Get("digits") != "6" {
+		t.Errorf("unexpected parameters in %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d", RecoveryCodeCount, len(codes))
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || seen[code] {
+			t.Errorf("unexpected code %s", code)
+		}
+		seen[code] = true
+
+		if !IsRecoveryCode(code) {
+			t.Errorf("expected %s to be recognized as recovery code", code)
+		}
+		typed := strings.ToUpper(strings.Replace(code, "-", " ", 1))
+		if !bytes.Equal(RecoveryCodeHash(code), RecoveryCodeHash(typed)) {
+			t.Errorf("expected %s and %s to have the same hash", code, typed)
+		}
+	}
+
+	if IsRecoveryCode("123 456") {
+		t.Error("expected TOTP code not to be recognized as recovery code")
+	}
+}
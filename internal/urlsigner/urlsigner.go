@@ -1,45 +1,141 @@
 package urlsigner
 
 import (
-	"fmt"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html"
+	"net/url"
 	"strings"
 	"time"
+)
+
+// Param is the query parameter signed URLs carry their token in
+const Param = "signature"
 
-	goalone "github.com/bwmarrin/go-alone"
+// Errors returned by Signer.Verify
+var (
+	ErrMissing      = errors.New("urlsigner: URL is not signed")
+	ErrMalformed    = errors.New("urlsigner: malformed signature")
+	ErrTampered     = errors.New("urlsigner: URL or signature was modified")
+	ErrWrongPurpose = errors.New("urlsigner: URL was signed for another purpose")
+	ErrExpired      = errors.New("urlsigner: signed URL has expired")
 )
 
-// Signer is type which holds secret key for generating signed tokens
+// Claims are stored in the token of a signed URL
+type Claims struct {
+	// Purpose tells what the URL can be used for, e.g. "activate"; it is checked by Verify
+	Purpose string `json:"pur"`
+	// Target is the path and query of the URL without the signature
+	Target string            `json:"tgt"`
+	Expiry time.Time         `json:"exp"`
+	Data   map[string]string `json:"dat,omitempty"`
+}
+
+// Signer signs URLs with HMAC-SHA256. Only path and query are signed, so a URL signed for one host keeps
+// working behind another (e.g. FrontEnd vs. the address the app listens on).
 type Signer struct {
 	Secret []byte
+	// Now returns the current time; tests can replace it
+	Now func() time.Time
 }
 
-// GenerateTokenFromString generates an URL signed token
-func (s *Signer) GenerateTokenFromString(data string) string {
-	var urlToSign string
+// New creates Signer with the specified secret
+func New(secret []byte) *Signer {
+	return &Signer{Secret: secret, Now: time.Now}
+}
 
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	if strings.Contains(data, "?") {
-		urlToSign = fmt.Sprintf("%s&hash=", data)
-	} else {
-		urlToSign = fmt.Sprintf("%s?hash=", data)
+// Sign returns rawURL with a signature parameter which is valid for purpose until ttl passes. data is
+// stored in the token and returned by Verify.
+func (s *Signer) Sign(purpose, rawURL string, ttl time.Duration, data map[string]string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
 	}
+	query := u.Query()
+	query.Del(Param)
 
-	tokenBytes := crypt.Sign([]byte(urlToSign))
-	token := string(tokenBytes)
-	return token
+	claims := Claims{
+		Purpose: purpose,
+		Target:  target(u.EscapedPath(), query),
+		Expiry:  s.Now().Add(ttl).UTC().Truncate(time.Second),
+		Data:    data,
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	query.Set(Param, encoded+"."+base64.RawURLEncoding.EncodeToString(s.mac(encoded)))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
 }
 
-// VerifyToken verifies if the URL signed token is valid or not.
-func (s *Signer) VerifyToken(token string) bool {
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	_, err := crypt.Unsign([]byte(token))
-	return err == nil
+// Verify checks the signature of rawURL, which may be a full URL or just its path and query (e.g.
+// r.URL.RequestURI()). HTML escaped URLs, like ones copied from an email, are accepted as well.
+func (s *Signer) Verify(purpose, rawURL string) (Claims, error) {
+	var claims Claims
+
+	u, err := url.Parse(html.UnescapeString(rawURL))
+	if err != nil {
+		return claims, ErrMalformed
+	}
+	query := u.Query()
+	token := query.Get(Param)
+	if token == "" {
+		return claims, ErrMissing
+	}
+	query.Del(Param)
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, ErrMalformed
+	}
+	if !hmac.Equal(signature, s.mac(parts[0])) {
+		return claims, ErrTampered
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrMalformed
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return claims, ErrMalformed
+	}
+
+	if claims.Purpose != purpose {
+		return claims, ErrWrongPurpose
+	}
+	if claims.Target != target(u.EscapedPath(), query) {
+		return claims, ErrTampered
+	}
+	if !s.Now().Before(claims.Expiry) {
+		return claims, ErrExpired
+	}
+	return claims, nil
 }
 
-// IsExpired returns TRUE if expiry date is ok, FALSE otherwise
-func (s *Signer) IsExpired(token string, minutesUntilExpire int) bool {
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	ts := crypt.Parse([]byte(token))
+// mac returns HMAC-SHA256 of the encoded claims
+func (s *Signer) mac(encoded string) []byte {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
 
-	return time.Since(ts.Timestamp) > time.Duration(minutesUntilExpire)*time.Minute
+// target returns path and query in canonical form, with query parameters sorted by name
+func target(path string, query url.Values) string {
+	if path == "" {
+		path = "/"
+	}
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
 }
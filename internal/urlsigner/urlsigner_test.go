@@ -0,0 +1,93 @@
+package urlsigner
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testSigner() *Signer {
+	s := New([]byte("secret"))
+	s.Now = func() time.Time { return now }
+	return s
+}
+
+func TestSignVerify(t *testing.T) {
+	s := testSigner()
+
+	signed, err := s.Sign("activate", "https://example.com/auth/activate-account?email=jon%40example.com", time.Hour, map[string]string{"name": "Jon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, "https://example.com/auth/activate-account?") || !strings.Contains(signed, Param+"=") {
+		t.Fatalf("unexpected signed URL %s", signed)
+	}
+
+	u, _ := url.Parse(signed)
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"full URL", signed},
+		{"request URI", u.RequestURI()},
+		{"other host", strings.Replace(signed, "https://example.com", "http://localhost:8080", 1)},
+		{"HTML escaped", strings.ReplaceAll(signed, "&", "&amp;")},
+		{"reordered query", "/auth/activate-account?" + Param + "=" + u.Query().Get(Param) + "&email=jon%40example.com"},
+	}
+
+	for _, e := range tests {
+		claims, err := s.Verify("activate", e.url)
+		if err != nil {
+			t.Errorf("for %s unexpected error %v", e.name, err)
+			continue
+		}
+		if claims.Purpose != "activate" || claims.Data["name"] != "Jon" || !claims.Expiry.Equal(now.Add(time.Hour)) {
+			t.Errorf("for %s unexpected claims %+v", e.name, claims)
+		}
+	}
+}
+
+func TestVerify_Errors(t *testing.T) {
+	s := testSigner()
+	signed, _ := s.Sign("reset", "/auth/reset-password?email=jon%40example.com", time.Hour, nil)
+	token := func(u string) string {
+		parsed, _ := url.Parse(u)
+		return parsed.Query().Get(Param)
+	}(signed)
+	parts := strings.Split(token, ".")
+
+	expired := testSigner()
+	expired.Now = func() time.Time { return now.Add(time.Hour) }
+
+	other := testSigner()
+	other.Secret = []byte("other secret")
+
+	tests := []struct {
+		name     string
+		signer   *Signer
+		purpose  string
+		url      string
+		expected error
+	}{
+		{"missing", s, "reset", "/auth/reset-password?email=jon%40example.com", ErrMissing},
+		{"malformed", s, "reset", "/auth/reset-password?" + Param + "=abc", ErrMalformed},
+		{"bad base64 signature", s, "reset", "/auth/reset-password?" + Param + "=" + parts[0] + ".%25%25", ErrMalformed},
+		{"changed query", s, "reset", strings.Replace(signed, "jon%40", "mary%40", 1), ErrTampered},
+		{"changed path", s, "reset", strings.Replace(signed, "reset-password", "activate-account", 1), ErrTampered},
+		{"added parameter", s, "reset", signed + "&admin=1", ErrTampered},
+		{"changed claims", s, "reset", strings.Replace(signed, parts[0], parts[0][:len(parts[0])-2]+"xx", 1), ErrTampered},
+		{"other secret", other, "reset", signed, ErrTampered},
+		{"wrong purpose", s, "activate", signed, ErrWrongPurpose},
+		{"expired", expired, "reset", signed, ErrExpired},
+	}
+
+	for _, e := range tests {
+		if _, err := e.signer.Verify(e.purpose, e.url); !errors.Is(err, e.expected) {
+			t.Errorf("for %s expected %v, got %v", e.name, e.expected, err)
+		}
+	}
+}
@@ -1,4 +1,12 @@
 #!/bin/bash
 
+# Secrets are read from APP_* environment variables (optionally kept in a local .env file)
+# instead of being passed on the command line, see "Configuration" in README.md.
+if [ -f .env ]; then
+    set -a
+    . ./.env
+    set +a
+fi
+
 go build -o app cmd/web/*.go
-./app -dbname=postgres -dbuser=postgres -secret= -dbpassword=password -production=false -cache=false -smtpuser= -smtphost= -frontend=localhost:8080 -smtppass=
+./app -env=${APP_ENV:-development} -production=false -cache=false -frontend=http://localhost:8080